@@ -0,0 +1,275 @@
+package config
+
+import (
+	"slices"
+	"time"
+)
+
+// Builder builds a Config in Go, e.g. for services that embed the proxy:
+//
+//	cfg, err := config.New().
+//		Port(8080).
+//		Group("api", "10.0.0.1:8080", "10.0.0.2:8080").RoundRobin().SlowStart(30 * time.Second).
+//		Rule().Path("/api").To("api").
+//		Build()
+//
+// The config is validated like a config file, with the same rules and
+// messages, and Build returns all the errors rather than a config that is
+// only partly valid. Errors are located with the keys of the config file,
+// e.g. backend_groups[0].servers[1].
+type Builder struct {
+	port          int
+	zone          string
+	groups        []*GroupBuilder
+	rules         []*RuleBuilder
+	notifications *Notifications
+	admin         *adminBuilder
+}
+
+type adminBuilder struct {
+	address string
+	token   string
+}
+
+// GroupBuilder builds a backend group. It embeds the Builder of the config so
+// that the groups and rules that follow can be chained.
+type GroupBuilder struct {
+	*Builder
+	name             string
+	servers          []string
+	placements       []ServerPlacement // of the servers with the same index
+	backupServers    []string
+	healthCheck      *HealthCheck
+	outlierDetection *OutlierDetection
+	panicThreshold   float64
+	slowStart        time.Duration
+}
+
+// RuleBuilder builds a rule. It embeds the Builder of the config so that the
+// groups and rules that follow can be chained.
+type RuleBuilder struct {
+	*Builder
+	host               string
+	path               string
+	backendGroup       string
+	requestOperations  []RequestOperation
+	responseOperations []ResponseOperation
+}
+
+// New returns a Builder of a config listening on any port until Port is set.
+func New() *Builder {
+	return &Builder{}
+}
+
+func (b *Builder) Port(port int) *Builder {
+	b.port = port
+	return b
+}
+
+// Zone is the zone of the proxy, see Config.Zone.
+func (b *Builder) Zone(zone string) *Builder {
+	b.zone = zone
+	return b
+}
+
+// Notifications sends the changes of the health of servers to a webhook. The
+// zero values of Timeout, RetryBackoff and MaxEventsPerMinute get the defaults
+// of config files. MaxRetries is used as is, while config files that do not
+// set it get DefaultMaxRetries.
+func (b *Builder) Notifications(n Notifications) *Builder {
+	b.notifications = &n
+	return b
+}
+
+// Admin enables the admin API on address, [host]:port or unix:/path/to/socket.
+func (b *Builder) Admin(address, token string) *Builder {
+	b.admin = &adminBuilder{address: address, token: token}
+	return b
+}
+
+// Group adds a backend group with the given servers, as hostname[:port] or
+// http://hostname[:port]. Servers are round robin load balanced by default.
+func (b *Builder) Group(name string, servers ...string) *GroupBuilder {
+	g := &GroupBuilder{Builder: b, name: name}
+	for _, server := range servers {
+		g.Server(server, 0, "")
+	}
+	b.groups = append(b.groups, g)
+	return g
+}
+
+// Rule adds a rule, which matches the requests by host and path. Rules are
+// matched in the order they are added.
+func (b *Builder) Rule() *RuleBuilder {
+	r := &RuleBuilder{Builder: b}
+	b.rules = append(b.rules, r)
+	return r
+}
+
+// RoundRobin balances the requests over the servers in turn. It is the only
+// load balancing algorithm, and the default one, so it only makes the choice
+// explicit, like load_balancing: round_robin in config files.
+func (g *GroupBuilder) RoundRobin() *GroupBuilder {
+	return g
+}
+
+// Server adds a server with the given priority, 0 being the highest, and zone,
+// empty when unknown. Servers in another zone than the proxy, see Builder.Zone,
+// rank below the servers of its zone that have the same priority.
+func (g *GroupBuilder) Server(address string, priority int, zone string) *GroupBuilder {
+	g.servers = append(g.servers, address)
+	g.placements = append(g.placements, ServerPlacement{Priority: priority, Zone: zone})
+	return g
+}
+
+// Backups adds servers that only get traffic when no server is healthy.
+func (g *GroupBuilder) Backups(servers ...string) *GroupBuilder {
+	g.backupServers = append(g.backupServers, servers...)
+	return g
+}
+
+// HealthCheck checks the health of the servers. The zero values of Type,
+// Method, ExpectedStatuses and the thresholds get the defaults of config files.
+func (g *GroupBuilder) HealthCheck(hc HealthCheck) *GroupBuilder {
+	g.healthCheck = &hc
+	return g
+}
+
+// OutlierDetection ejects the servers that fail the requests sent to them. The
+// zero values of the durations, the success rate minimums and
+// MaxEjectionPercent get the defaults of config files.
+func (g *GroupBuilder) OutlierDetection(od OutlierDetection) *GroupBuilder {
+	g.outlierDetection = &od
+	return g
+}
+
+// PanicThreshold is the fraction of healthy servers under which the traffic
+// goes to every server, see loadbalancer.WithPanicThreshold.
+func (g *GroupBuilder) PanicThreshold(threshold float64) *GroupBuilder {
+	g.panicThreshold = threshold
+	return g
+}
+
+// SlowStart ramps up the traffic sent to recovered and new servers, see
+// loadbalancer.WithSlowStart.
+func (g *GroupBuilder) SlowStart(window time.Duration) *GroupBuilder {
+	g.slowStart = window
+	return g
+}
+
+// Host matches the requests to the host, with its port if any.
+func (r *RuleBuilder) Host(host string) *RuleBuilder {
+	r.host = host
+	return r
+}
+
+// Path matches the requests to the path, which must be equal to the path of
+// the requests, as in config files: there is no prefix matching. / matches
+// every path.
+func (r *RuleBuilder) Path(path string) *RuleBuilder {
+	r.path = path
+	return r
+}
+
+// To sends the matched requests to the backend group with the given name.
+func (r *RuleBuilder) To(backendGroup string) *RuleBuilder {
+	r.backendGroup = backendGroup
+	return r
+}
+
+// AddRequestHeader adds a header to the matched requests.
+func (r *RuleBuilder) AddRequestHeader(header, value string) *RuleBuilder {
+	r.requestOperations = append(r.requestOperations, &AddHeaderRequestOperation{Header: header, Value: value})
+	return r
+}
+
+// AddResponseHeader adds a header to the responses to the matched requests.
+func (r *RuleBuilder) AddResponseHeader(header, value string) *RuleBuilder {
+	r.responseOperations = append(r.responseOperations, &AddHeaderResponseOperation{Header: header, Value: value})
+	return r
+}
+
+// Build validates and builds the config. The errors are FieldErrors.
+func (b *Builder) Build() (*Config, error) {
+	cfg := &Config{Port: b.port, Zone: b.zone, Notifications: b.notifications}
+	if b.admin != nil {
+		network, address := ParseAdminAddress(b.admin.address)
+		cfg.Admin = &Admin{Network: network, Address: address, Token: b.admin.token}
+	}
+	for _, g := range b.groups {
+		cfg.BackendGroups = append(cfg.BackendGroups, &BackendGroup{
+			Name:             g.name,
+			PanicThreshold:   g.panicThreshold,
+			SlowStart:        g.slowStart,
+			HealthCheck:      g.healthCheck,
+			OutlierDetection: g.outlierDetection,
+		})
+	}
+	for _, r := range b.rules {
+		cfg.Rules = append(cfg.Rules, &Rule{
+			Host:               r.host,
+			Path:               r.path,
+			RequestOperations:  slices.Clone(r.requestOperations),
+			ResponseOperations: slices.Clone(r.responseOperations),
+		})
+	}
+	if errs := b.validate(cfg); len(errs) > 0 {
+		return nil, errs
+	}
+
+	if cfg.Notifications != nil {
+		cfg.Notifications = cfg.Notifications.WithDefaults()
+	}
+	groups := make(map[string]*BackendGroup)
+	for i, bg := range cfg.BackendGroups {
+		bg.Servers = ParseServers(b.groups[i].servers)
+		bg.BackupServers = ParseServers(b.groups[i].backupServers)
+		bg.Priorities = Priorities(bg.Servers, b.groups[i].placements, cfg.Zone)
+		if bg.HealthCheck != nil {
+			bg.HealthCheck = bg.HealthCheck.WithDefaults()
+		}
+		if bg.OutlierDetection != nil {
+			bg.OutlierDetection = bg.OutlierDetection.WithDefaults()
+		}
+		bg.Lb = bg.NewLoadBalancer()
+		groups[bg.Name] = bg
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Path == "/" {
+			rule.Path = ""
+		}
+		rule.BackendGroup = groups[b.rules[i].backendGroup]
+	}
+	return cfg, nil
+}
+
+// validate validates cfg, built but not resolved yet, with the rules of config
+// files.
+func (b *Builder) validate(cfg *Config) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	v.add(ValidateConfig(cfg.Port, len(cfg.BackendGroups), len(cfg.Rules)))
+
+	var names BackendGroupNames
+	for i, bg := range cfg.BackendGroups {
+		v := v.at("backend_groups", i)
+		v.add(ValidateServers(b.groups[i].servers, b.groups[i].backupServers))
+		v.add(ValidatePlacements(b.groups[i].servers, b.groups[i].placements))
+		v.add(bg.Validate())
+		v.add(names.Define(bg.Name, ""))
+	}
+
+	for i, rule := range cfg.Rules {
+		v := v.at("rules", i)
+		v.add(rule.Validate())
+		v.add(names.Check(b.rules[i].backendGroup))
+	}
+
+	if cfg.Notifications != nil {
+		v.at("notifications").add(cfg.Notifications.Validate())
+	}
+	if cfg.Admin != nil {
+		v.at("admin").add(cfg.Admin.Validate())
+	}
+	return errs
+}
@@ -0,0 +1,140 @@
+package config_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	cfg, err := config.New().
+		Port(8080).
+		Zone("eu-west-1a").
+		Admin("127.0.0.1:9901", "secret").
+		Notifications(config.Notifications{WebhookURL: &url.URL{Scheme: "https", Host: "hooks.example.com"}, MaxRetries: config.DefaultMaxRetries}).
+		Group("api", "10.0.0.1:8080", "http://10.0.0.2:8080").RoundRobin().
+		Backups("10.0.0.9:8080").
+		PanicThreshold(0.5).
+		SlowStart(30*time.Second).
+		HealthCheck(config.HealthCheck{Path: "/healthz", Interval: 10 * time.Second, Timeout: time.Second}).
+		OutlierDetection(config.OutlierDetection{Consecutive5xx: 5}).
+		Group("static", "static.io").
+		Server("static.eu-west-1b.io", 0, "eu-west-1b").
+		Server("static.fallback.io", 1, "").
+		Rule().Host("api.io").Path("/v1").To("api").AddRequestHeader("X-Env", "prod").
+		Rule().Path("/").To("static").AddResponseHeader("Cache-Control", "max-age=60").
+		Build()
+	require.NoError(t, err)
+
+	// the builder resolves the config like a config file
+	expected, err := yaml.Parse([]byte(`
+port: 8080
+zone: eu-west-1a
+notifications:
+  webhook_url: https://hooks.example.com
+admin:
+  address: 127.0.0.1:9901
+  token: secret
+backend_groups:
+  - name: api
+    load_balancing: round_robin
+    servers: [10.0.0.1:8080, http://10.0.0.2:8080]
+    backup_servers: [10.0.0.9:8080]
+    panic_threshold: 0.5
+    slow_start: 30s
+    health_check:
+      path: /healthz
+      interval: 10s
+      timeout: 1s
+    outlier_detection:
+      consecutive_5xx: 5
+  - name: static
+    servers:
+      - static.io
+      - address: static.eu-west-1b.io
+        zone: eu-west-1b
+      - address: static.fallback.io
+        priority: 1
+rules:
+  - host: api.io
+    path: /v1
+    backend_group: api
+    request_operations:
+      - type: add_header
+        header: X-Env
+        value: prod
+  - path: /
+    backend_group: static
+    response_operations:
+      - type: add_header
+        header: Cache-Control
+        value: max-age=60
+`), yaml.FormatYAML)
+	require.NoError(t, err)
+	require.Equal(t, expected.Dump(), cfg.Dump())
+	require.Equal(t, expected.BackendGroups[0].OutlierDetection, cfg.BackendGroups[0].OutlierDetection)
+	require.Equal(t, expected.Notifications, cfg.Notifications)
+	require.Equal(t, map[string]int{"http://static.eu-west-1b.io": 1, "http://static.fallback.io": 2}, cfg.BackendGroups[1].Priorities)
+	require.Equal(t, expected.BackendGroups[1].Priorities, cfg.BackendGroups[1].Priorities)
+	require.Same(t, cfg.BackendGroups[0], cfg.Rules[0].BackendGroup)
+	require.Same(t, cfg.BackendGroups[1], cfg.Rules[1].BackendGroup)
+	require.NotNil(t, cfg.BackendGroups[0].Lb)
+}
+
+func TestBuilder_Errors(t *testing.T) {
+	_, err := config.New().Port(70000).Build()
+	require.EqualError(t, err, "port: port must be between 0 and 65535\n"+
+		"backend_groups: at least one backend group must be defined\n"+
+		"rules: at least one rule must be defined")
+
+	// the rules are easy to forget, without them every request is a 404
+	_, err = config.New().Group("api", "10.0.0.1:8080").Build()
+	require.EqualError(t, err, "rules: at least one rule must be defined")
+
+	cfg, err := config.New().
+		Group("api", "10.0.0.1:8080", "not a server").SlowStart(-time.Second).
+		HealthCheck(config.HealthCheck{Path: "healthz", Interval: time.Second, Timeout: time.Second}).
+		Group("api", "10.0.0.2:8080").Server("10.0.0.3:8080", -1, "").
+		Rule().Path("api").To("web").AddRequestHeader("X-Env", "").
+		Rule().
+		Notifications(config.Notifications{RetryBackoff: -time.Second}).
+		Admin("unix:", "").
+		Build()
+	require.Nil(t, cfg)
+	require.EqualError(t, err, `backend_groups[0].servers[1]: server "not a server" must be in format [hostname|IP:port]
+backend_groups[0].slow_start: invalid slow start "-1s": must not be negative
+backend_groups[0].health_check.path: path "healthz" must start with /
+backend_groups[0].health_check.timeout: invalid timeout "1s": must be less than interval "1s"
+backend_groups[1].servers[1].priority: server "10.0.0.3:8080": priority must not be negative
+backend_groups[1].name: name "api" is already used
+rules[0].path: path must start with /
+rules[0].request_operations[0]: value is missing
+rules[0].backend_group: backend group "web" not found
+rules[1]: either host or path must be specified
+rules[1].backend_group: backend_group is required
+notifications.webhook_url: webhook_url "" must be an http or https URL
+notifications.retry_backoff: invalid retry_backoff "-1s": must be greater than 0
+admin.address: address "unix:" must contain the path of the socket
+admin.token: token is required`)
+
+	// the health checks and outlier detections follow the rules of config files
+	_, err = config.New().
+		Group("tcp", "10.0.0.1:8080").
+		HealthCheck(config.HealthCheck{Type: config.TCPHealthCheck, Path: "/x", Interval: time.Second, Timeout: time.Millisecond}).
+		Group("grpc", "10.0.0.2:8080").
+		HealthCheck(config.HealthCheck{Type: config.TCPHealthCheck, Service: "svc", Command: []string{"true"}, Interval: time.Second, Timeout: time.Millisecond}).
+		OutlierDetection(config.OutlierDetection{BaseEjectionTime: time.Minute, MaxEjectionTime: -time.Second}).
+		Rule().Path("/").To("tcp").
+		Build()
+	require.EqualError(t, err, `backend_groups[0].health_check.path: path is not supported by tcp health checks
+backend_groups[1].health_check.service: service is not supported by tcp health checks
+backend_groups[1].health_check.command: command is not supported by tcp health checks
+backend_groups[1].outlier_detection.max_ejection_time: invalid max_ejection_time "-1s": must be greater than 0`)
+	var errs config.FieldErrors
+	require.ErrorAs(t, err, &errs)
+	require.Equal(t, []any{"backend_groups", 1, "health_check", "service"}, errs[1].Path)
+}
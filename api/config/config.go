@@ -1,9 +1,12 @@
 package config
 
 import (
+	"cmp"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"time"
 
 	"github.com/mouad-eh/wasseet/loadbalancer"
@@ -11,18 +14,54 @@ import (
 )
 
 type Config struct {
-	Port          int
+	Port int
+	// Zone is where the proxy runs. Servers of other zones are only used
+	// when the servers of the same zone cannot take all the traffic.
+	Zone          string
 	BackendGroups []*BackendGroup
 	// Ordering for rules is important.
 	// To know the target backend group for a request, we start from the first rule and
 	// move to the next one until we find a match or we reach the end of the list.
 	Rules []*Rule
+	// Notifications is nil when changes of the health of servers are not notified.
+	Notifications *Notifications
+	// Admin is nil when the admin API is disabled.
+	Admin *Admin
 }
 
 func (c *Config) Load() (Config, error) {
 	return *c, nil
 }
 
+// Clone returns a copy of the config whose round robin load balancers are
+// replaced with new ones, without the state of the servers, so that the
+// backend groups of the copy can be changed and load balanced independently
+// of c. Other load balancers are shared.
+func (c *Config) Clone() *Config {
+	clone := *c
+	groups := make(map[*BackendGroup]*BackendGroup, len(c.BackendGroups))
+	clone.BackendGroups = make([]*BackendGroup, len(c.BackendGroups))
+	for i, bg := range c.BackendGroups {
+		cloned := *bg
+		cloned.Servers = slices.Clone(bg.Servers)
+		cloned.BackupServers = slices.Clone(bg.BackupServers)
+		if _, ok := bg.Lb.(*loadbalancer.RoundRobin); ok {
+			cloned.Lb = cloned.NewLoadBalancer()
+		}
+		groups[bg] = &cloned
+		clone.BackendGroups[i] = &cloned
+	}
+	clone.Rules = make([]*Rule, len(c.Rules))
+	for i, rule := range c.Rules {
+		cloned := *rule
+		if bg, ok := groups[rule.BackendGroup]; ok {
+			cloned.BackendGroup = bg
+		}
+		clone.Rules[i] = &cloned
+	}
+	return &clone
+}
+
 // GetFirstMatchingRule returns an error if there are no rules.
 // We expect user to provide no rules if there is only one backend group, but
 // in this case we should always have default rule that matches all requests.
@@ -39,17 +78,231 @@ func (c *Config) GetFirstMatchingRule(req request.ServerRequest) (*Rule, error)
 }
 
 type BackendGroup struct {
-	Name        string
-	Lb          loadbalancer.LoadBalancer
-	Servers     []*url.URL
-	HealthCheck *HealthCheck
+	Name    string
+	Lb      loadbalancer.LoadBalancer
+	Servers []*url.URL
+	// BackupServers only receive traffic when none of the servers is healthy.
+	BackupServers []*url.URL
+	// Priorities maps servers to their priority level, see loadbalancer.WithPriorities.
+	// It is nil when all servers have the highest priority.
+	Priorities       map[string]int
+	HealthCheck      *HealthCheck
+	OutlierDetection *OutlierDetection
+	// PanicThreshold is the fraction of healthy servers under which
+	// the load balancer routes to all servers, see loadbalancer.WithPanicThreshold.
+	PanicThreshold float64
+	// SlowStart is the duration over which the traffic sent to a recovered
+	// or newly added server is ramped up, see loadbalancer.WithSlowStart.
+	SlowStart time.Duration
+}
+
+// NewLoadBalancer returns a round robin load balancer of the servers of the
+// group, configured by its backup servers, priorities, panic threshold and
+// slow start.
+func (bg *BackendGroup) NewLoadBalancer() loadbalancer.LoadBalancer {
+	opts := []loadbalancer.Option{
+		loadbalancer.WithPanicThreshold(bg.PanicThreshold),
+		loadbalancer.WithSlowStart(bg.SlowStart),
+	}
+	if len(bg.BackupServers) > 0 {
+		opts = append(opts, loadbalancer.WithBackups(bg.BackupServers))
+	}
+	if len(bg.Priorities) > 0 {
+		opts = append(opts, loadbalancer.WithPriorities(bg.Priorities))
+	}
+	return loadbalancer.NewRoundRobin(bg.Servers, opts...)
+}
+
+// AllServers returns both the servers and the backup servers of the group.
+func (bg *BackendGroup) AllServers() []*url.URL {
+	if len(bg.BackupServers) == 0 {
+		return bg.Servers
+	}
+	servers := make([]*url.URL, 0, len(bg.Servers)+len(bg.BackupServers))
+	servers = append(servers, bg.Servers...)
+	return append(servers, bg.BackupServers...)
 }
 
 type HealthCheck struct {
-	Path     string
+	Type HealthCheckType
+	// Path, Method, Host, Headers and the expected status and body are only
+	// used by HTTP health checks.
+	Path   string
+	Method string
+	// Host overrides the Host header of the check request when not empty.
+	Host    string
+	Headers http.Header
+	// A check passes when the status code of the response is in one of
+	// ExpectedStatuses and the body contains ExpectedBody and matches
+	// ExpectedBodyRegex, when they are set.
+	ExpectedStatuses  []StatusRange
+	ExpectedBody      string
+	ExpectedBodyRegex *regexp.Regexp
+	// Send is written to the connection of a TCP health check, which passes
+	// if the data read back contains Expect. Without Send and Expect, a TCP
+	// health check passes as soon as the connection is established.
+	Send   string
+	Expect string
+	// Service is the name of the service whose status is queried by a gRPC
+	// health check, the whole server by default.
+	Service string
+	// Command is run by exec health checks, which pass when it exits with 0.
+	Command []string
+	// Scheme and Port override the ones of the server when not empty, for
+	// servers exposing their health on a dedicated listener.
+	Scheme   string
+	Port     int
 	Interval time.Duration
 	Timeout  time.Duration
-	Retries  int
+	// HealthyThreshold is the number of consecutive passing checks for an
+	// unhealthy server to become healthy, UnhealthyThreshold is the number
+	// of consecutive failing checks for a healthy server to become unhealthy.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+type HealthCheckType string
+
+const (
+	HTTPHealthCheck HealthCheckType = "http"
+	TCPHealthCheck  HealthCheckType = "tcp"
+	// GRPCHealthCheck uses the grpc.health.v1 protocol, over h2c unless the
+	// scheme of the health check is https.
+	GRPCHealthCheck HealthCheckType = "grpc"
+	ExecHealthCheck HealthCheckType = "exec"
+)
+
+// HealthCheckTypes are the types of health checks, HTTPHealthCheck being the
+// default.
+var HealthCheckTypes = []HealthCheckType{HTTPHealthCheck, TCPHealthCheck, GRPCHealthCheck, ExecHealthCheck}
+
+func (hc HealthCheck) typeOrDefault() HealthCheckType {
+	if hc.Type == "" {
+		return HTTPHealthCheck
+	}
+	return hc.Type
+}
+
+// WithDefaults returns a copy of the health check whose type, method,
+// expected statuses and thresholds are set to their defaults when zero.
+func (hc HealthCheck) WithDefaults() *HealthCheck {
+	hc.Type = hc.typeOrDefault()
+	if hc.Type == HTTPHealthCheck {
+		if hc.Method == "" {
+			hc.Method = http.MethodGet
+		}
+		if len(hc.ExpectedStatuses) == 0 {
+			hc.ExpectedStatuses = []StatusRange{{Min: http.StatusOK, Max: http.StatusOK}}
+		}
+	}
+	hc.HealthyThreshold = max(1, hc.HealthyThreshold)
+	hc.UnhealthyThreshold = max(1, hc.UnhealthyThreshold)
+	return &hc
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (r StatusRange) Contains(status int) bool {
+	return status >= r.Min && status <= r.Max
+}
+
+// OutlierDetection ejects servers from the load balancing pool based on the
+// responses to proxied requests. A detector is disabled when its threshold is 0.
+type OutlierDetection struct {
+	// Consecutive5xx is the number of consecutive 5xx responses or connection
+	// errors after which a server is ejected.
+	Consecutive5xx int
+	// ConsecutiveConnectionErrors is the number of consecutive connection
+	// errors after which a server is ejected.
+	ConsecutiveConnectionErrors int
+	// Servers whose success rate over an interval is below the mean success
+	// rate of the group minus SuccessRateStdevFactor standard deviations are
+	// ejected. Only servers with at least SuccessRateRequestVolume requests
+	// are considered and only when there are at least SuccessRateMinimumHosts of them.
+	SuccessRateStdevFactor   float64
+	SuccessRateMinimumHosts  int
+	SuccessRateRequestVolume int
+	// Interval between two success rate analyses and unejection sweeps.
+	Interval time.Duration
+	// A server is ejected for BaseEjectionTime multiplied by the number of
+	// times it has been ejected recently, up to MaxEjectionTime.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent caps the percentage of servers of the group that can
+	// be ejected at the same time. At least one server can always be ejected.
+	MaxEjectionPercent int
+}
+
+const (
+	defaultOutlierDetectionInterval = 10 * time.Second
+	defaultBaseEjectionTime         = 30 * time.Second
+	defaultMaxEjectionTime          = 300 * time.Second
+	defaultMaxEjectionPercent       = 10
+	defaultSuccessRateMinimumHosts  = 5
+	defaultSuccessRateRequestVolume = 100
+)
+
+// WithDefaults returns a copy of the outlier detection whose durations,
+// success rate minimums and MaxEjectionPercent are set to their defaults when
+// zero.
+func (od OutlierDetection) WithDefaults() *OutlierDetection {
+	od.SuccessRateMinimumHosts = cmp.Or(od.SuccessRateMinimumHosts, defaultSuccessRateMinimumHosts)
+	od.SuccessRateRequestVolume = cmp.Or(od.SuccessRateRequestVolume, defaultSuccessRateRequestVolume)
+	od.Interval = cmp.Or(od.Interval, defaultOutlierDetectionInterval)
+	od.BaseEjectionTime = cmp.Or(od.BaseEjectionTime, defaultBaseEjectionTime)
+	od.MaxEjectionTime = cmp.Or(od.MaxEjectionTime, defaultMaxEjectionTime)
+	od.MaxEjectionPercent = cmp.Or(od.MaxEjectionPercent, defaultMaxEjectionPercent)
+	return &od
+}
+
+// Notifications sends the changes of the health of servers as JSON events
+// to a webhook.
+type Notifications struct {
+	WebhookURL *url.URL
+	Headers    http.Header
+	// Timeout of a single delivery attempt.
+	Timeout time.Duration
+	// A failed delivery is retried up to MaxRetries times, waiting
+	// RetryBackoff before the first retry and twice as long before each next one.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// MaxEventsPerMinute caps the number of events sent so that flapping
+	// servers do not flood the webhook. Events above the limit are dropped.
+	MaxEventsPerMinute int
+}
+
+const (
+	defaultNotificationTimeout = 5 * time.Second
+	defaultRetryBackoff        = time.Second
+	defaultMaxEventsPerMinute  = 60
+	// DefaultMaxRetries is the number of retries of config files that do
+	// not set it. It is not set by WithDefaults since 0 disables retries.
+	DefaultMaxRetries = 3
+)
+
+// WithDefaults returns a copy of the notifications whose Timeout,
+// RetryBackoff and MaxEventsPerMinute are set to their defaults when zero.
+func (n Notifications) WithDefaults() *Notifications {
+	n.Timeout = cmp.Or(n.Timeout, defaultNotificationTimeout)
+	n.RetryBackoff = cmp.Or(n.RetryBackoff, defaultRetryBackoff)
+	n.MaxEventsPerMinute = cmp.Or(n.MaxEventsPerMinute, defaultMaxEventsPerMinute)
+	return &n
+}
+
+// Admin is the admin API of the proxy, served on its own listener.
+type Admin struct {
+	// Network is either "tcp" or "unix".
+	Network string
+	Address string
+	// Token must be sent by clients as a bearer token.
+	Token string
+	// StateFile persists the servers added and removed through the admin
+	// API across restarts. It is optional.
+	StateFile string
 }
 
 type Rule struct {
@@ -101,6 +354,10 @@ func (op *AddHeaderRequestOperation) Apply(req request.ServerRequest) {
 	req.Header.Add(op.Header, op.Value)
 }
 
+func (op *AddHeaderRequestOperation) Validate() error {
+	return validateAddHeader(op.Header, op.Value)
+}
+
 type AddHeaderResponseOperation struct {
 	Header string
 	Value  string
@@ -109,3 +366,17 @@ type AddHeaderResponseOperation struct {
 func (op *AddHeaderResponseOperation) Apply(resp *http.Response) {
 	resp.Header.Add(op.Header, op.Value)
 }
+
+func (op *AddHeaderResponseOperation) Validate() error {
+	return validateAddHeader(op.Header, op.Value)
+}
+
+func validateAddHeader(header, value string) error {
+	if header == "" {
+		return fmt.Errorf("header is missing")
+	}
+	if value == "" {
+		return fmt.Errorf("value is missing")
+	}
+	return nil
+}
@@ -26,7 +26,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://any.com/api", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: true,
 		},
@@ -38,7 +38,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com/any/path", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: true,
 		},
@@ -50,7 +50,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com/other", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: false,
 		},
@@ -62,7 +62,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://different.com/api/users", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: false,
 		},
@@ -74,7 +74,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com/api", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: true,
 		},
@@ -86,7 +86,7 @@ func TestRuleMatch(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://other.com/other", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expected: false,
 		},
@@ -125,7 +125,7 @@ func TestApplyRequestOperations(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := httptest.NewRequest("GET", "http://example.com", nil)
-			serverReq := request.ServerRequest{req}
+			serverReq := request.ServerRequest{Request: req}
 
 			rule := &config.Rule{
 				RequestOperations: tt.operations,
@@ -219,7 +219,7 @@ func TestGetFirstMatchingRule(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expectError: false,
 			expectRule: &config.Rule{
@@ -245,7 +245,7 @@ func TestGetFirstMatchingRule(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://second.com/api", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expectError: false,
 			expectRule: &config.Rule{
@@ -267,7 +267,7 @@ func TestGetFirstMatchingRule(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://nomatch.com/other", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expectError: true,
 		},
@@ -278,7 +278,7 @@ func TestGetFirstMatchingRule(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expectError: true,
 		},
@@ -299,7 +299,7 @@ func TestGetFirstMatchingRule(t *testing.T) {
 			},
 			request: func() request.ServerRequest {
 				req := httptest.NewRequest("GET", "http://example.com/api", nil)
-				return request.ServerRequest{req}
+				return request.ServerRequest{Request: req}
 			}(),
 			expectError: false,
 			expectRule: &config.Rule{
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+type ChangeType string
+
+const (
+	Added   ChangeType = "added"
+	Removed ChangeType = "removed"
+	Changed ChangeType = "changed"
+)
+
+// Change is a difference between two configs. Path locates what changed with
+// the keys of the config, backend groups being identified by their name,
+// servers by their URL and rules by their host and path, e.g.
+// backend_groups[api].servers or rules[api.io/v1].backend_group. Old and New
+// are the values from the dumps of the configs, so secrets are redacted.
+type Change struct {
+	Type ChangeType `json:"type"`
+	Path string     `json:"path"`
+	Old  any        `json:"old,omitempty"`
+	New  any        `json:"new,omitempty"`
+}
+
+// String formats the change as a line of a diff, e.g.
+// + backend_groups[api].servers: http://10.0.0.5:8080
+func (c Change) String() string {
+	switch c.Type {
+	case Added:
+		return fmt.Sprintf("+ %s: %s", c.Path, formatValue(c.New))
+	case Removed:
+		return fmt.Sprintf("- %s: %s", c.Path, formatValue(c.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Path, formatValue(c.Old), formatValue(c.New))
+	}
+}
+
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Diff returns the changes that turn prev into next.
+func Diff(prev, next *Config) []Change {
+	return DiffDumps(prev.Dump(), next.Dump())
+}
+
+// DiffDumps returns the changes that turn the config dumped as prev into the
+// one dumped as next, e.g. to compare a config file with the active config
+// returned by the admin API.
+func DiffDumps(prev, next Dump) []Change {
+	d := &differ{changes: []Change{}}
+	d.compare("port", prev.Port, next.Port)
+	d.compare("zone", prev.Zone, next.Zone)
+	d.backendGroups(prev.BackendGroups, next.BackendGroups)
+	d.rules(prev.Rules, next.Rules)
+	d.compare("notifications", prev.Notifications, next.Notifications)
+	d.compare("admin", prev.Admin, next.Admin)
+	return d.changes
+}
+
+type differ struct {
+	changes []Change
+}
+
+func (d *differ) add(typ ChangeType, path string, old, new any) {
+	d.changes = append(d.changes, Change{Type: typ, Path: path, Old: old, New: new})
+}
+
+// compare reports a change of a value that is not identified by a key. Zero
+// values stand for values that are not set.
+func (d *differ) compare(path string, old, new any) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	switch {
+	case isZero(old):
+		d.add(Added, path, nil, new)
+	case isZero(new):
+		d.add(Removed, path, old, nil)
+	default:
+		d.add(Changed, path, old, new)
+	}
+}
+
+func isZero(v any) bool {
+	return v == nil || reflect.ValueOf(v).IsZero()
+}
+
+func (d *differ) backendGroups(prev, next []BackendGroupDump) {
+	prevByName := make(map[string]BackendGroupDump)
+	for _, bg := range prev {
+		prevByName[bg.Name] = bg
+	}
+	nextNames := make(map[string]bool)
+	for _, bg := range next {
+		nextNames[bg.Name] = true
+	}
+	for _, bg := range prev {
+		if !nextNames[bg.Name] {
+			d.add(Removed, fmt.Sprintf("backend_groups[%s]", bg.Name), bg, nil)
+		}
+	}
+
+	for _, bg := range next {
+		path := fmt.Sprintf("backend_groups[%s]", bg.Name)
+		old, ok := prevByName[bg.Name]
+		if !ok {
+			d.add(Added, path, nil, bg)
+			continue
+		}
+		d.members(path+".servers", old.Servers, bg.Servers)
+		d.members(path+".backup_servers", old.BackupServers, bg.BackupServers)
+		d.compare(path+".load_balancing", old.LoadBalancing, bg.LoadBalancing)
+		if len(old.Priorities) > 0 || len(bg.Priorities) > 0 {
+			d.compare(path+".priorities", old.Priorities, bg.Priorities)
+		}
+		d.compare(path+".health_check", old.HealthCheck, bg.HealthCheck)
+		d.compare(path+".outlier_detection", old.OutlierDetection, bg.OutlierDetection)
+		d.compare(path+".panic_threshold", old.PanicThreshold, bg.PanicThreshold)
+		d.compare(path+".slow_start", old.SlowStart, bg.SlowStart)
+	}
+}
+
+// members reports the values added to and removed from a list whose order
+// does not matter, e.g. of servers.
+func (d *differ) members(path string, prev, next []string) {
+	for _, v := range prev {
+		if !slices.Contains(next, v) {
+			d.add(Removed, path, v, nil)
+		}
+	}
+	for _, v := range next {
+		if !slices.Contains(prev, v) {
+			d.add(Added, path, nil, v)
+		}
+	}
+}
+
+func (d *differ) rules(prev, next []RuleDump) {
+	prevKeys, nextKeys := ruleKeys(prev), ruleKeys(next)
+	prevByKey := make(map[string]RuleDump)
+	for i, rule := range prev {
+		prevByKey[prevKeys[i]] = rule
+	}
+	for i, rule := range prev {
+		if !slices.Contains(nextKeys, prevKeys[i]) {
+			d.add(Removed, fmt.Sprintf("rules[%s]", prevKeys[i]), rule, nil)
+		}
+	}
+
+	for i, rule := range next {
+		path := fmt.Sprintf("rules[%s]", nextKeys[i])
+		old, ok := prevByKey[nextKeys[i]]
+		if !ok {
+			d.add(Added, path, nil, rule)
+			continue
+		}
+		d.compare(path+".backend_group", old.BackendGroup, rule.BackendGroup)
+		d.operations(path+".request_operations", old.RequestOperations, rule.RequestOperations)
+		d.operations(path+".response_operations", old.ResponseOperations, rule.ResponseOperations)
+	}
+
+	// the first matching rule wins, so the order of the rules matters
+	var prevOrder, nextOrder []string
+	for _, key := range prevKeys {
+		if slices.Contains(nextKeys, key) {
+			prevOrder = append(prevOrder, key)
+		}
+	}
+	for _, key := range nextKeys {
+		if slices.Contains(prevKeys, key) {
+			nextOrder = append(nextOrder, key)
+		}
+	}
+	if !slices.Equal(prevOrder, nextOrder) {
+		d.add(Changed, "rules.order", prevOrder, nextOrder)
+	}
+}
+
+// ruleKeys identifies the rules by their host and path, numbering the rules
+// that share them, e.g. api.io/v1 and api.io/v1#2.
+func ruleKeys(rules []RuleDump) []string {
+	keys := make([]string, len(rules))
+	seen := make(map[string]int)
+	for i, rule := range rules {
+		key := rule.Host + rule.Path
+		if key == "" {
+			key = "*"
+		}
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			key = fmt.Sprintf("%s#%d", key, n)
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// operations reports the operations added and removed, or the new order of
+// the operations when only their order changed, since they apply in order.
+func (d *differ) operations(path string, prev, next []OperationDump) {
+	added := slices.Clone(next)
+	var removed []OperationDump
+	for _, op := range prev {
+		if i := slices.Index(added, op); i >= 0 {
+			added = slices.Delete(added, i, i+1)
+		} else {
+			removed = append(removed, op)
+		}
+	}
+	for _, op := range removed {
+		d.add(Removed, path, op.String(), nil)
+	}
+	for _, op := range added {
+		d.add(Added, path, nil, op.String())
+	}
+	if len(added) == 0 && len(removed) == 0 && !slices.Equal(prev, next) {
+		d.add(Changed, path, operationStrings(prev), operationStrings(next))
+	}
+}
+
+// String formats the operation as e.g. add_header X-Env: prod.
+func (op OperationDump) String() string {
+	var b strings.Builder
+	b.WriteString(op.Type)
+	if op.Header != "" {
+		b.WriteString(" " + op.Header)
+	}
+	if op.Value != "" {
+		b.WriteString(": " + op.Value)
+	}
+	return b.String()
+}
+
+func operationStrings(ops []OperationDump) []string {
+	s := make([]string, len(ops))
+	for i, op := range ops {
+		s[i] = op.String()
+	}
+	return s
+}
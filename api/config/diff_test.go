@@ -0,0 +1,60 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffDumps(t *testing.T) {
+	prev := config.Dump{
+		Port: 8080,
+		BackendGroups: []config.BackendGroupDump{
+			{Name: "api", LoadBalancing: "round_robin", Servers: []string{"http://api1.io", "http://api2.io"}},
+			{Name: "static", LoadBalancing: "round_robin", Servers: []string{"http://static.io"}},
+		},
+		Rules: []config.RuleDump{
+			{Path: "/api", BackendGroup: "api", RequestOperations: []config.OperationDump{
+				{Type: "add_header", Header: "X-Env", Value: "prod"},
+			}},
+			{Path: "/static", BackendGroup: "static"},
+			{Host: "old.io", BackendGroup: "static"},
+		},
+	}
+	next := config.Dump{
+		Port: 8081,
+		BackendGroups: []config.BackendGroupDump{
+			{Name: "api", LoadBalancing: "round_robin", Servers: []string{"http://api2.io", "http://api3.io"}, SlowStart: "30s"},
+			{Name: "web", LoadBalancing: "round_robin", Servers: []string{"http://web.io"}},
+		},
+		Rules: []config.RuleDump{
+			{Path: "/static", BackendGroup: "web"},
+			{Path: "/api", BackendGroup: "api", RequestOperations: []config.OperationDump{
+				{Type: "add_header", Header: "X-Env", Value: "staging"},
+			}},
+		},
+		Admin: &config.AdminDump{Network: "tcp", Address: "127.0.0.1:9901"},
+	}
+
+	var lines []string
+	for _, change := range config.DiffDumps(prev, next) {
+		lines = append(lines, change.String())
+	}
+	require.Equal(t, []string{
+		"~ port: 8080 -> 8081",
+		`- backend_groups[static]: {"name":"static","load_balancing":"round_robin","servers":["http://static.io"]}`,
+		"- backend_groups[api].servers: http://api1.io",
+		"+ backend_groups[api].servers: http://api3.io",
+		"+ backend_groups[api].slow_start: 30s",
+		`+ backend_groups[web]: {"name":"web","load_balancing":"round_robin","servers":["http://web.io"]}`,
+		`- rules[old.io]: {"host":"old.io","backend_group":"static"}`,
+		"~ rules[/static].backend_group: static -> web",
+		"- rules[/api].request_operations: add_header X-Env: prod",
+		"+ rules[/api].request_operations: add_header X-Env: staging",
+		`~ rules.order: ["/api","/static"] -> ["/static","/api"]`,
+		`+ admin: {"network":"tcp","address":"127.0.0.1:9901"}`,
+	}, lines)
+
+	require.Empty(t, config.DiffDumps(next, next))
+}
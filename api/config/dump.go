@@ -0,0 +1,269 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mouad-eh/wasseet/loadbalancer"
+)
+
+// redacted replaces the values of headers and the credentials of URLs in dumps.
+const redacted = "<redacted>"
+
+// Dump is a serializable description of a Config, e.g. to inspect the active
+// config. Durations are formatted as strings and secrets are redacted.
+type Dump struct {
+	Port          int                `json:"port" yaml:"port"`
+	Zone          string             `json:"zone,omitempty" yaml:"zone,omitempty"`
+	BackendGroups []BackendGroupDump `json:"backend_groups" yaml:"backend_groups"`
+	Rules         []RuleDump         `json:"rules" yaml:"rules"`
+	Notifications *NotificationsDump `json:"notifications,omitempty" yaml:"notifications,omitempty"`
+	Admin         *AdminDump         `json:"admin,omitempty" yaml:"admin,omitempty"`
+}
+
+type BackendGroupDump struct {
+	Name             string                `json:"name" yaml:"name"`
+	LoadBalancing    string                `json:"load_balancing" yaml:"load_balancing"`
+	Servers          []string              `json:"servers" yaml:"servers"`
+	BackupServers    []string              `json:"backup_servers,omitempty" yaml:"backup_servers,omitempty"`
+	Priorities       map[string]int        `json:"priorities,omitempty" yaml:"priorities,omitempty"`
+	HealthCheck      *HealthCheckDump      `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionDump `json:"outlier_detection,omitempty" yaml:"outlier_detection,omitempty"`
+	PanicThreshold   float64               `json:"panic_threshold,omitempty" yaml:"panic_threshold,omitempty"`
+	SlowStart        string                `json:"slow_start,omitempty" yaml:"slow_start,omitempty"`
+}
+
+type HealthCheckDump struct {
+	Type               HealthCheckType     `json:"type" yaml:"type"`
+	Path               string              `json:"path,omitempty" yaml:"path,omitempty"`
+	Method             string              `json:"method,omitempty" yaml:"method,omitempty"`
+	Host               string              `json:"host,omitempty" yaml:"host,omitempty"`
+	Headers            map[string][]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	ExpectedStatuses   []string            `json:"expected_statuses,omitempty" yaml:"expected_statuses,omitempty"`
+	ExpectedBody       string              `json:"expected_body,omitempty" yaml:"expected_body,omitempty"`
+	ExpectedBodyRegex  string              `json:"expected_body_regex,omitempty" yaml:"expected_body_regex,omitempty"`
+	Send               string              `json:"send,omitempty" yaml:"send,omitempty"`
+	Expect             string              `json:"expect,omitempty" yaml:"expect,omitempty"`
+	Service            string              `json:"service,omitempty" yaml:"service,omitempty"`
+	Command            []string            `json:"command,omitempty" yaml:"command,omitempty"`
+	Scheme             string              `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	Port               int                 `json:"port,omitempty" yaml:"port,omitempty"`
+	Interval           string              `json:"interval" yaml:"interval"`
+	Timeout            string              `json:"timeout" yaml:"timeout"`
+	HealthyThreshold   int                 `json:"healthy_threshold" yaml:"healthy_threshold"`
+	UnhealthyThreshold int                 `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+}
+
+type OutlierDetectionDump struct {
+	Consecutive5xx              int     `json:"consecutive_5xx" yaml:"consecutive_5xx"`
+	ConsecutiveConnectionErrors int     `json:"consecutive_connection_errors" yaml:"consecutive_connection_errors"`
+	SuccessRateStdevFactor      float64 `json:"success_rate_stdev_factor" yaml:"success_rate_stdev_factor"`
+	SuccessRateMinimumHosts     int     `json:"success_rate_minimum_hosts" yaml:"success_rate_minimum_hosts"`
+	SuccessRateRequestVolume    int     `json:"success_rate_request_volume" yaml:"success_rate_request_volume"`
+	Interval                    string  `json:"interval" yaml:"interval"`
+	BaseEjectionTime            string  `json:"base_ejection_time" yaml:"base_ejection_time"`
+	MaxEjectionTime             string  `json:"max_ejection_time" yaml:"max_ejection_time"`
+	MaxEjectionPercent          int     `json:"max_ejection_percent" yaml:"max_ejection_percent"`
+}
+
+type RuleDump struct {
+	Host               string          `json:"host,omitempty" yaml:"host,omitempty"`
+	Path               string          `json:"path,omitempty" yaml:"path,omitempty"`
+	BackendGroup       string          `json:"backend_group" yaml:"backend_group"`
+	RequestOperations  []OperationDump `json:"request_operations,omitempty" yaml:"request_operations,omitempty"`
+	ResponseOperations []OperationDump `json:"response_operations,omitempty" yaml:"response_operations,omitempty"`
+}
+
+type OperationDump struct {
+	Type   string `json:"type" yaml:"type"`
+	Header string `json:"header,omitempty" yaml:"header,omitempty"`
+	Value  string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+type NotificationsDump struct {
+	WebhookURL         string              `json:"webhook_url" yaml:"webhook_url"`
+	Headers            map[string][]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Timeout            string              `json:"timeout" yaml:"timeout"`
+	MaxRetries         int                 `json:"max_retries" yaml:"max_retries"`
+	RetryBackoff       string              `json:"retry_backoff" yaml:"retry_backoff"`
+	MaxEventsPerMinute int                 `json:"max_events_per_minute" yaml:"max_events_per_minute"`
+}
+
+// AdminDump leaves the token out.
+type AdminDump struct {
+	Network   string `json:"network" yaml:"network"`
+	Address   string `json:"address" yaml:"address"`
+	StateFile string `json:"state_file,omitempty" yaml:"state_file,omitempty"`
+}
+
+func (c *Config) Dump() Dump {
+	dump := Dump{
+		Port:          c.Port,
+		Zone:          c.Zone,
+		BackendGroups: make([]BackendGroupDump, len(c.BackendGroups)),
+		Rules:         make([]RuleDump, len(c.Rules)),
+	}
+	for i, bg := range c.BackendGroups {
+		dump.BackendGroups[i] = bg.dump()
+	}
+	for i, rule := range c.Rules {
+		dump.Rules[i] = rule.dump()
+	}
+	if n := c.Notifications; n != nil {
+		dump.Notifications = &NotificationsDump{
+			WebhookURL:         RedactURL(n.WebhookURL),
+			Headers:            redactHeaders(n.Headers),
+			Timeout:            n.Timeout.String(),
+			MaxRetries:         n.MaxRetries,
+			RetryBackoff:       n.RetryBackoff.String(),
+			MaxEventsPerMinute: n.MaxEventsPerMinute,
+		}
+	}
+	if c.Admin != nil {
+		dump.Admin = &AdminDump{Network: c.Admin.Network, Address: c.Admin.Address, StateFile: c.Admin.StateFile}
+	}
+	return dump
+}
+
+func (bg *BackendGroup) dump() BackendGroupDump {
+	dump := BackendGroupDump{
+		Name:           bg.Name,
+		LoadBalancing:  loadBalancingType(bg.Lb),
+		Servers:        urlStrings(bg.Servers),
+		BackupServers:  urlStrings(bg.BackupServers),
+		Priorities:     bg.Priorities,
+		PanicThreshold: bg.PanicThreshold,
+	}
+	if bg.SlowStart > 0 {
+		dump.SlowStart = bg.SlowStart.String()
+	}
+
+	if hc := bg.HealthCheck; hc != nil {
+		dump.HealthCheck = &HealthCheckDump{
+			Type:               hc.Type,
+			Path:               hc.Path,
+			Method:             hc.Method,
+			Host:               hc.Host,
+			Headers:            redactHeaders(hc.Headers),
+			ExpectedBody:       hc.ExpectedBody,
+			Send:               hc.Send,
+			Expect:             hc.Expect,
+			Service:            hc.Service,
+			Command:            hc.Command,
+			Scheme:             hc.Scheme,
+			Port:               hc.Port,
+			Interval:           hc.Interval.String(),
+			Timeout:            hc.Timeout.String(),
+			HealthyThreshold:   hc.HealthyThreshold,
+			UnhealthyThreshold: hc.UnhealthyThreshold,
+		}
+		for _, r := range hc.ExpectedStatuses {
+			dump.HealthCheck.ExpectedStatuses = append(dump.HealthCheck.ExpectedStatuses, r.String())
+		}
+		if hc.ExpectedBodyRegex != nil {
+			dump.HealthCheck.ExpectedBodyRegex = hc.ExpectedBodyRegex.String()
+		}
+	}
+
+	if od := bg.OutlierDetection; od != nil {
+		dump.OutlierDetection = &OutlierDetectionDump{
+			Consecutive5xx:              od.Consecutive5xx,
+			ConsecutiveConnectionErrors: od.ConsecutiveConnectionErrors,
+			SuccessRateStdevFactor:      od.SuccessRateStdevFactor,
+			SuccessRateMinimumHosts:     od.SuccessRateMinimumHosts,
+			SuccessRateRequestVolume:    od.SuccessRateRequestVolume,
+			Interval:                    od.Interval.String(),
+			BaseEjectionTime:            od.BaseEjectionTime.String(),
+			MaxEjectionTime:             od.MaxEjectionTime.String(),
+			MaxEjectionPercent:          od.MaxEjectionPercent,
+		}
+	}
+	return dump
+}
+
+func (r *Rule) dump() RuleDump {
+	dump := RuleDump{Host: r.Host, Path: r.Path}
+	if r.BackendGroup != nil {
+		dump.BackendGroup = r.BackendGroup.Name
+	}
+	for _, op := range r.RequestOperations {
+		dump.RequestOperations = append(dump.RequestOperations, dumpOperation(op))
+	}
+	for _, op := range r.ResponseOperations {
+		dump.ResponseOperations = append(dump.ResponseOperations, dumpOperation(op))
+	}
+	return dump
+}
+
+func dumpOperation(op any) OperationDump {
+	switch op := op.(type) {
+	case *AddHeaderRequestOperation:
+		return OperationDump{Type: "add_header", Header: op.Header, Value: op.Value}
+	case *AddHeaderResponseOperation:
+		return OperationDump{Type: "add_header", Header: op.Header, Value: op.Value}
+	default:
+		return OperationDump{Type: fmt.Sprintf("%T", op)}
+	}
+}
+
+func loadBalancingType(lb loadbalancer.LoadBalancer) string {
+	switch lb.(type) {
+	case *loadbalancer.RoundRobin:
+		return "round_robin"
+	default:
+		return fmt.Sprintf("%T", lb)
+	}
+}
+
+func (r StatusRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func redactHeaders(headers http.Header) map[string][]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	redactedHeaders := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		redactedHeaders[name] = make([]string, len(values))
+		for i := range values {
+			redactedHeaders[name][i] = redacted
+		}
+	}
+	return redactedHeaders
+}
+
+// RedactURL formats a URL without its userinfo and query, which often carry
+// credentials, e.g. the token of a webhook, for dumps and logs.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	stripped := *u
+	stripped.User, stripped.RawQuery, stripped.ForceQuery = nil, "", false
+	s := stripped.String()
+	if u.User != nil {
+		s = strings.Replace(s, "//", "//"+redacted+"@", 1)
+	}
+	if u.RawQuery != "" {
+		s += "?" + redacted
+	}
+	return s
+}
+
+func urlStrings(urls []*url.URL) []string {
+	if len(urls) == 0 {
+		return nil
+	}
+	strs := make([]string, len(urls))
+	for i, u := range urls {
+		strs[i] = u.String()
+	}
+	return strs
+}
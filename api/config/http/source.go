@@ -0,0 +1,360 @@
+// Package http loads configs from a URL, e.g. of a central config service.
+//
+// The configs are written in YAML or JSON, with the schema of package yaml,
+// and go through the same validation. Unlike files, they are neither expanded
+// with environment variables nor allowed to include other configs.
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+)
+
+const (
+	defaultPollInterval = 30 * time.Second
+	defaultMaxBackoff   = 5 * time.Minute
+	defaultTimeout      = 10 * time.Second
+	// maxConfigSize protects the proxy from a runaway config service.
+	maxConfigSize = 10 << 20
+)
+
+// errNotModified is returned by fetch when the config has the ETag it was
+// given.
+var errNotModified = errors.New("config not modified")
+
+type Source struct {
+	URL string
+	// Format of the config, from the extension of the path of the URL by
+	// default, see yaml.FormatOf.
+	Format yaml.Format
+	// Client defaults to a client with a 10s timeout.
+	Client *nethttp.Client
+	// Header is added to every request, e.g. for authorization.
+	Header nethttp.Header
+
+	// AutoReload makes Watch poll the URL every PollInterval, 30s by default.
+	// The requests are conditional on the ETag of the last config, if any, so
+	// that an unchanged config is not downloaded again.
+	AutoReload   bool
+	PollInterval time.Duration
+	// MaxBackoff caps the interval between polls, which doubles on every
+	// failed poll. It defaults to 5m.
+	MaxBackoff time.Duration
+
+	// ChecksumURL is the URL of the SHA-256 checksum of the config, in hex as
+	// written by sha256sum. The config is rejected when it does not match.
+	ChecksumURL string
+	// PublicKey verifies the Ed25519 signature of the config, which is
+	// detached and served base64 encoded at SignatureURL, the URL of the
+	// config with a .sig suffix by default. The config is rejected when the
+	// signature is missing or invalid.
+	PublicKey    ed25519.PublicKey
+	SignatureURL string
+
+	// CacheFile keeps the last config that was fetched, verified and
+	// validated, which is loaded instead when the URL cannot be fetched, so
+	// that the proxy can start while the config service is down.
+	CacheFile string
+
+	mu       sync.Mutex // protects etag and revision
+	etag     string
+	revision string
+}
+
+// Load fetches, verifies and validates the config, or loads the cached config
+// when the URL cannot be fetched.
+func (s *Source) Load() (config.Config, error) {
+	cfg, revision, etag, err := s.load(context.Background())
+	if err != nil {
+		return config.Config{}, err
+	}
+	s.mu.Lock()
+	s.etag, s.revision = etag, revision
+	s.mu.Unlock()
+	return cfg, nil
+}
+
+// Watch polls the URL and sends the config every time it changes, until ctx
+// is done, or returns nil when AutoReload is false. The revision of the events
+// is a hash of the content of the config.
+//
+// Failed polls are reported as events with an error, and retried with an
+// exponential backoff. A config that is rejected, e.g. invalid, is reported
+// once until it changes. The cached config is not used by Watch: it would only
+// roll back to an older config.
+func (s *Source) Watch(ctx context.Context) <-chan config.ConfigEvent {
+	if !s.AutoReload {
+		return nil
+	}
+	events := make(chan config.ConfigEvent)
+	go s.watch(ctx, events)
+	return events
+}
+
+func (s *Source) watch(ctx context.Context, events chan<- config.ConfigEvent) {
+	defer close(events)
+
+	pollInterval := s.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	maxBackoff := s.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	s.mu.Lock()
+	etag, last := s.etag, s.revision
+	s.mu.Unlock()
+	var rejected string // revision of the last config rejected
+
+	interval := pollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		var event *config.ConfigEvent
+		var fetchErr *fetchError
+		cfg, revision, newEtag, err := s.fetchConfig(ctx, etag)
+		switch {
+		case errors.Is(err, errNotModified):
+			interval = pollInterval
+		case errors.As(err, &fetchErr):
+			if ctx.Err() != nil {
+				return
+			}
+			event = &config.ConfigEvent{Err: err}
+			interval = min(2*interval, maxBackoff)
+		case err != nil:
+			// the config was fetched but rejected, which is reported once
+			// rather than on every poll
+			if newEtag != "" {
+				etag = newEtag
+			}
+			interval = pollInterval
+			if revision != rejected {
+				rejected = revision
+				event = &config.ConfigEvent{Err: err}
+			}
+		default:
+			etag = newEtag
+			interval = pollInterval
+			rejected = ""
+			if revision != last {
+				last = revision
+				event = &config.ConfigEvent{Config: &cfg, Revision: revision}
+			}
+		}
+
+		if event != nil {
+			select {
+			case events <- *event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// load fetches the config, falling back to the cache when it cannot be
+// fetched.
+func (s *Source) load(ctx context.Context) (config.Config, string, string, error) {
+	cfg, revision, etag, err := s.fetchConfig(ctx, "")
+	var fetchErr *fetchError
+	if err == nil || s.CacheFile == "" || !errors.As(err, &fetchErr) {
+		return cfg, revision, etag, err
+	}
+
+	content, cacheErr := os.ReadFile(s.CacheFile)
+	if cacheErr != nil {
+		return config.Config{}, "", "", errors.Join(err, fmt.Errorf("failed to read cached config: %w", cacheErr))
+	}
+	cfg, cacheErr = yaml.Parse(content, s.format())
+	if cacheErr != nil {
+		return config.Config{}, "", "", errors.Join(err, fmt.Errorf("failed to load cached config: %w", cacheErr))
+	}
+	// no ETag, so that the first poll fetches the config
+	return cfg, revisionOf(content), "", nil
+}
+
+// fetchConfig fetches, verifies, validates and caches the config. It returns
+// errNotModified when the config has the given ETag. The revision of a config
+// that is fetched but rejected is returned with the error, along with its ETag
+// when it is invalid, so that it is not downloaded again while unchanged.
+func (s *Source) fetchConfig(ctx context.Context, etag string) (config.Config, string, string, error) {
+	content, newEtag, err := s.fetch(ctx, s.URL, etag)
+	if err != nil {
+		return config.Config{}, "", "", err
+	}
+	revision := revisionOf(content)
+	if err := s.verify(ctx, content); err != nil {
+		// no ETag: the checksum or the signature may be published after the
+		// config, which is then verified again
+		return config.Config{}, revision, "", err
+	}
+	cfg, err := yaml.Parse(content, s.format())
+	if err != nil {
+		return config.Config{}, revision, newEtag, err
+	}
+	if err := s.cache(content); err != nil {
+		return config.Config{}, revision, "", err
+	}
+	return cfg, revision, newEtag, nil
+}
+
+// fetchError is an error that prevented fetching a URL, as opposed to an
+// invalid config.
+type fetchError struct {
+	url string
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("failed to fetch %s: %s", e.url, e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+// fetch gets the content of the URL, along with its ETag. It returns
+// errNotModified when the content has the given ETag.
+func (s *Source) fetch(ctx context.Context, rawURL, etag string) ([]byte, string, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", &fetchError{url: rawURL, err: err}
+	}
+	for key, values := range s.Header {
+		req.Header[key] = values
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, "", &fetchError{url: rawURL, err: err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == nethttp.StatusNotModified && etag != "":
+		return nil, etag, errNotModified
+	case resp.StatusCode != nethttp.StatusOK:
+		return nil, "", &fetchError{url: rawURL, err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return nil, "", &fetchError{url: rawURL, err: err}
+	}
+	if len(content) > maxConfigSize {
+		return nil, "", &fetchError{url: rawURL, err: fmt.Errorf("larger than %d bytes", maxConfigSize)}
+	}
+	return content, resp.Header.Get("ETag"), nil
+}
+
+// verify checks the checksum and the signature of the config, when enabled.
+func (s *Source) verify(ctx context.Context, content []byte) error {
+	if s.ChecksumURL != "" {
+		checksum, _, err := s.fetch(ctx, s.ChecksumURL, "")
+		if err != nil {
+			return fmt.Errorf("failed to get config checksum: %w", err)
+		}
+		fields := strings.Fields(string(checksum))
+		if len(fields) == 0 {
+			return fmt.Errorf("empty config checksum")
+		}
+		sum := sha256.Sum256(content)
+		if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("config checksum mismatch: expected %s, got %s", fields[0], hex.EncodeToString(sum[:]))
+		}
+	}
+
+	if s.PublicKey != nil {
+		signatureURL := s.SignatureURL
+		if signatureURL == "" {
+			signatureURL = s.URL + ".sig"
+		}
+		encoded, _, err := s.fetch(ctx, signatureURL, "")
+		if err != nil {
+			return fmt.Errorf("failed to get config signature: %w", err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return fmt.Errorf("invalid config signature: %w", err)
+		}
+		if !ed25519.Verify(s.PublicKey, content, signature) {
+			return fmt.Errorf("invalid config signature")
+		}
+	}
+	return nil
+}
+
+// cache writes the config to the cache file, through a temporary file so that
+// the cache is never left half written.
+func (s *Source) cache(content []byte) error {
+	if s.CacheFile == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.CacheFile), filepath.Base(s.CacheFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to cache config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to cache config: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to cache config: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.CacheFile); err != nil {
+		return fmt.Errorf("failed to cache config: %w", err)
+	}
+	return nil
+}
+
+func (s *Source) client() *nethttp.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &nethttp.Client{Timeout: defaultTimeout}
+}
+
+// format returns the format of the config, from the extension of the path of
+// the URL by default.
+func (s *Source) format() yaml.Format {
+	if s.Format != "" {
+		return s.Format
+	}
+	if u, err := url.Parse(s.URL); err == nil {
+		return yaml.FormatOf(u.Path)
+	}
+	return yaml.FormatYAML
+}
+
+func revisionOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,299 @@
+package http_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	confighttp "github.com/mouad-eh/wasseet/api/config/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	service := newConfigService(t, configYAML(8080))
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", Header: http.Header{"Authorization": {"Bearer token"}}}
+
+	cfg, err := src.Load()
+	require.NoError(t, err)
+	require.Equal(t, 8080, cfg.Port)
+	require.Equal(t, "Bearer token", service.lastRequest().Header.Get("Authorization"))
+}
+
+func TestLoad_JSON(t *testing.T) {
+	service := newConfigService(t, `{"port": 8081, "backend_groups": [{"name": "group", "servers": [{"address": "backend.io"}]}], "rules": [{"path": "/", "backend_group": "group"}]}`)
+
+	cfg, err := (&confighttp.Source{URL: service.URL + "/config.json"}).Load()
+	require.NoError(t, err)
+	require.Equal(t, 8081, cfg.Port)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	service := newConfigService(t, "port: 0")
+
+	_, err := (&confighttp.Source{URL: service.URL + "/config.yaml"}).Load()
+	require.ErrorContains(t, err, "failed to validate config file")
+
+	_, err = (&confighttp.Source{URL: service.URL + "/missing.yaml"}).Load()
+	require.ErrorContains(t, err, "unexpected status 404 Not Found")
+}
+
+func TestLoad_Checksum(t *testing.T) {
+	content := configYAML(8080)
+	service := newConfigService(t, content)
+	sum := sha256.Sum256([]byte(content))
+	service.set("/config.yaml.sha256", hex.EncodeToString(sum[:])+"  config.yaml\n")
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", ChecksumURL: service.URL + "/config.yaml.sha256"}
+
+	_, err := src.Load()
+	require.NoError(t, err)
+
+	service.set("/config.yaml", configYAML(8081))
+	_, err = src.Load()
+	require.ErrorContains(t, err, "config checksum mismatch")
+}
+
+func TestLoad_Signature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	content := configYAML(8080)
+	service := newConfigService(t, content)
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", PublicKey: publicKey}
+
+	_, err = src.Load()
+	require.ErrorContains(t, err, "failed to get config signature")
+
+	service.set("/config.yaml.sig", base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(content))))
+	cfg, err := src.Load()
+	require.NoError(t, err)
+	require.Equal(t, 8080, cfg.Port)
+
+	// a config that was tampered with
+	service.set("/config.yaml", configYAML(8081))
+	_, err = src.Load()
+	require.ErrorContains(t, err, "invalid config signature")
+}
+
+func TestLoad_Cache(t *testing.T) {
+	service := newConfigService(t, configYAML(8080))
+	cacheFile := filepath.Join(t.TempDir(), "config.yaml")
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", CacheFile: cacheFile}
+
+	// nothing to fall back to yet
+	service.Close()
+	_, err := src.Load()
+	require.ErrorContains(t, err, "failed to read cached config")
+
+	service = newConfigService(t, configYAML(8080))
+	src.URL = service.URL + "/config.yaml"
+	_, err = src.Load()
+	require.NoError(t, err)
+	cached, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+	require.Equal(t, configYAML(8080), string(cached))
+
+	// an invalid config is neither loaded nor cached
+	service.set("/config.yaml", "port: 0")
+	_, err = src.Load()
+	require.Error(t, err)
+
+	// the service is down
+	service.Close()
+	cfg, err := src.Load()
+	require.NoError(t, err)
+	require.Equal(t, 8080, cfg.Port)
+}
+
+func TestWatch(t *testing.T) {
+	service := newConfigService(t, configYAML(8080))
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", AutoReload: true, PollInterval: 10 * time.Millisecond}
+	_, err := src.Load()
+	require.NoError(t, err)
+	events := src.Watch(t.Context())
+
+	// the unchanged config is not downloaded again
+	require.Eventually(t, func() bool { return service.notModified() >= 3 }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, `"1"`, service.lastRequest().Header.Get("If-None-Match"))
+
+	service.set("/config.yaml", configYAML(8081))
+	event := receive(t, events)
+	require.NoError(t, event.Err)
+	require.Equal(t, 8081, event.Config.Port)
+	require.NotEmpty(t, event.Revision)
+
+	service.set("/config.yaml", "port: 0")
+	event = receive(t, events)
+	require.ErrorContains(t, event.Err, "failed to validate config file")
+
+	// the invalid config is reported once and not downloaded again, without
+	// backing off
+	notModified := service.notModified()
+	require.Eventually(t, func() bool { return service.notModified() >= notModified+3 }, 2*time.Second, 10*time.Millisecond)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %+v", event)
+	default:
+	}
+
+	service.set("/config.yaml", configYAML(8082))
+	event = receive(t, events)
+	require.NoError(t, event.Err)
+	require.Equal(t, 8082, event.Config.Port)
+}
+
+func TestWatch_Backoff(t *testing.T) {
+	service := newConfigService(t, configYAML(8080))
+	src := &confighttp.Source{
+		URL:          service.URL + "/config.yaml",
+		AutoReload:   true,
+		PollInterval: 10 * time.Millisecond,
+		MaxBackoff:   40 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	events := src.Watch(ctx)
+	require.NoError(t, receive(t, events).Err)
+
+	service.fail(true)
+	start := time.Now()
+	for range 4 {
+		require.ErrorContains(t, receive(t, events).Err, "unexpected status 503 Service Unavailable")
+	}
+	// 20ms, 40ms and then 40ms between the failed polls
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatch_Signature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	content := configYAML(8080)
+	service := newConfigService(t, content)
+	service.set("/config.yaml.sig", base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte("stale"))))
+	src := &confighttp.Source{URL: service.URL + "/config.yaml", PublicKey: publicKey, AutoReload: true, PollInterval: 10 * time.Millisecond}
+	events := src.Watch(t.Context())
+
+	require.ErrorContains(t, receive(t, events).Err, "invalid config signature")
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %+v", event)
+	default:
+	}
+
+	// the signature is published after the config, which is verified again
+	service.set("/config.yaml.sig", base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(content))))
+	event := receive(t, events)
+	require.NoError(t, event.Err)
+	require.Equal(t, 8080, event.Config.Port)
+}
+
+func TestWatch_Disabled(t *testing.T) {
+	require.Nil(t, (&confighttp.Source{URL: "http://config.io/config.yaml"}).Watch(t.Context()))
+}
+
+func configYAML(port int) string {
+	return fmt.Sprintf(`port: %d
+backend_groups:
+  - name: group
+    servers:
+      - address: backend.io
+rules:
+  - path: /
+    backend_group: group
+`, port)
+}
+
+// configService serves files from memory, with an ETag that changes with
+// their content.
+type configService struct {
+	*httptest.Server
+	mu          sync.Mutex
+	files       map[string]string
+	etags       map[string]int
+	failing     bool
+	requests    []*http.Request
+	notModCount int
+}
+
+func newConfigService(t *testing.T, content string) *configService {
+	t.Helper()
+	s := &configService{files: make(map[string]string), etags: make(map[string]int)}
+	s.set("/config.yaml", content)
+	s.set("/config.json", content)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *configService) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	if s.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	content, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := fmt.Sprintf(`"%d"`, s.etags[r.URL.Path])
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		s.notModCount++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(content))
+}
+
+func (s *configService) set(path, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = content
+	s.etags[path]++
+}
+
+func (s *configService) fail(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func (s *configService) lastRequest() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func (s *configService) notModified() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notModCount
+}
+
+func receive(t *testing.T, events <-chan config.ConfigEvent) config.ConfigEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+		return config.ConfigEvent{}
+	}
+}
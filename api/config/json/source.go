@@ -0,0 +1,50 @@
+// Package json loads configs written in JSON.
+//
+// JSON configs have the same schema as YAML configs, with the same keys, and
+// go through the same validation: they are decoded into the model of package
+// yaml, so see yaml.Config for the reference of the schema.
+package json
+
+import (
+	"context"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+)
+
+// Source loads a config file written in JSON, whatever its extension. Note
+// that yaml.Source also loads the files with a .json extension as JSON.
+type Source struct {
+	Path string
+	// AutoReload, Debounce, Polling and PollInterval work as for yaml.Source.
+	AutoReload   bool
+	Debounce     time.Duration
+	Polling      bool
+	PollInterval time.Duration
+}
+
+func (s *Source) Load() (config.Config, error) {
+	return s.yamlSource().Load()
+}
+
+// Watch loads the config file every time it changes, see yaml.Source.Watch.
+func (s *Source) Watch(ctx context.Context) <-chan config.ConfigEvent {
+	return s.yamlSource().Watch(ctx)
+}
+
+func (s *Source) yamlSource() *yaml.Source {
+	return &yaml.Source{
+		Path:         s.Path,
+		Format:       yaml.FormatJSON,
+		AutoReload:   s.AutoReload,
+		Debounce:     s.Debounce,
+		Polling:      s.Polling,
+		PollInterval: s.PollInterval,
+	}
+}
+
+// Parse decodes, validates and resolves a config written in JSON.
+func Parse(content []byte) (config.Config, error) {
+	return yaml.Parse(content, yaml.FormatJSON)
+}
@@ -0,0 +1,59 @@
+package json_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	jsonapi "github.com/mouad-eh/wasseet/api/config/json"
+	yamlapi "github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_SameConfigAsYaml(t *testing.T) {
+	yamlConfig, err := (&yamlapi.Source{Path: "testdata/config.yaml"}).Load()
+	require.NoError(t, err)
+	jsonConfig, err := (&jsonapi.Source{Path: "testdata/config.json"}).Load()
+	require.NoError(t, err)
+
+	require.Equal(t, yamlConfig, jsonConfig)
+	require.Len(t, jsonConfig.Rules[0].RequestOperations, 1)
+	require.Equal(t, &config.AddHeaderRequestOperation{Header: "X-Forwarded-For", Value: "127.0.0.1"}, jsonConfig.Rules[0].RequestOperations[0])
+}
+
+func TestLoad_FormatFromExtension(t *testing.T) {
+	// yaml sources load .json files as JSON
+	cfg, err := (&yamlapi.Source{Path: "testdata/config.json"}).Load()
+	require.NoError(t, err)
+	require.Equal(t, "http://server1.com", cfg.BackendGroups[0].Servers[0].String())
+
+	// JSON sources load any file as JSON
+	path := filepath.Join(t.TempDir(), "config.conf")
+	content, err := os.ReadFile("testdata/config.yaml")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+	_, err = (&jsonapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, path+":1: invalid character 'p' looking for beginning of value")
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"syntax error", "{\n\"port\": 8080,\n}", "line 3: invalid character '}' looking for beginning of object key string"},
+		{"truncated", `{"port": 8080`, "line 1: unexpected end of JSON input"},
+		{"trailing data", `{"port": 8080} {}`, "line 1: invalid character '{' after top-level value"},
+		{"wrong type", `{"port": "http"}`, "line 1: cannot unmarshal !!str `http` into int"},
+		{"unknown operation", `{"rules": [{"request_operations": [{"type": "remove_header"}]}]}`, "unknown request operation type: remove_header"},
+		{"invalid port", `{"port": -1}`, "port must be between 0 and 65535"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jsonapi.Parse([]byte(tt.content))
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
@@ -1,5 +1,27 @@
 package config
 
+import "context"
+
 type Source interface {
 	Load() (Config, error)
 }
+
+// Watcher is implemented by sources that push their config when it changes,
+// so that it is reloaded without being polled or signalled from outside.
+type Watcher interface {
+	// Watch sends an event every time the config changes, until ctx is done
+	// and the channel is closed. It returns nil when the source is not watched.
+	Watch(ctx context.Context) <-chan ConfigEvent
+}
+
+// ConfigEvent is sent by a Watcher when its config changes.
+type ConfigEvent struct {
+	// Config is the new config, nil when Err is set.
+	Config *Config
+	// Revision identifies the config in the source, e.g. a hash of a file or
+	// an ETag. Events with the revision of the current config are ignored.
+	Revision string
+	// Err is set when the new config could not be loaded, in which case the
+	// current config is kept.
+	Err error
+}
@@ -0,0 +1,529 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The checks below are shared by the config formats and the Builder, so that
+// a config is validated the same way however it is written.
+
+// IsValidPort tells whether port is a TCP port, or 0 for any port when
+// allowZero is true.
+func IsValidPort(port int, allowZero bool) bool {
+	if allowZero {
+		return port >= 0 && port <= 65535
+	}
+	return port >= 1 && port <= 65535
+}
+
+var dnsRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`)
+
+// IsValidHostname tells whether host is an IP address or a DNS name.
+func IsValidHostname(host string) bool {
+	return net.ParseIP(host) != nil || dnsRegex.MatchString(host)
+}
+
+// IsValidAddress tells whether addr is a hostname, or a hostname or IP
+// address followed by a port.
+func IsValidAddress(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// no port: must be a hostname only
+		return dnsRegex.MatchString(addr)
+	}
+	portNum, err := strconv.Atoi(port)
+	return err == nil && IsValidHostname(host) && IsValidPort(portNum, false)
+}
+
+// httpTokenRegex matches the token grammar of RFC 9110 used by methods and header names.
+var httpTokenRegex = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+// IsValidHTTPToken tells whether token can be used as an HTTP method or
+// header name.
+func IsValidHTTPToken(token string) bool {
+	return httpTokenRegex.MatchString(token)
+}
+
+// FieldError is a problem with a value of a config. Path locates the value
+// with the keys, as strings, and the indexes, as ints, of config files from
+// the value that was validated, e.g. {"servers", 1}.
+type FieldError struct {
+	Path    []any
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if len(e.Path) == 0 {
+		return e.Message
+	}
+	return FormatPath(e.Path) + ": " + e.Message
+}
+
+// FieldErrors are all the problems of a value, one per line.
+type FieldErrors []*FieldError
+
+func (errs FieldErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FormatPath formats the path of a value, e.g. backend_groups[0].servers[1].
+func FormatPath(path []any) string {
+	var b strings.Builder
+	for _, key := range path {
+		switch key := key.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", key)
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			fmt.Fprint(&b, key)
+		}
+	}
+	return b.String()
+}
+
+// validator collects the FieldErrors of the value at path.
+type validator struct {
+	path []any
+	errs *FieldErrors
+}
+
+func newValidator(errs *FieldErrors) validator {
+	return validator{errs: errs}
+}
+
+// at returns a validator of the value at the given keys and indexes from the
+// current value.
+func (v validator) at(path ...any) validator {
+	v.path = append(slices.Clip(v.path), path...)
+	return v
+}
+
+func (v validator) errorf(format string, args ...any) {
+	*v.errs = append(*v.errs, &FieldError{Path: v.path, Message: fmt.Sprintf(format, args...)})
+}
+
+// add reports errs, which are relative to the current value.
+func (v validator) add(errs FieldErrors) {
+	for _, err := range errs {
+		*v.errs = append(*v.errs, &FieldError{Path: append(slices.Clip(v.path), err.Path...), Message: err.Message})
+	}
+}
+
+// ValidateConfig reports the problems of the top-level values of a config:
+// its port and the lack of backend groups or rules, counted over every file of
+// the config.
+func ValidateConfig(port, backendGroups, rules int) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	// We consider port 0 as a valid port as it will let the OS choose
+	// any available port which can be useful for testing.
+	// TODO: Port 0 on prod is not allowed. We should consider adding
+	// environment flag (test/prod).
+	if !IsValidPort(port, true) {
+		v.at("port").errorf("port must be between 0 and 65535")
+	}
+	if backendGroups == 0 {
+		v.at("backend_groups").errorf("at least one backend group must be defined")
+	}
+	if rules == 0 {
+		v.at("rules").errorf("at least one rule must be defined")
+	}
+	return errs
+}
+
+// BackendGroupNames checks that the names of the backend groups of a config
+// are unique and that rules send requests to one of them. The zero value has
+// no names.
+type BackendGroupNames struct {
+	definedIn map[string]string // name -> file
+}
+
+// Define adds the name of a backend group of the given file, empty when the
+// config is not read from files, and reports the name when already used.
+func (names *BackendGroupNames) Define(name, file string) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs).at("name")
+	if name == "" {
+		// reported by BackendGroup.Validate
+		return nil
+	}
+	if names.definedIn == nil {
+		names.definedIn = make(map[string]string)
+	}
+	if other, ok := names.definedIn[name]; ok && other == file {
+		v.errorf("name %q is already used", name)
+	} else if ok {
+		v.errorf("name %q is already used in %s", name, other)
+	} else {
+		names.definedIn[name] = file
+	}
+	return errs
+}
+
+// Check reports the backend group of a rule when missing or not defined.
+func (names *BackendGroupNames) Check(name string) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs).at("backend_group")
+	if name == "" {
+		v.errorf("backend_group is required")
+	} else if _, ok := names.definedIn[name]; !ok {
+		v.errorf("backend group %q not found", name)
+	}
+	return errs
+}
+
+// isValidServer tells whether server is written as hostname[:port] or
+// http://hostname[:port].
+func isValidServer(server string) bool {
+	return IsValidAddress(strings.TrimPrefix(server, "http://"))
+}
+
+// ValidateServers reports the lack of servers of a backend group and its
+// servers and backup servers not written as hostname[:port] or
+// http://hostname[:port].
+func ValidateServers(servers, backupServers []string) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if len(servers) == 0 {
+		v.at("servers").errorf("at least one server must be defined")
+	}
+	for i, server := range servers {
+		if !isValidServer(server) {
+			v.at("servers", i).errorf("server %q must be in format [hostname|IP:port]", server)
+		}
+	}
+	for i, server := range backupServers {
+		if !isValidServer(server) {
+			v.at("backup_servers", i).errorf("backup server %q must be in format [hostname|IP:port]", server)
+		}
+	}
+	return errs
+}
+
+// ParseServers parses servers written as hostname[:port] or
+// http://hostname[:port], which must be valid, see ValidateServers.
+func ParseServers(servers []string) []*url.URL {
+	if len(servers) == 0 {
+		return nil
+	}
+	urls := make([]*url.URL, len(servers))
+	for i, server := range servers {
+		if !strings.HasPrefix(server, "http://") {
+			server = "http://" + server
+		}
+		urls[i], _ = url.Parse(server)
+	}
+	return urls
+}
+
+// ServerPlacement is where a server of a backend group stands: its priority,
+// 0 being the highest, and its zone.
+type ServerPlacement struct {
+	Priority int
+	Zone     string
+}
+
+// ValidatePlacements reports the servers whose priority is negative. The
+// placements are the ones of the servers with the same index.
+func ValidatePlacements(servers []string, placements []ServerPlacement) FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	for i, placement := range placements {
+		if placement.Priority < 0 {
+			v.at("servers", i, "priority").errorf("server %q: priority must not be negative", servers[i])
+		}
+	}
+	return errs
+}
+
+// Priorities returns the priority levels of the servers, see
+// BackendGroup.Priorities, from their placements and the zone of the proxy:
+// servers in a remote zone rank below the servers of the local zone that have
+// the same priority. It is nil when all the servers have the highest priority.
+func Priorities(servers []*url.URL, placements []ServerPlacement, localZone string) map[string]int {
+	var priorities map[string]int
+	for i, placement := range placements {
+		level := 2 * placement.Priority
+		if localZone != "" && placement.Zone != "" && placement.Zone != localZone {
+			level++
+		}
+		if level != 0 {
+			if priorities == nil {
+				priorities = make(map[string]int)
+			}
+			priorities[servers[i].String()] = level
+		}
+	}
+	return priorities
+}
+
+// Validate reports the problems of a backend group, but the ones of its
+// servers, which are checked before they are parsed by ValidateServers.
+func (bg *BackendGroup) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if bg.Name == "" {
+		v.at("name").errorf("name is required")
+	}
+	if bg.PanicThreshold < 0 || bg.PanicThreshold > 1 {
+		v.at("panic_threshold").errorf("panic threshold %v must be between 0 and 1", bg.PanicThreshold)
+	}
+	if bg.SlowStart < 0 {
+		v.at("slow_start").errorf("invalid slow start %q: must not be negative", bg.SlowStart)
+	}
+	if bg.HealthCheck != nil {
+		v.at("health_check").add(bg.HealthCheck.Validate())
+	}
+	if bg.OutlierDetection != nil {
+		v.at("outlier_detection").add(bg.OutlierDetection.Validate())
+	}
+	return errs
+}
+
+// Validate reports the problems of a health check before WithDefaults: the
+// zero values of its fields stand for fields that are not set.
+func (hc *HealthCheck) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if hc.Type != "" && !slices.Contains(HealthCheckTypes, hc.Type) {
+		v.at("type").errorf("invalid type %q: must be one of http, tcp, grpc or exec", hc.Type)
+		return errs
+	}
+	hc.validateTypeFields(v)
+
+	if hc.typeOrDefault() == HTTPHealthCheck && !strings.HasPrefix(hc.Path, "/") {
+		v.at("path").errorf("path %q must start with /", hc.Path)
+	}
+	if hc.typeOrDefault() == ExecHealthCheck && (len(hc.Command) == 0 || hc.Command[0] == "") {
+		v.at("command").errorf("command is required by exec health checks")
+	}
+
+	if hc.Interval <= 0 {
+		v.at("interval").errorf("invalid interval %q: must be greater than 0", hc.Interval)
+	}
+	if hc.Timeout <= 0 {
+		v.at("timeout").errorf("invalid timeout %q: must be greater than 0", hc.Timeout)
+	} else if hc.Interval > 0 && hc.Timeout >= hc.Interval {
+		v.at("timeout").errorf("invalid timeout %q: must be less than interval %q", hc.Timeout, hc.Interval)
+	}
+
+	if hc.Method != "" && !IsValidHTTPToken(hc.Method) {
+		v.at("method").errorf("invalid method %q", hc.Method)
+	}
+	if hc.Host != "" && !IsValidAddress(hc.Host) {
+		v.at("host").errorf("host %q must be in format [hostname|IP:port]", hc.Host)
+	}
+	for _, name := range slices.Sorted(maps.Keys(hc.Headers)) {
+		if !IsValidHTTPToken(name) {
+			v.at("headers", name).errorf("invalid header name %q", name)
+		}
+	}
+	for i, status := range hc.ExpectedStatuses {
+		if status.Min < 100 || status.Max > 599 {
+			v.at("expected_statuses", i).errorf("invalid expected status %q: status codes must be between 100 and 599", status)
+		} else if status.Min > status.Max {
+			v.at("expected_statuses", i).errorf("invalid expected status %q: range start must not be greater than its end", status)
+		}
+	}
+	if hc.Scheme != "" && hc.Scheme != "http" && hc.Scheme != "https" {
+		v.at("scheme").errorf("invalid scheme %q: must be http or https", hc.Scheme)
+	}
+	if hc.Port != 0 && !IsValidPort(hc.Port, false) {
+		v.at("port").errorf("port must be between 1 and 65535")
+	}
+	if hc.HealthyThreshold < 0 {
+		v.at("healthy_threshold").errorf("healthy_threshold must not be negative")
+	}
+	if hc.UnhealthyThreshold < 0 {
+		v.at("unhealthy_threshold").errorf("unhealthy_threshold must not be negative")
+	}
+	return errs
+}
+
+// validateTypeFields rejects the fields that are not used by the type of the health check,
+// which are most likely a mistake.
+func (hc *HealthCheck) validateTypeFields(v validator) {
+	fields := []struct {
+		name  string
+		set   bool
+		types []HealthCheckType
+	}{
+		{"path", hc.Path != "", []HealthCheckType{HTTPHealthCheck}},
+		{"method", hc.Method != "", []HealthCheckType{HTTPHealthCheck}},
+		{"host", hc.Host != "", []HealthCheckType{HTTPHealthCheck}},
+		{"headers", len(hc.Headers) > 0, []HealthCheckType{HTTPHealthCheck}},
+		{"expected_statuses", len(hc.ExpectedStatuses) > 0, []HealthCheckType{HTTPHealthCheck}},
+		{"expected_body", hc.ExpectedBody != "", []HealthCheckType{HTTPHealthCheck}},
+		{"expected_body_regex", hc.ExpectedBodyRegex != nil, []HealthCheckType{HTTPHealthCheck}},
+		{"send", hc.Send != "", []HealthCheckType{TCPHealthCheck}},
+		{"expect", hc.Expect != "", []HealthCheckType{TCPHealthCheck}},
+		{"service", hc.Service != "", []HealthCheckType{GRPCHealthCheck}},
+		{"command", len(hc.Command) > 0, []HealthCheckType{ExecHealthCheck}},
+		{"scheme", hc.Scheme != "", []HealthCheckType{HTTPHealthCheck, GRPCHealthCheck}},
+	}
+	for _, field := range fields {
+		if field.set && !slices.Contains(field.types, hc.typeOrDefault()) {
+			v.at(field.name).errorf("%s is not supported by %s health checks", field.name, hc.typeOrDefault())
+		}
+	}
+}
+
+// Validate reports the problems of an outlier detection before WithDefaults:
+// the zero values of its fields stand for fields that are not set.
+func (od *OutlierDetection) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"consecutive_5xx", od.Consecutive5xx},
+		{"consecutive_connection_errors", od.ConsecutiveConnectionErrors},
+		{"success_rate_minimum_hosts", od.SuccessRateMinimumHosts},
+		{"success_rate_request_volume", od.SuccessRateRequestVolume},
+	} {
+		if field.value < 0 {
+			v.at(field.name).errorf("%s must not be negative", field.name)
+		}
+	}
+	if od.SuccessRateStdevFactor < 0 {
+		v.at("success_rate_stdev_factor").errorf("success_rate_stdev_factor must not be negative")
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		v.at("max_ejection_percent").errorf("max_ejection_percent must be between 0 and 100")
+	}
+
+	valid := true
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"interval", od.Interval},
+		{"base_ejection_time", od.BaseEjectionTime},
+		{"max_ejection_time", od.MaxEjectionTime},
+	} {
+		if d.value < 0 {
+			v.at(d.name).errorf("invalid %s %q: must be greater than 0", d.name, d.value)
+			valid = false
+		}
+	}
+	if resolved := od.WithDefaults(); valid && resolved.MaxEjectionTime < resolved.BaseEjectionTime {
+		v.at("max_ejection_time").errorf("max_ejection_time must not be less than base_ejection_time")
+	}
+	return errs
+}
+
+// Validate reports the problems of a rule, but the ones of the name of its
+// backend group, which is only known by the config.
+func (r *Rule) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if r.Host == "" && r.Path == "" {
+		v.errorf("either host or path must be specified")
+	}
+	if r.Host != "" && !IsValidAddress(r.Host) {
+		v.at("host").errorf("host %q must be in format [hostname|IP:port]", r.Host)
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		v.at("path").errorf("path must start with /")
+	}
+	for i, op := range r.RequestOperations {
+		if op, ok := op.(interface{ Validate() error }); ok {
+			if err := op.Validate(); err != nil {
+				v.at("request_operations", i).errorf("%s", err)
+			}
+		}
+	}
+	for i, op := range r.ResponseOperations {
+		if op, ok := op.(interface{ Validate() error }); ok {
+			if err := op.Validate(); err != nil {
+				v.at("response_operations", i).errorf("%s", err)
+			}
+		}
+	}
+	return errs
+}
+
+// Validate reports the problems of notifications before WithDefaults: the zero
+// values of their durations stand for durations that are not set.
+func (n *Notifications) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if u := n.WebhookURL; u == nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		var webhookURL string
+		if u != nil {
+			webhookURL = u.String()
+		}
+		v.at("webhook_url").errorf("webhook_url %q must be an http or https URL", webhookURL)
+	}
+	for _, name := range slices.Sorted(maps.Keys(n.Headers)) {
+		if !IsValidHTTPToken(name) {
+			v.at("headers", name).errorf("invalid header name %q", name)
+		}
+	}
+	if n.MaxRetries < 0 {
+		v.at("max_retries").errorf("max_retries must not be negative")
+	}
+	if n.MaxEventsPerMinute < 0 {
+		v.at("max_events_per_minute").errorf("max_events_per_minute must not be negative")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"timeout", n.Timeout},
+		{"retry_backoff", n.RetryBackoff},
+	} {
+		if d.value < 0 {
+			v.at(d.name).errorf("invalid %s %q: must be greater than 0", d.name, d.value)
+		}
+	}
+	return errs
+}
+
+const unixAddressPrefix = "unix:"
+
+// ParseAdminAddress splits the address of the admin API, [host]:port or
+// unix:/path/to/socket, into its network and address.
+func ParseAdminAddress(address string) (network, addr string) {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// Validate reports the problems of the admin API.
+func (a *Admin) Validate() FieldErrors {
+	var errs FieldErrors
+	v := newValidator(&errs)
+	if a.Network == "unix" {
+		if a.Address == "" {
+			v.at("address").errorf("address %q must contain the path of the socket", unixAddressPrefix+a.Address)
+		}
+	} else if host, port, err := net.SplitHostPort(a.Address); err != nil || (host != "" && !IsValidHostname(host)) {
+		v.at("address").errorf("address %q must be in format [host]:port or unix:path", a.Address)
+	} else if portNum, err := strconv.Atoi(port); err != nil || !IsValidPort(portNum, true) {
+		v.at("address").errorf("address %q: port must be between 0 and 65535", a.Address)
+	}
+	if a.Token == "" {
+		v.at("token").errorf("token is required")
+	}
+	return errs
+}
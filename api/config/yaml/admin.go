@@ -0,0 +1,28 @@
+package yaml
+
+import (
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+// Admin enables the admin API.
+type Admin struct {
+	Address string `yaml:"address"` // [host]:port, or unix:/path/to/socket
+	Token   string `yaml:"token"`   // sent by clients as a bearer token
+	// StateFile persists the servers added and removed at runtime, optional
+	StateFile string `yaml:"state_file"`
+}
+
+func (a Admin) Validate() error {
+	var errs ValidationErrors
+	a.validate(newValidator(nil, &errs))
+	return errs.err()
+}
+
+func (a Admin) validate(v validator) {
+	v.add(a.Resolve().Validate())
+}
+
+func (a Admin) Resolve() *config.Admin {
+	network, address := config.ParseAdminAddress(a.Address)
+	return &config.Admin{Network: network, Address: address, Token: a.Token, StateFile: a.StateFile}
+}
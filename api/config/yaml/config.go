@@ -1,33 +1,33 @@
 package yaml
 
 import (
-	"fmt"
-	"net/url"
-	"strings"
+	"reflect"
 	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
-	"github.com/mouad-eh/wasseet/loadbalancer"
 )
 
 type Config struct {
 	Port          int            `yaml:"port"`
+	Zone          string         `yaml:"zone"` // Optional
 	BackendGroups []BackendGroup `yaml:"backend_groups"`
 	Rules         []Rule         `yaml:"rules"`
+	Notifications *Notifications `yaml:"notifications"` // Optional
+	Admin         *Admin         `yaml:"admin"`         // Optional
+	// Include lists files, or globs, whose backend groups and rules are added
+	// to the config. Relative paths are relative to the directory of the file.
+	Include []string `yaml:"include"` // Optional
 }
 
 type BackendGroup struct {
-	Name          string            `yaml:"name"`
-	LoadBalancing LoadBalancingType `yaml:"load_balancing"` // Optional
-	Servers       []string          `yaml:"servers"`
-	HealthCheck   *HealthCheck      `yaml:"health_check"` // Optional
-}
-
-type HealthCheck struct {
-	Path     string `yaml:"path"`
-	Interval string `yaml:"interval"`
-	Timeout  string `yaml:"timeout"`
-	Retries  int    `yaml:"retries"`
+	Name             string            `yaml:"name"`
+	LoadBalancing    LoadBalancingType `yaml:"load_balancing"` // Optional
+	Servers          []Server          `yaml:"servers"`
+	BackupServers    []string          `yaml:"backup_servers"`    // Optional
+	HealthCheck      *HealthCheck      `yaml:"health_check"`      // Optional
+	OutlierDetection *OutlierDetection `yaml:"outlier_detection"` // Optional
+	PanicThreshold   float64           `yaml:"panic_threshold"`   // Optional, disabled by default
+	SlowStart        string            `yaml:"slow_start"`        // Optional, disabled by default
 }
 
 type LoadBalancingType string
@@ -54,46 +54,41 @@ func (c *Config) Resolve() config.Config {
 	proxyBGMap := make(map[string]*config.BackendGroup)
 
 	for _, bg := range c.BackendGroups {
-		// Parse server URLs
-		servers := make([]*url.URL, len(bg.Servers))
-		for i, server := range bg.Servers {
-			serverURL := server
-			if !strings.HasPrefix(server, "http://") {
-				serverURL = "http://" + server
-			}
-			u, _ := url.Parse(serverURL)
-			servers[i] = u
-		}
+		servers := config.ParseServers(bg.addresses())
+		backupServers := config.ParseServers(bg.BackupServers)
+
+		priorities := config.Priorities(servers, bg.placements(), c.Zone)
 
-		// Create the appropriate load balancer based on type
-		var lb loadbalancer.LoadBalancer
-		switch bg.LoadBalancing {
-		case RoundRobin:
-			lb = loadbalancer.NewRoundRobin(servers)
+		// we are sure that ParseDuration will not fail because
+		// we already checked that during validation.
+		var slowStart time.Duration
+		if bg.SlowStart != "" {
+			slowStart, _ = time.ParseDuration(bg.SlowStart)
 		}
 
 		// Resolve health check
 		var healthCheck *config.HealthCheck
 		if bg.HealthCheck != nil {
-			// we are sure that ParseDuration will not fail because
-			// we already checked that during validation.
-			interval, _ := time.ParseDuration(bg.HealthCheck.Interval)
-			timeout, _ := time.ParseDuration(bg.HealthCheck.Timeout)
-
-			healthCheck = &config.HealthCheck{
-				Path:     bg.HealthCheck.Path,
-				Interval: interval,
-				Timeout:  timeout,
-				Retries:  bg.HealthCheck.Retries,
-			}
+			healthCheck = bg.HealthCheck.Resolve()
+		}
+
+		var outlierDetection *config.OutlierDetection
+		if bg.OutlierDetection != nil {
+			outlierDetection = bg.OutlierDetection.Resolve()
 		}
 
 		proxyBG := &config.BackendGroup{
-			Name:        bg.Name,
-			Lb:          lb,
-			Servers:     servers,
-			HealthCheck: healthCheck,
+			Name:             bg.Name,
+			Servers:          servers,
+			BackupServers:    backupServers,
+			Priorities:       priorities,
+			HealthCheck:      healthCheck,
+			OutlierDetection: outlierDetection,
+			PanicThreshold:   bg.PanicThreshold,
+			SlowStart:        slowStart,
 		}
+		// round_robin is the only load balancing type
+		proxyBG.Lb = proxyBG.NewLoadBalancer()
 		proxyBGMap[bg.Name] = proxyBG
 	}
 
@@ -131,139 +126,187 @@ func (c *Config) Resolve() config.Config {
 		proxyBGs[i] = proxyBGMap[bg.Name]
 	}
 
+	var notifications *config.Notifications
+	if c.Notifications != nil {
+		notifications = c.Notifications.Resolve()
+	}
+
+	var admin *config.Admin
+	if c.Admin != nil {
+		admin = c.Admin.Resolve()
+	}
+
 	return config.Config{
 		Port:          c.Port,
+		Zone:          c.Zone,
 		BackendGroups: proxyBGs,
 		Rules:         proxyRules,
+		Notifications: notifications,
+		Admin:         admin,
 	}
 }
 
-func (c *Config) Validate() error {
-	// We consider port 0 as a valid port as it will let the OS choose
-	// any available port which can be useful for testing.
-	// TODO: Port 0 on prod is not allowed. We should consider adding
-	// environment flag (test/prod).
-	if !isValidPort(c.Port, true) {
-		return fmt.Errorf("port must be between 0 and 65535")
+func (bg BackendGroup) addresses() []string {
+	addresses := make([]string, len(bg.Servers))
+	for i, server := range bg.Servers {
+		addresses[i] = server.Address
 	}
-	if len(c.BackendGroups) == 0 {
-		return fmt.Errorf("at least one backend group must be defined")
-	}
-	if len(c.Rules) == 0 {
-		return fmt.Errorf("at least one rule must be defined")
+	return addresses
+}
+
+func (bg BackendGroup) placements() []config.ServerPlacement {
+	placements := make([]config.ServerPlacement, len(bg.Servers))
+	for i, server := range bg.Servers {
+		placements[i] = config.ServerPlacement{Priority: server.Priority, Zone: server.Zone}
 	}
+	return placements
+}
 
-	// Validate each backend group
-	for i, bg := range c.BackendGroups {
-		if err := bg.Validate(); err != nil {
-			return fmt.Errorf("backend group %d: %w", i, err)
+// Validate reports all the problems of the config.
+func (c *Config) Validate() error {
+	return validateFiles([]*configFile{{config: *c}}).err()
+}
+
+// validateFiles validates the configs of a config file and of the files it
+// includes, so that errors point to the file they come from. The first file
+// is the main one.
+func validateFiles(files []*configFile) ValidationErrors {
+	var errs ValidationErrors
+	for _, file := range files {
+		errs = append(errs, file.errs...)
+		if file.node != nil {
+			checkKeys(newValidator(file, &errs), file.node, reflect.TypeFor[Config]())
 		}
 	}
 
-	// Validate each rule
-	for i, rule := range c.Rules {
-		if err := rule.Validate(); err != nil {
-			return fmt.Errorf("rule %d: %w", i, err)
-		}
+	main := files[0]
+	v := newValidator(main, &errs)
+	backendGroups, rules := 0, 0
+	for _, file := range files {
+		backendGroups += len(file.config.BackendGroups)
+		rules += len(file.config.Rules)
+	}
+	v.add(config.ValidateConfig(main.config.Port, backendGroups, rules))
 
-		// Check if referenced backend group exists
-		found := false
-		for _, bg := range c.BackendGroups {
-			if bg.Name == rule.BackendGroup {
-				found = true
-				break
-			}
+	var names config.BackendGroupNames
+	for _, file := range files {
+		v := newValidator(file, &errs)
+		if file != main {
+			file.config.validateIncluded(v)
 		}
-		if !found {
-			return fmt.Errorf("rule %d: backend group %q not found", i, rule.BackendGroup)
+		for i, bg := range file.config.BackendGroups {
+			v := v.at("backend_groups", i)
+			bg.validate(v)
+			v.add(names.Define(bg.Name, file.path))
 		}
 	}
 
-	return nil
-}
+	for _, file := range files {
+		for i, rule := range file.config.Rules {
+			v := newValidator(file, &errs).at("rules", i)
+			rule.validate(v)
+			v.add(names.Check(rule.BackendGroup))
+		}
+	}
 
-func (bg BackendGroup) Validate() error {
-	if bg.Name == "" {
-		return fmt.Errorf("name is required")
+	if main.config.Notifications != nil {
+		main.config.Notifications.validate(v.at("notifications"))
 	}
-	if len(bg.Servers) == 0 {
-		return fmt.Errorf("at least one server must be defined")
+	if main.config.Admin != nil {
+		main.config.Admin.validate(v.at("admin"))
 	}
-	// Validate servers
-	for j, server := range bg.Servers {
-		serverToValidate := strings.TrimPrefix(server, "http://")
-		if !isValidDNSOrIPWithPort(serverToValidate) {
-			return fmt.Errorf("server %d %q must be in format [hostname|IP:port]", j, server)
-		}
-	}
-	// Validate load balancing type
-	if !isValidLoadBalancingType(bg.LoadBalancing) {
-		return fmt.Errorf("invalid load balancing type %q", bg.LoadBalancing)
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.path
 	}
+	errs.sort(paths)
+	return errs
+}
 
-	if bg.HealthCheck != nil {
-		if err := bg.HealthCheck.Validate(); err != nil {
-			return fmt.Errorf("health check: %w", err)
+// validateIncluded checks that an included file only has backend groups and rules.
+func (c *Config) validateIncluded(v validator) {
+	fields := []struct {
+		name string
+		set  bool
+	}{
+		{"port", c.Port != 0},
+		{"zone", c.Zone != ""},
+		{"notifications", c.Notifications != nil},
+		{"admin", c.Admin != nil},
+		{"include", len(c.Include) > 0},
+	}
+	for _, field := range fields {
+		if field.set {
+			v.at(field.name).errorf("included files can only define backend_groups and rules")
 		}
 	}
+}
 
-	return nil
+func (bg BackendGroup) Validate() error {
+	var errs ValidationErrors
+	bg.validate(newValidator(nil, &errs))
+	return errs.err()
 }
 
-func (hc HealthCheck) Validate() error {
-	if !strings.HasPrefix(hc.Path, "/") {
-		return fmt.Errorf("path %q must start with /", hc.Path)
+// validate checks the values that are parsed, the rules of backend groups
+// being checked by config.BackendGroup.Validate on the parsed backend group.
+func (bg BackendGroup) validate(v validator) {
+	v.add(config.ValidateServers(bg.addresses(), bg.BackupServers))
+	v.add(config.ValidatePlacements(bg.addresses(), bg.placements()))
+	// Validate load balancing type
+	if !isValidLoadBalancingType(bg.LoadBalancing) {
+		v.at("load_balancing").errorf("invalid load balancing type %q", bg.LoadBalancing)
 	}
 
-	interval, err := time.ParseDuration(hc.Interval)
-	if err != nil {
-		return fmt.Errorf("invalid interval %q: %w", hc.Interval, err)
-	}
-	if interval <= 0 {
-		return fmt.Errorf("invalid interval %q: must be greater than 0", hc.Interval)
-	}
-	timeout, err := time.ParseDuration(hc.Timeout)
-	if err != nil {
-		return fmt.Errorf("invalid timeout %q: %w", hc.Timeout, err)
+	parsed := &config.BackendGroup{Name: bg.Name, PanicThreshold: bg.PanicThreshold}
+	if bg.SlowStart != "" {
+		slowStart, err := time.ParseDuration(bg.SlowStart)
+		if err != nil {
+			v.at("slow_start").errorf("invalid slow start %q: %s", bg.SlowStart, err)
+		}
+		parsed.SlowStart = slowStart
 	}
-	if timeout <= 0 {
-		return fmt.Errorf("invalid timeout %q: must be greater than 0", hc.Timeout)
+	v.add(parsed.Validate())
+
+	if bg.HealthCheck != nil {
+		bg.HealthCheck.validate(v.at("health_check"))
 	}
-	if timeout >= interval {
-		return fmt.Errorf("invalid timeout %q: must be less than interval %q", hc.Timeout, hc.Interval)
+	if bg.OutlierDetection != nil {
+		bg.OutlierDetection.validate(v.at("outlier_detection"))
 	}
-
-	return nil
 }
 
 func (rule *Rule) Validate() error {
-	if rule.Host == "" && rule.Path == "" {
-		return fmt.Errorf("either host or path must be specified")
-	}
-
-	if rule.Host != "" && !isValidDNSOrIPWithPort(rule.Host) {
-		return fmt.Errorf("host %q must be in format [hostname|IP:port]", rule.Host)
-	}
+	var errs ValidationErrors
+	rule.validate(newValidator(nil, &errs))
+	return errs.err()
+}
 
-	if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
-		return fmt.Errorf("path must start with /")
-	}
+// validate checks the rule with config.Rule.Validate, but its backend group,
+// which is checked by Config.Validate since it is defined by the config.
+func (rule *Rule) validate(v validator) {
+	v.add(rule.parse().Validate())
+}
 
-	if rule.BackendGroup == "" {
-		return fmt.Errorf("backend_group is required")
+// parse returns the rule without its backend group, which is only known by the
+// config. The operations that could not be decoded are left nil.
+func (rule *Rule) parse() *config.Rule {
+	parsed := &config.Rule{
+		Host:               rule.Host,
+		Path:               rule.Path,
+		RequestOperations:  make([]config.RequestOperation, len(rule.RequestOperations)),
+		ResponseOperations: make([]config.ResponseOperation, len(rule.ResponseOperations)),
 	}
-
 	for i, op := range rule.RequestOperations {
-		if err := op.Operation.Validate(); err != nil {
-			return fmt.Errorf("request operation %d: %w", i, err)
+		if op.Operation != nil {
+			parsed.RequestOperations[i] = op.Operation.Resolve()
 		}
 	}
-
 	for i, op := range rule.ResponseOperations {
-		if err := op.Operation.Validate(); err != nil {
-			return fmt.Errorf("response operation %d: %w", i, err)
+		if op.Operation != nil {
+			parsed.ResponseOperations[i] = op.Operation.Resolve()
 		}
 	}
-
-	return nil
+	return parsed
 }
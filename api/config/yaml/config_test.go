@@ -1,14 +1,15 @@
 package yaml_test
 
 import (
+	"net/http"
 	"net/url"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/mouad-eh/wasseet/api/config"
 	yamlapi "github.com/mouad-eh/wasseet/api/config/yaml"
 	"github.com/mouad-eh/wasseet/loadbalancer"
-	"github.com/mouad-eh/wasseet/api/config"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
 )
@@ -68,6 +69,479 @@ rules:
 	require.Error(t, err)
 }
 
+func TestValidate_InvalidPanicThreshold(t *testing.T) {
+	yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    panic_threshold: 1.5
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "panic threshold")
+}
+
+func TestValidate_InvalidSlowStart(t *testing.T) {
+	yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    slow_start: soon
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "slow start")
+}
+
+func TestValidate_InvalidBackupServer(t *testing.T) {
+	yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    backup_servers:
+      - localhost:notaport
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "backend_groups[0].backup_servers[0]: backup server")
+}
+
+func TestResolve_BackupServers(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    backup_servers:
+      - localhost:9100
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	resolved := yamlconfig.Resolve()
+
+	bg := resolved.BackendGroups[0]
+	require.Equal(t, []*url.URL{{Scheme: "http", Host: "localhost:9000"}}, bg.Servers)
+	require.Equal(t, []*url.URL{{Scheme: "http", Host: "localhost:9100"}}, bg.BackupServers)
+	require.Len(t, bg.AllServers(), 2)
+}
+
+func TestResolve_Priorities(t *testing.T) {
+	yamlContent := `
+port: 0
+zone: dc1
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+      - address: localhost:9001
+        zone: dc1
+      - address: localhost:9002
+        zone: dc2
+      - address: localhost:9003
+        priority: 1
+        zone: dc1
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	resolved := yamlconfig.Resolve()
+
+	require.Equal(t, "dc1", resolved.Zone)
+	bg := resolved.BackendGroups[0]
+	require.Len(t, bg.Servers, 4)
+	require.Equal(t, map[string]int{
+		"http://localhost:9002": 1, // remote zone
+		"http://localhost:9003": 2, // lower priority
+	}, bg.Priorities)
+}
+
+func TestValidate_NegativePriority(t *testing.T) {
+	yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - address: localhost:9000
+        priority: -1
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "priority")
+}
+
+func TestResolve_OutlierDetection(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    outlier_detection:
+      consecutive_5xx: 5
+      base_ejection_time: 10s
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	resolved := yamlconfig.Resolve()
+
+	require.Equal(t, &config.OutlierDetection{
+		Consecutive5xx:           5,
+		SuccessRateMinimumHosts:  5,
+		SuccessRateRequestVolume: 100,
+		Interval:                 10 * time.Second,
+		BaseEjectionTime:         10 * time.Second,
+		MaxEjectionTime:          300 * time.Second,
+		MaxEjectionPercent:       10,
+	}, resolved.BackendGroups[0].OutlierDetection)
+}
+
+func TestValidate_InvalidOutlierDetection(t *testing.T) {
+	yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    outlier_detection:
+      consecutive_5xx: 5
+      base_ejection_time: 10m
+      max_ejection_time: 1m
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "max_ejection_time")
+}
+
+func TestResolve_HealthCheck(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    health_check:
+      path: /ready
+      method: HEAD
+      host: health.internal
+      headers:
+        x-probe: wasseet
+      expected_statuses: ["200-299", "404"]
+      expected_body: ok
+      expected_body_regex: "^status: (up|degraded)"
+      scheme: https
+      port: 9443
+      interval: 10s
+      timeout: 2s
+      healthy_threshold: 2
+      unhealthy_threshold: 3
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	hc := yamlconfig.Resolve().BackendGroups[0].HealthCheck
+
+	require.Equal(t, "/ready", hc.Path)
+	require.Equal(t, http.MethodHead, hc.Method)
+	require.Equal(t, "health.internal", hc.Host)
+	require.Equal(t, http.Header{"X-Probe": {"wasseet"}}, hc.Headers)
+	require.Equal(t, []config.StatusRange{{Min: 200, Max: 299}, {Min: 404, Max: 404}}, hc.ExpectedStatuses)
+	require.Equal(t, "ok", hc.ExpectedBody)
+	require.True(t, hc.ExpectedBodyRegex.MatchString("status: degraded"))
+	require.Equal(t, "https", hc.Scheme)
+	require.Equal(t, 9443, hc.Port)
+	require.Equal(t, 2, hc.HealthyThreshold)
+	require.Equal(t, 3, hc.UnhealthyThreshold)
+}
+
+func TestValidate_InvalidHealthCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		healthCheck string
+		err         string
+	}{
+		{"invalid method", "method: \"GET /\"", "invalid method"},
+		{"invalid status", "expected_statuses: [\"600\"]", "invalid expected status"},
+		{"reversed status range", "expected_statuses: [\"299-200\"]", "invalid expected status"},
+		{"invalid regex", "expected_body_regex: \"(\"", "invalid expected body regex"},
+		{"invalid scheme", "scheme: ftp", "invalid scheme"},
+		{"invalid header", "headers: {\"x probe\": a}", "invalid header name"},
+		{"retries and unhealthy threshold", "retries: 3\n      unhealthy_threshold: 3", "retries and unhealthy_threshold"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    health_check:
+      path: /health
+      interval: 10s
+      timeout: 5s
+      ` + tt.healthCheck + `
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+			var config yamlapi.Config
+			err := yaml.Unmarshal([]byte(yamlContent), &config)
+			require.NoError(t, err)
+
+			err = config.Validate()
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestValidate_HealthCheckTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		healthCheck string
+		err         string
+	}{
+		{"tcp", "type: tcp\n      send: PING\n      expect: PONG", ""},
+		{"grpc", "type: grpc\n      service: orders", ""},
+		{"exec", "type: exec\n      command: [/bin/check, --verbose]", ""},
+		{"invalid type", "type: udp", "invalid type"},
+		{"http without path", "type: http", "path"},
+		{"path with tcp", "type: tcp\n      path: /health", "path is not supported by tcp health checks"},
+		{"send with http", "path: /health\n      send: PING", "send is not supported by http health checks"},
+		{"scheme with exec", "type: exec\n      command: [/bin/check]\n      scheme: https", "scheme is not supported"},
+		{"exec without command", "type: exec", "command is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    health_check:
+      interval: 10s
+      timeout: 5s
+      ` + tt.healthCheck + `
+rules:
+  - path: /api
+    backend_group: backend1
+`
+
+			var config yamlapi.Config
+			err := yaml.Unmarshal([]byte(yamlContent), &config)
+			require.NoError(t, err)
+
+			err = config.Validate()
+			if tt.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResolve_TCPHealthCheck(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+    health_check:
+      type: tcp
+      send: PING
+      expect: PONG
+      port: 9001
+      interval: 10s
+      timeout: 2s
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	require.Equal(t, &config.HealthCheck{
+		Type:               config.TCPHealthCheck,
+		Send:               "PING",
+		Expect:             "PONG",
+		Port:               9001,
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}, yamlconfig.Resolve().BackendGroups[0].HealthCheck)
+}
+
+func TestResolve_Notifications(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+notifications:
+  webhook_url: https://oncall.example.com/hooks/wasseet
+  headers:
+    authorization: Bearer secret
+  max_retries: 0
+`
+
+	var yamlconfig yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &yamlconfig)
+	require.NoError(t, err)
+	require.NoError(t, yamlconfig.Validate())
+
+	require.Equal(t, &config.Notifications{
+		WebhookURL:         &url.URL{Scheme: "https", Host: "oncall.example.com", Path: "/hooks/wasseet"},
+		Headers:            http.Header{"Authorization": {"Bearer secret"}},
+		Timeout:            5 * time.Second,
+		MaxRetries:         0,
+		RetryBackoff:       time.Second,
+		MaxEventsPerMinute: 60,
+	}, yamlconfig.Resolve().Notifications)
+}
+
+func TestValidate_InvalidNotifications(t *testing.T) {
+	yamlContent := `
+port: 0
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+notifications:
+  webhook_url: oncall.example.com
+`
+
+	var config yamlapi.Config
+	err := yaml.Unmarshal([]byte(yamlContent), &config)
+	require.NoError(t, err)
+
+	err = config.Validate()
+	require.ErrorContains(t, err, "notifications.webhook_url: webhook_url")
+}
+
+func TestResolve_Admin(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected *config.Admin
+	}{
+		{"127.0.0.1:9901", &config.Admin{Network: "tcp", Address: "127.0.0.1:9901", Token: "secret"}},
+		{":9901", &config.Admin{Network: "tcp", Address: ":9901", Token: "secret"}},
+		{"unix:/run/wasseet/admin.sock", &config.Admin{Network: "unix", Address: "/run/wasseet/admin.sock", Token: "secret"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			admin := yamlapi.Admin{Address: tt.address, Token: "secret"}
+			require.NoError(t, admin.Validate())
+			require.Equal(t, tt.expected, admin.Resolve())
+		})
+	}
+
+	admin := yamlapi.Admin{Address: ":9901", Token: "secret", StateFile: "/var/lib/wasseet/state.json"}
+	require.Equal(t, "/var/lib/wasseet/state.json", admin.Resolve().StateFile)
+}
+
+func TestValidate_InvalidAdmin(t *testing.T) {
+	tests := []struct {
+		admin yamlapi.Admin
+		err   string
+	}{
+		{yamlapi.Admin{Address: "localhost", Token: "secret"}, "must be in format [host]:port or unix:path"},
+		{yamlapi.Admin{Address: "localhost:99999", Token: "secret"}, "port must be between 0 and 65535"},
+		{yamlapi.Admin{Address: "unix:", Token: "secret"}, "must contain the path of the socket"},
+		{yamlapi.Admin{Address: "localhost:9901"}, "token is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err, func(t *testing.T) {
+			require.ErrorContains(t, tt.admin.Validate(), tt.err)
+		})
+	}
+}
+
 func TestResolve(t *testing.T) {
 	yamlContent := `
 port: 0
@@ -82,6 +556,8 @@ backend_groups:
       interval: 10s
       timeout: 5s
       retries: 3
+    panic_threshold: 0.5
+    slow_start: 60s
 rules:
   - path: /
     backend_group: backend1
@@ -109,15 +585,24 @@ rules:
 	}
 
 	backendGroup := &config.BackendGroup{
-		Name:    "backend1",
-		Lb:      loadbalancer.NewRoundRobin(servers),
+		Name: "backend1",
+		Lb: loadbalancer.NewRoundRobin(servers,
+			loadbalancer.WithPanicThreshold(0.5),
+			loadbalancer.WithSlowStart(60*time.Second),
+		),
 		Servers: servers,
 		HealthCheck: &config.HealthCheck{
-			Path:     "/health",
-			Interval: 10 * time.Second,
-			Timeout:  5 * time.Second,
-			Retries:  3,
+			Type:               config.HTTPHealthCheck,
+			Path:               "/health",
+			Method:             http.MethodGet,
+			ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+			Interval:           10 * time.Second,
+			Timeout:            5 * time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 3,
 		},
+		PanicThreshold: 0.5,
+		SlowStart:      60 * time.Second,
 	}
 
 	requestOps := []config.RequestOperation{
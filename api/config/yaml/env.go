@@ -0,0 +1,75 @@
+package yaml
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	envReferenceRegex = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+	envNameRegex      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// expandEnv replaces the references to environment variables in the scalars
+// of a parsed config file, so that comments are left alone: ${VAR} is
+// replaced with the value of VAR, which must be set, and ${VAR:-default} with
+// default when VAR is unset or empty. $${ is replaced with a literal ${.
+func expandEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		expanded, err := expandEnvString(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		if expanded != node.Value {
+			node.Value = expanded
+			if node.Style == 0 {
+				// resolve the type of the expanded value, e.g. a number for a port
+				node.Tag = ""
+			}
+		}
+		return nil
+	case yaml.AliasNode:
+		// expanded where it is anchored
+		return nil
+	}
+	for _, content := range node.Content {
+		if err := expandEnv(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandEnvString(value string) (string, error) {
+	var expanded strings.Builder
+	last := 0
+	for _, match := range envReferenceRegex.FindAllStringSubmatchIndex(value, -1) {
+		expanded.WriteString(value[last:match[0]])
+		last = match[1]
+		if value[match[0]+1] == '$' {
+			// escaped
+			expanded.WriteString(value[match[0]+1 : match[1]])
+			continue
+		}
+
+		reference := value[match[2]:match[3]]
+		name, defaultValue, hasDefault := strings.Cut(reference, ":-")
+		if !envNameRegex.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable reference ${%s}", reference)
+		}
+		envValue, ok := os.LookupEnv(name)
+		if envValue == "" && hasDefault {
+			envValue = defaultValue
+		} else if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		expanded.WriteString(envValue)
+	}
+	expanded.WriteString(value[last:])
+	return expanded.String(), nil
+}
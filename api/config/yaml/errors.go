@@ -0,0 +1,191 @@
+package yaml
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a config. When the config was read
+// from a file, File, Line and Column locate the key the problem is about.
+type ValidationError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"` // of the key, e.g. rules[3].backend_group
+	Message string `json:"message"`
+}
+
+// Error formats the error as file:line:column: path: message, the format
+// understood by most editors.
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	switch {
+	case e.File != "" && e.Line > 0 && e.Column > 0:
+		fmt.Fprintf(&b, "%s:%d:%d: ", e.File, e.Line, e.Column)
+	case e.File != "" && e.Line > 0:
+		fmt.Fprintf(&b, "%s:%d: ", e.File, e.Line)
+	case e.File != "":
+		fmt.Fprintf(&b, "%s: ", e.File)
+	case e.Line > 0 && e.Column > 0:
+		fmt.Fprintf(&b, "line %d, column %d: ", e.Line, e.Column)
+	case e.Line > 0:
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors are all the problems found in a config, one per line.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// err returns nil rather than empty errors.
+func (errs ValidationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// sort sorts the errors by file, in the given order, and by position.
+func (errs ValidationErrors) sort(files []string) {
+	slices.SortStableFunc(errs, func(a, b *ValidationError) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(files, a.File), slices.Index(files, b.File)),
+			cmp.Compare(a.Line, b.Line),
+			cmp.Compare(a.Column, b.Column),
+		)
+	})
+}
+
+// validator collects validation errors about the value at path in a file.
+type validator struct {
+	file *configFile // nil when the config was not read from a file
+	path []any       // keys as strings and indexes as ints
+	errs *ValidationErrors
+}
+
+func newValidator(file *configFile, errs *ValidationErrors) validator {
+	return validator{file: file, errs: errs}
+}
+
+// at returns a validator of the value at the given keys and indexes from the
+// current value.
+func (v validator) at(path ...any) validator {
+	v.path = append(slices.Clip(v.path), path...)
+	return v
+}
+
+func (v validator) errorf(format string, args ...any) {
+	err := &ValidationError{Path: config.FormatPath(v.path), Message: fmt.Sprintf(format, args...)}
+	if v.file != nil {
+		err.File = v.file.path
+		if v.file.node != nil {
+			node := locate(v.file.node, v.path)
+			err.Line, err.Column = node.Line, node.Column
+		}
+	}
+	*v.errs = append(*v.errs, err)
+}
+
+// add reports the errors of the config value parsed from the current value,
+// but the ones about keys already reported, e.g. a duration that could not be
+// parsed and is then reported as missing.
+func (v validator) add(errs config.FieldErrors) {
+	for _, err := range errs {
+		v := v.at(err.Path...)
+		path := config.FormatPath(v.path)
+		reported := slices.ContainsFunc(*v.errs, func(err *ValidationError) bool {
+			return err.Path == path && (v.file == nil || err.File == v.file.path)
+		})
+		if !reported {
+			v.errorf("%s", err.Message)
+		}
+	}
+}
+
+// check reports err, if any.
+func (v validator) check(err error) {
+	if err != nil {
+		v.errorf("%s", err)
+	}
+}
+
+// locate returns the node of the deepest key of path found from node. Keys
+// are located at their key in their mapping rather than at their value.
+func locate(node *yaml.Node, path []any) *yaml.Node {
+	for node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	found := node
+	for _, key := range path {
+		if node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		switch key := key.(type) {
+		case int:
+			if node.Kind != yaml.SequenceNode || key >= len(node.Content) {
+				return found
+			}
+			node = node.Content[key]
+			found = node
+		default:
+			if node.Kind != yaml.MappingNode {
+				return found
+			}
+			next := (*yaml.Node)(nil)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == fmt.Sprint(key) {
+					found, next = node.Content[i], node.Content[i+1]
+				}
+			}
+			if next == nil {
+				return found
+			}
+			node = next
+		}
+	}
+	return found
+}
+
+var yamlErrorLineRegex = regexp.MustCompile(`^(?:yaml: |json: )?line (\d+): (.*)$`)
+
+// fileErrors turns the errors of the YAML and JSON decoders, which may start
+// with the line they are about, into validation errors of the file.
+func fileErrors(path string, err error) ValidationErrors {
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	errs := make(ValidationErrors, len(messages))
+	for i, message := range messages {
+		errs[i] = &ValidationError{File: path, Message: message}
+		if match := yamlErrorLineRegex.FindStringSubmatch(message); match != nil {
+			errs[i].Line, _ = strconv.Atoi(match[1])
+			errs[i].Message = match[2]
+		}
+	}
+	return errs
+}
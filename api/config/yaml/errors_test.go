@@ -0,0 +1,131 @@
+package yaml_test
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	yamlapi "github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_AllValidationErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", `port: 70000
+include: [team.yaml]
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+      - "invalid server"
+    health_check:
+      path: /health
+      interval: 5s
+      timeout: 10s
+      retries: two
+rules:
+  - path: /api
+    backend_group: backend2
+    request_operations:
+      - type: add_header
+        heder: X-Forwarded-For
+        value: 127.0.0.1
+      - type: remove_header
+`)
+	team := writeFile(t, dir, "team.yaml", `backend_groups:
+  - name: backend1
+    servers: [localhost:9001]
+    slow_strat: 30s
+`)
+
+	_, err := (&yamlapi.Source{Path: path}).Load()
+	var errs yamlapi.ValidationErrors
+	require.True(t, errors.As(err, &errs), err)
+	var got []yamlapi.ValidationError
+	for _, err := range errs {
+		got = append(got, *err)
+	}
+	require.Equal(t, []yamlapi.ValidationError{
+		{File: path, Line: 1, Column: 1, Path: "port", Message: "port must be between 0 and 65535"},
+		{File: path, Line: 7, Column: 9, Path: "backend_groups[0].servers[1]", Message: `server "invalid server" must be in format [hostname|IP:port]`},
+		{File: path, Line: 11, Column: 7, Path: "backend_groups[0].health_check.timeout", Message: `invalid timeout "10s": must be less than interval "5s"`},
+		{File: path, Line: 12, Message: "cannot unmarshal !!str `two` into int"},
+		{File: path, Line: 15, Column: 5, Path: "rules[0].backend_group", Message: `backend group "backend2" not found`},
+		{File: path, Line: 17, Column: 9, Path: "rules[0].request_operations[0]", Message: "header is missing"},
+		{File: path, Line: 18, Column: 9, Path: "rules[0].request_operations[0].heder", Message: `unknown key "heder"`},
+		{File: path, Line: 20, Message: "unknown request operation type: remove_header"},
+		{File: team, Line: 2, Column: 5, Path: "backend_groups[0].name", Message: `name "backend1" is already used in ` + path},
+		{File: team, Line: 4, Column: 5, Path: "backend_groups[0].slow_strat", Message: `unknown key "slow_strat"`},
+	}, got)
+}
+
+// TestParse_UnparsedValuesReportedOnce checks that values that cannot be
+// parsed are not reported again by the rules of the parsed config.
+func TestParse_UnparsedValuesReportedOnce(t *testing.T) {
+	_, err := yamlapi.Parse([]byte(`port: 8080
+backend_groups:
+  - name: backend1
+    servers: [localhost:9000]
+    slow_start: soon
+    health_check:
+      path: /health
+      interval: ten
+      timeout: 1s
+      expected_statuses: [ok]
+    outlier_detection:
+      base_ejection_time: long
+      max_ejection_time: 20s
+rules:
+  - path: /
+    backend_group: backend1
+`), yamlapi.FormatYAML)
+	var errs yamlapi.ValidationErrors
+	require.True(t, errors.As(err, &errs), err)
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Path)
+	}
+	require.Equal(t, []string{
+		"backend_groups[0].slow_start",
+		"backend_groups[0].health_check.interval",
+		"backend_groups[0].health_check.expected_statuses[0]",
+		"backend_groups[0].outlier_detection.base_ejection_time",
+	}, got)
+}
+
+func TestValidationErrors_Format(t *testing.T) {
+	errs := yamlapi.ValidationErrors{
+		{File: "config.yaml", Line: 3, Column: 5, Path: "rules[0].backend_group", Message: `backend group "x" not found`},
+		{File: "config.yaml", Line: 7, Message: "cannot unmarshal !!str `two` into int"},
+		{Path: "port", Message: "port must be between 0 and 65535"},
+	}
+	require.Equal(t, `config.yaml:3:5: rules[0].backend_group: backend group "x" not found
+config.yaml:7: cannot unmarshal !!str `+"`two`"+` into int
+port: port must be between 0 and 65535`, errs.Error())
+
+	data, err := json.Marshal(errs[:2])
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"file": "config.yaml", "line": 3, "column": 5, "path": "rules[0].backend_group", "message": "backend group \"x\" not found"},
+		{"file": "config.yaml", "line": 7, "message": "cannot unmarshal !!str `+"`two`"+` into int"}
+	]`, string(data))
+}
+
+func TestParse_JSONPositions(t *testing.T) {
+	_, err := yamlapi.Parse([]byte(`{
+	"port": 8080,
+	"backend_groups": [{"name": "backend1", "servers": ["localhost:9000"], "load_balancng": "round_robin"}],
+	"rules": [{"path": "/", "backend_group": "backend1"}]
+}`), yamlapi.FormatJSON)
+	require.EqualError(t, err, `failed to validate config file: line 3, column 73: backend_groups[0].load_balancng: unknown key "load_balancng"`)
+}
+
+func TestLoad_UnknownKeyInIncludedJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", "include: [conf.d/*]\nrules:\n  - path: /\n    backend_group: team\n")
+	writeFile(t, dir, "conf.d/team.json", `{"backend_groups": [{"name": "team", "servers": ["localhost:9000"], "zone": "dc1"}]}`)
+
+	_, err := (&yamlapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, filepath.Join(dir, "conf.d", "team.json")+`:1:69: backend_groups[0].zone: unknown key "zone"`)
+}
@@ -0,0 +1,200 @@
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the format of a config file. Every format is decoded into Config,
+// so they share the same schema, validation rules and resolution.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// FormatOf returns the format of a config file from its extension: JSON for
+// .json files and YAML for any other file.
+func FormatOf(path string) Format {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// Parse decodes, validates and resolves a config written in the given format.
+// Unlike Source, it neither expands environment variables nor includes files.
+func Parse(content []byte, format Format) (config.Config, error) {
+	file, err := decodeFile("", content, format)
+	if err != nil {
+		return config.Config{}, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+	return (&configFiles{main: file}).parse()
+}
+
+// decodeFile decodes a config file. Decoding goes on after type errors, e.g. a
+// string given for a number, which are recorded in the errors of the file.
+// The other errors are returned as ValidationErrors.
+func decodeFile(path string, content []byte, format Format) (*configFile, error) {
+	node, err := parseFile(path, content, format)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(path, content, node)
+}
+
+// parseFile parses a config file into a YAML node, which is nil if the file is
+// empty.
+func parseFile(path string, content []byte, format Format) (*yaml.Node, error) {
+	var node *yaml.Node
+	var err error
+	switch format {
+	case FormatYAML, "":
+		node = &yaml.Node{}
+		err = yaml.Unmarshal(content, node)
+	case FormatJSON:
+		node, err = jsonNode(content)
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", format)
+	}
+	if err != nil {
+		return nil, fileErrors(path, err)
+	}
+	if node.Kind == 0 {
+		return nil, nil
+	}
+	return node, nil
+}
+
+// decodeNode decodes a config file parsed by parseFile, see decodeFile.
+func decodeNode(path string, content []byte, node *yaml.Node) (*configFile, error) {
+	file := &configFile{path: path, content: content}
+	if node == nil {
+		// empty file
+		return file, nil
+	}
+	file.node = node
+	if err := node.Decode(&file.config); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fileErrors(path, err)
+		}
+		file.errs = fileErrors(path, err)
+	}
+	return file, nil
+}
+
+// jsonNode parses a JSON document into a YAML node, so that JSON configs go
+// through the UnmarshalYAML methods of the config, e.g. of the operations.
+// JSON is mostly a subset of YAML, but not entirely: the YAML parser rejects
+// some valid JSON escapes like \/, hence the JSON parser.
+func jsonNode(content []byte) (*yaml.Node, error) {
+	// the decoder tokens lack the context of syntax errors, e.g. a trailing
+	// comma is reported as an unexpected comma
+	var raw json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, fmt.Errorf("json: line %d: %w", lineOf(content, syntaxErr.Offset), err)
+		}
+		return nil, fmt.Errorf("json: %w", err)
+	}
+
+	p := &jsonParser{content: content, dec: json.NewDecoder(bytes.NewReader(content))}
+	p.dec.UseNumber()
+	node, err := p.value()
+	if err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}, Line: node.Line, Column: node.Column}, nil
+}
+
+type jsonParser struct {
+	content []byte
+	dec     *json.Decoder
+}
+
+// value parses the next JSON value.
+func (p *jsonParser) value() (*yaml.Node, error) {
+	start := p.tokenStart()
+	token, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{Line: p.line(start), Column: p.column(start)}
+	switch token := token.(type) {
+	case json.Delim:
+		switch token {
+		case '{':
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+			for p.dec.More() {
+				key, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, key, value)
+			}
+		case '[':
+			node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+			for p.dec.More() {
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, item)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", token)
+		}
+		// the closing delimiter
+		if _, err := p.dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.Kind, node.Tag, node.Value, node.Style = yaml.ScalarNode, "!!str", token, yaml.DoubleQuotedStyle
+	case json.Number:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!int", token.String()
+		if strings.ContainsAny(node.Value, ".eE") {
+			node.Tag = "!!float"
+		}
+	case bool:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!bool", fmt.Sprint(token)
+	case nil:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!null", "null"
+	}
+	return node, nil
+}
+
+// tokenStart returns the offset of the next token, skipping the whitespace and
+// separators that follow the previous one.
+func (p *jsonParser) tokenStart() int64 {
+	offset := p.dec.InputOffset()
+	for offset < int64(len(p.content)) && strings.IndexByte(" \t\r\n,:", p.content[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (p *jsonParser) line(offset int64) int {
+	return lineOf(p.content, offset)
+}
+
+func (p *jsonParser) column(offset int64) int {
+	return int(offset) - bytes.LastIndexByte(p.content[:offset], '\n')
+}
+
+func lineOf(content []byte, offset int64) int {
+	return bytes.Count(content[:min(offset, int64(len(content)))], []byte("\n")) + 1
+}
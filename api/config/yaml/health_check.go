@@ -0,0 +1,155 @@
+package yaml
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+type HealthCheck struct {
+	Type               HealthCheckType   `yaml:"type"`                // Optional, http by default
+	Path               string            `yaml:"path"`                // Required by http health checks
+	Method             string            `yaml:"method"`              // Optional, GET by default
+	Host               string            `yaml:"host"`                // Optional, Host header sent with the check
+	Headers            map[string]string `yaml:"headers"`             // Optional
+	ExpectedStatuses   []string          `yaml:"expected_statuses"`   // Optional, 200 by default
+	ExpectedBody       string            `yaml:"expected_body"`       // Optional, substring of the body
+	ExpectedBodyRegex  string            `yaml:"expected_body_regex"` // Optional
+	Send               string            `yaml:"send"`                // Optional, tcp only
+	Expect             string            `yaml:"expect"`              // Optional, tcp only
+	Service            string            `yaml:"service"`             // Optional, grpc only
+	Command            []string          `yaml:"command"`             // Required by exec health checks
+	Scheme             string            `yaml:"scheme"`              // Optional, scheme of the server by default
+	Port               int               `yaml:"port"`                // Optional, port of the server by default
+	Interval           string            `yaml:"interval"`
+	Timeout            string            `yaml:"timeout"`
+	Retries            int               `yaml:"retries"`             // Deprecated: use unhealthy_threshold
+	HealthyThreshold   int               `yaml:"healthy_threshold"`   // Optional, 1 by default
+	UnhealthyThreshold int               `yaml:"unhealthy_threshold"` // Optional, 1 by default
+}
+
+type HealthCheckType string
+
+const (
+	HTTPHealthCheck        HealthCheckType = "http"
+	TCPHealthCheck         HealthCheckType = "tcp"
+	GRPCHealthCheck        HealthCheckType = "grpc"
+	ExecHealthCheck        HealthCheckType = "exec"
+	DefaultHealthCheckType HealthCheckType = HTTPHealthCheck
+)
+
+func (hc HealthCheck) Validate() error {
+	var errs ValidationErrors
+	hc.validate(newValidator(nil, &errs))
+	return errs.err()
+}
+
+// validate checks the values that are parsed, the rules of health checks being
+// checked by config.HealthCheck.Validate on the parsed health check.
+func (hc HealthCheck) validate(v validator) {
+	if _, err := time.ParseDuration(hc.Interval); err != nil {
+		v.at("interval").errorf("invalid interval %q: %s", hc.Interval, err)
+	}
+	if _, err := time.ParseDuration(hc.Timeout); err != nil {
+		v.at("timeout").errorf("invalid timeout %q: %s", hc.Timeout, err)
+	}
+	for i, status := range hc.ExpectedStatuses {
+		if _, err := parseStatusRange(status); err != nil {
+			v.at("expected_statuses", i).errorf("invalid expected status %q: %s", status, err)
+		}
+	}
+	if hc.ExpectedBodyRegex != "" {
+		if _, err := regexp.Compile(hc.ExpectedBodyRegex); err != nil {
+			v.at("expected_body_regex").errorf("invalid expected body regex %q: %s", hc.ExpectedBodyRegex, err)
+		}
+	}
+	if hc.Retries < 0 {
+		v.at("retries").errorf("retries must not be negative")
+	}
+	if hc.Retries != 0 && hc.UnhealthyThreshold != 0 {
+		v.at("retries").errorf("retries and unhealthy_threshold cannot be both specified, use unhealthy_threshold")
+	}
+	v.add(hc.parse().Validate())
+}
+
+// parse returns the health check without defaults, the values that cannot be
+// parsed being left to zero.
+func (hc HealthCheck) parse() *config.HealthCheck {
+	interval, _ := time.ParseDuration(hc.Interval)
+	timeout, _ := time.ParseDuration(hc.Timeout)
+
+	var headers http.Header
+	if len(hc.Headers) > 0 {
+		headers = make(http.Header, len(hc.Headers))
+		for name, value := range hc.Headers {
+			headers.Set(name, value)
+		}
+	}
+
+	var expectedStatuses []config.StatusRange
+	for _, status := range hc.ExpectedStatuses {
+		statusRange, _ := parseStatusRange(status)
+		expectedStatuses = append(expectedStatuses, statusRange)
+	}
+
+	var expectedBodyRegex *regexp.Regexp
+	if hc.ExpectedBodyRegex != "" {
+		expectedBodyRegex, _ = regexp.Compile(hc.ExpectedBodyRegex)
+	}
+
+	unhealthyThreshold := hc.UnhealthyThreshold
+	if unhealthyThreshold == 0 && hc.Retries > 0 {
+		unhealthyThreshold = hc.Retries
+	}
+
+	return &config.HealthCheck{
+		Type:               config.HealthCheckType(hc.Type),
+		Path:               hc.Path,
+		Method:             hc.Method,
+		Host:               hc.Host,
+		Headers:            headers,
+		ExpectedStatuses:   expectedStatuses,
+		ExpectedBody:       hc.ExpectedBody,
+		ExpectedBodyRegex:  expectedBodyRegex,
+		Send:               hc.Send,
+		Expect:             hc.Expect,
+		Service:            hc.Service,
+		Command:            hc.Command,
+		Scheme:             hc.Scheme,
+		Port:               hc.Port,
+		Interval:           interval,
+		Timeout:            timeout,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: unhealthyThreshold,
+	}
+}
+
+// Resolve must only be called on validated health checks.
+func (hc HealthCheck) Resolve() *config.HealthCheck {
+	return hc.parse().WithDefaults()
+}
+
+// parseStatusRange parses either a single status code (e.g. "200")
+// or an inclusive range of status codes (e.g. "200-299"), whose bounds are
+// checked by config.HealthCheck.Validate.
+func parseStatusRange(status string) (config.StatusRange, error) {
+	minStatus, maxStatus, isRange := strings.Cut(status, "-")
+	if !isRange {
+		maxStatus = minStatus
+	}
+
+	statusRange := config.StatusRange{}
+	var err error
+	if statusRange.Min, err = strconv.Atoi(strings.TrimSpace(minStatus)); err != nil {
+		return config.StatusRange{}, fmt.Errorf("must be a status code or a range of status codes")
+	}
+	if statusRange.Max, err = strconv.Atoi(strings.TrimSpace(maxStatus)); err != nil {
+		return config.StatusRange{}, fmt.Errorf("must be a status code or a range of status codes")
+	}
+	return statusRange, nil
+}
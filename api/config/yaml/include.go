@@ -0,0 +1,136 @@
+package yaml
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is a config file decoded after expanding its environment variables.
+type configFile struct {
+	path    string
+	content []byte     // as read, before expansion
+	node    *yaml.Node // nil if the file is empty
+	config  Config
+	errs    ValidationErrors // found while decoding
+}
+
+// configFiles are a config file and the files it includes.
+type configFiles struct {
+	main     *configFile // nil if it could not be read
+	included []*configFile
+	patterns []string // of the included files, relative to the working directory
+}
+
+// read reads and decodes the config file and the files it includes. On error,
+// it returns the files read so far along with the error.
+func (s *Source) read() (*configFiles, error) {
+	files := &configFiles{}
+	main, err := readFile(s.Path, s.format())
+	files.main = main
+	if err != nil {
+		return files, err
+	}
+
+	seen := map[string]bool{filepath.Clean(s.Path): true}
+	for i, pattern := range main.config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(s.Path), pattern)
+		}
+		files.patterns = append(files.patterns, pattern)
+		var errs ValidationErrors
+		v := newValidator(main, &errs).at("include", i)
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			v.errorf("invalid include %q: %s", pattern, err)
+		} else if len(paths) == 0 && !hasGlobMeta(pattern) {
+			v.errorf("included file %s does not exist", pattern)
+		}
+		if len(errs) > 0 {
+			return files, fmt.Errorf("failed to include config file: %w", errs)
+		}
+
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			file, err := readFile(path, FormatOf(path))
+			if file != nil {
+				files.included = append(files.included, file)
+			}
+			if err != nil {
+				return files, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// readFile returns a nil file if it cannot be read, and the file undecoded if
+// it cannot be decoded.
+func readFile(path string, format Format) (*configFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	node, err := parseFile(path, content, format)
+	if err != nil {
+		return &configFile{path: path, content: content}, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+	if node != nil {
+		if err := expandEnv(node); err != nil {
+			return &configFile{path: path, content: content}, fmt.Errorf("failed to expand config file: %w", fileErrors(path, err))
+		}
+	}
+	file, err := decodeNode(path, content, node)
+	if err != nil {
+		return &configFile{path: path, content: content}, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+	return file, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// parse validates, merges and resolves the config.
+func (f *configFiles) parse() (config.Config, error) {
+	files := append([]*configFile{f.main}, f.included...)
+	if err := validateFiles(files).err(); err != nil {
+		return config.Config{}, fmt.Errorf("failed to validate config file: %w", err)
+	}
+	cfg := f.main.config
+	cfg.BackendGroups = slices.Clone(cfg.BackendGroups)
+	cfg.Rules = slices.Clone(cfg.Rules)
+	// the backend groups and rules of the included files come after the ones
+	// of the main file
+	for _, file := range f.included {
+		cfg.BackendGroups = append(cfg.BackendGroups, file.config.BackendGroups...)
+		cfg.Rules = append(cfg.Rules, file.config.Rules...)
+	}
+	return cfg.Resolve(), nil
+}
+
+// revision identifies the content of the files. The error that interrupted
+// reading them is part of it, so that fixing it is noticed.
+func (f *configFiles) revision(err error) string {
+	hash := sha256.New()
+	for _, file := range append([]*configFile{f.main}, f.included...) {
+		if file != nil {
+			fmt.Fprintf(hash, "%s\x00%d\x00", file.path, len(file.content))
+			hash.Write(file.content)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(hash, "%s\x00", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
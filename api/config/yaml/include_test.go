@@ -0,0 +1,248 @@
+package yaml_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	yamlapi "github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_EnvExpansion(t *testing.T) {
+	t.Setenv("WASSEET_PORT", "8081")
+	t.Setenv("WASSEET_EMPTY", "")
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+port: ${WASSEET_PORT}
+backend_groups:
+  - name: backend1
+    servers:
+      - ${WASSEET_BACKEND_HOST:-localhost}:${WASSEET_EMPTY:-9000}
+rules:
+  - path: /
+    backend_group: backend1
+    request_operations:
+      - type: add_header
+        header: X-Template
+        value: $${WASSEET_PORT}
+`)
+
+	cfg, err := (&yamlapi.Source{Path: path}).Load()
+	require.NoError(t, err)
+	require.Equal(t, 8081, cfg.Port)
+	require.Equal(t, "localhost:9000", cfg.BackendGroups[0].Servers[0].Host)
+	require.Equal(t, "${WASSEET_PORT}", cfg.Rules[0].RequestOperations[0].(*config.AddHeaderRequestOperation).Value)
+}
+
+func TestLoad_EnvExpansionErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", "port: 8080\nzone: ${WASSEET_UNSET}\n")
+	_, err := (&yamlapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, path+":2: environment variable WASSEET_UNSET is not set")
+
+	path = writeFile(t, dir, "config.yaml", "zone: ${WASSEET-ZONE}\n")
+	_, err = (&yamlapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, path+":1: invalid environment variable reference ${WASSEET-ZONE}")
+}
+
+func TestLoad_EnvExpansionSkipsComments(t *testing.T) {
+	t.Setenv("WASSEET_PORT", "8081")
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+# port: ${WASSEET_UNSET}
+port: ${WASSEET_PORT} # was ${WASSEET_OLD_PORT}
+backend_groups:
+  - name: backend1
+    servers:
+      # - ${WASSEET_UNSET}:9000
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+`)
+
+	cfg, err := (&yamlapi.Source{Path: path}).Load()
+	require.NoError(t, err)
+	require.Equal(t, 8081, cfg.Port)
+	require.Len(t, cfg.BackendGroups[0].Servers, 1)
+}
+
+func TestLoad_Include(t *testing.T) {
+	t.Setenv("WASSEET_ORDERS_HOST", "orders.internal")
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", `
+port: 8080
+include:
+  - conf.d/*.yaml
+  - extra.json
+backend_groups:
+  - name: default
+    servers:
+      - localhost:9000
+rules:
+  - path: /static
+    backend_group: default
+  - path: /orders/legacy
+    backend_group: orders
+`)
+	writeFile(t, dir, "conf.d/users.yaml", `
+backend_groups:
+  - name: users
+    servers:
+      - localhost:9001
+rules:
+  - path: /users
+    backend_group: users
+`)
+	writeFile(t, dir, "conf.d/orders.yaml", `
+backend_groups:
+  - name: orders
+    servers:
+      - ${WASSEET_ORDERS_HOST}:9002
+rules:
+  - path: /orders
+    backend_group: orders
+  - path: /orders/users
+    backend_group: users
+`)
+	writeFile(t, dir, "conf.d/README.md", "not a config file")
+	writeFile(t, dir, "extra.json", `{"rules": [{"path": "/extra", "backend_group": "default"}]}`)
+
+	cfg, err := (&yamlapi.Source{Path: path}).Load()
+	require.NoError(t, err)
+
+	var names []string
+	for _, bg := range cfg.BackendGroups {
+		names = append(names, bg.Name)
+	}
+	require.Equal(t, []string{"default", "orders", "users"}, names)
+	require.Equal(t, "orders.internal:9002", cfg.BackendGroups[1].Servers[0].Host)
+
+	var rules []string
+	for _, rule := range cfg.Rules {
+		rules = append(rules, rule.Path+" -> "+rule.BackendGroup.Name)
+	}
+	require.Equal(t, []string{
+		"/static -> default",
+		"/orders/legacy -> orders",
+		"/orders -> orders",
+		"/orders/users -> users",
+		"/users -> users",
+		"/extra -> default",
+	}, rules)
+}
+
+func TestLoad_IncludeErrors(t *testing.T) {
+	main := `
+port: 8080
+include: [conf.d/*.yaml]
+backend_groups:
+  - name: default
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: default
+`
+	tests := []struct {
+		name     string
+		included string
+		err      string
+	}{
+		{
+			name: "duplicate name",
+			included: `
+backend_groups:
+  - name: default
+    servers:
+      - localhost:9001
+`,
+			err: `conf.d/team.yaml:3:5: backend_groups[0].name: name "default" is already used in `,
+		},
+		{
+			name: "invalid backend group",
+			included: `
+backend_groups:
+  - name: team
+    servers:
+      - "invalid server"
+`,
+			err: `conf.d/team.yaml:5:9: backend_groups[0].servers[0]: server "invalid server" must be in format [hostname|IP:port]`,
+		},
+		{
+			name: "unknown backend group",
+			included: `
+rules:
+  - path: /team
+    backend_group: team
+`,
+			err: `conf.d/team.yaml:4:5: rules[0].backend_group: backend group "team" not found`,
+		},
+		{
+			name:     "not only backend groups and rules",
+			included: "port: 8081\n",
+			err:      "conf.d/team.yaml:1:1: port: included files can only define backend_groups and rules",
+		},
+		{
+			name:     "invalid yaml",
+			included: "backend_groups: {\n",
+			err:      "conf.d/team.yaml:1: did not find expected node content",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeFile(t, dir, "config.yaml", main)
+			writeFile(t, dir, "conf.d/team.yaml", tt.included)
+
+			_, err := (&yamlapi.Source{Path: path}).Load()
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestLoad_IncludeMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", `
+port: 8080
+include: [conf.d/*.yaml, team.yaml]
+backend_groups:
+  - name: default
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: default
+`)
+
+	// globs may match no file, but included files must exist
+	_, err := (&yamlapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, path+":3:26: include[1]: included file "+filepath.Join(dir, "team.yaml")+" does not exist")
+}
+
+func TestValidate_DuplicateBackendGroupName(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+  - name: backend1
+    servers:
+      - localhost:9001
+rules:
+  - path: /
+    backend_group: backend1
+`)
+
+	_, err := (&yamlapi.Source{Path: path}).Load()
+	require.ErrorContains(t, err, path+`:7:5: backend_groups[1].name: name "backend1" is already used`)
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
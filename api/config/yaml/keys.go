@@ -0,0 +1,93 @@
+package yaml
+
+import (
+	"maps"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkKeys reports the keys of node that are not fields of typ. The decoder
+// ignores them, so that a typo would otherwise silently do nothing.
+func checkKeys(v validator, node *yaml.Node, typ reflect.Type) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, content := range node.Content {
+			checkKeys(v, content, typ)
+		}
+		return
+	case yaml.AliasNode:
+		// checked where it is anchored
+		return
+	}
+
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	// operations are decoded into the type given by their type key
+	switch typ {
+	case reflect.TypeFor[RequestOperationWrapper]():
+		var w RequestOperationWrapper
+		if err := node.Decode(&w); err != nil {
+			return // reported by the decoder
+		}
+		typ = reflect.TypeOf(w.Operation).Elem()
+	case reflect.TypeFor[ResponseOperationWrapper]():
+		var w ResponseOperationWrapper
+		if err := node.Decode(&w); err != nil {
+			return
+		}
+		typ = reflect.TypeOf(w.Operation).Elem()
+	}
+
+	switch {
+	case typ.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(typ)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				continue // reported by the decoder
+			}
+			if key.Tag == "!!merge" {
+				checkKeys(v, value, typ)
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				v.at(key.Value).errorf("unknown key %q", key.Value)
+				continue
+			}
+			checkKeys(v.at(key.Value), value, field)
+		}
+	case typ.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkKeys(v.at(node.Content[i].Value), node.Content[i+1], typ.Elem())
+		}
+	case typ.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			checkKeys(v.at(i), item, typ.Elem())
+		}
+	}
+}
+
+// yamlFields returns the types of the fields of a struct by key. The fields of
+// embedded structs are inlined.
+func yamlFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		switch {
+		case name == "-":
+		case field.Anonymous || options == "inline":
+			maps.Copy(fields, yamlFields(field.Type))
+		case field.IsExported():
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fields[name] = field.Type
+		}
+	}
+	return fields
+}
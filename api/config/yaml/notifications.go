@@ -0,0 +1,71 @@
+package yaml
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+// Notifications sends the changes of the health of servers to a webhook.
+type Notifications struct {
+	WebhookURL         string            `yaml:"webhook_url"`
+	Headers            map[string]string `yaml:"headers"`               // Optional, e.g. for authentication
+	Timeout            string            `yaml:"timeout"`               // Optional, 5s by default
+	MaxRetries         *int              `yaml:"max_retries"`           // Optional, 3 by default
+	RetryBackoff       string            `yaml:"retry_backoff"`         // Optional, 1s by default, doubled on every retry
+	MaxEventsPerMinute int               `yaml:"max_events_per_minute"` // Optional, 60 by default
+}
+
+func (n Notifications) Validate() error {
+	var errs ValidationErrors
+	n.validate(newValidator(nil, &errs))
+	return errs.err()
+}
+
+// validate checks the values that are parsed, the rules of notifications
+// being checked by config.Notifications.Validate on the parsed notifications.
+func (n Notifications) validate(v validator) {
+	if _, err := url.Parse(n.WebhookURL); err != nil {
+		v.at("webhook_url").errorf("webhook_url %q must be an http or https URL", n.WebhookURL)
+	}
+	// durations that are set must be greater than 0 since 0 is their default
+	validatePositiveDurations(v, []namedDuration{
+		{"timeout", n.Timeout},
+		{"retry_backoff", n.RetryBackoff},
+	})
+	v.add(n.parse().Validate())
+}
+
+// parse returns the notifications without defaults, but the number of
+// retries, the values that cannot be parsed being left to zero.
+func (n Notifications) parse() *config.Notifications {
+	webhookURL, _ := url.Parse(n.WebhookURL)
+
+	var headers http.Header
+	if len(n.Headers) > 0 {
+		headers = make(http.Header, len(n.Headers))
+		for name, value := range n.Headers {
+			headers.Set(name, value)
+		}
+	}
+
+	maxRetries := config.DefaultMaxRetries
+	if n.MaxRetries != nil {
+		maxRetries = *n.MaxRetries
+	}
+
+	return &config.Notifications{
+		WebhookURL:         webhookURL,
+		Headers:            headers,
+		Timeout:            parseDuration(n.Timeout),
+		MaxRetries:         maxRetries,
+		RetryBackoff:       parseDuration(n.RetryBackoff),
+		MaxEventsPerMinute: n.MaxEventsPerMinute,
+	}
+}
+
+// Resolve must only be called on validated notifications.
+func (n Notifications) Resolve() *config.Notifications {
+	return n.parse().WithDefaults()
+}
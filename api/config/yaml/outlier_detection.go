@@ -0,0 +1,74 @@
+package yaml
+
+import (
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+// OutlierDetection ejects servers based on the responses to proxied requests.
+//
+// Each detector is disabled unless its threshold is set.
+type OutlierDetection struct {
+	Consecutive5xx              int     `yaml:"consecutive_5xx"`               // Optional
+	ConsecutiveConnectionErrors int     `yaml:"consecutive_connection_errors"` // Optional
+	SuccessRateStdevFactor      float64 `yaml:"success_rate_stdev_factor"`     // Optional
+	SuccessRateMinimumHosts     int     `yaml:"success_rate_minimum_hosts"`    // Optional
+	SuccessRateRequestVolume    int     `yaml:"success_rate_request_volume"`   // Optional
+	Interval                    string  `yaml:"interval"`                      // Optional
+	BaseEjectionTime            string  `yaml:"base_ejection_time"`            // Optional
+	MaxEjectionTime             string  `yaml:"max_ejection_time"`             // Optional
+	MaxEjectionPercent          int     `yaml:"max_ejection_percent"`          // Optional
+}
+
+func (od OutlierDetection) Validate() error {
+	var errs ValidationErrors
+	od.validate(newValidator(nil, &errs))
+	return errs.err()
+}
+
+// validate checks the durations, the rules of outlier detections being checked
+// by config.OutlierDetection.Validate on the parsed outlier detection.
+func (od OutlierDetection) validate(v validator) {
+	// durations that are set must be greater than 0 since 0 is their default
+	valid := validatePositiveDurations(v, []namedDuration{
+		{"interval", od.Interval},
+		{"base_ejection_time", od.BaseEjectionTime},
+		{"max_ejection_time", od.MaxEjectionTime},
+	})
+	parsed := od.parse()
+	if !valid {
+		// the durations are compared with each other, which is only
+		// meaningful when they are all valid
+		parsed.Interval, parsed.BaseEjectionTime, parsed.MaxEjectionTime = 0, 0, 0
+	}
+	v.add(parsed.Validate())
+}
+
+// parse returns the outlier detection without defaults, the durations that
+// cannot be parsed being left to zero.
+func (od OutlierDetection) parse() *config.OutlierDetection {
+	return &config.OutlierDetection{
+		Consecutive5xx:              od.Consecutive5xx,
+		ConsecutiveConnectionErrors: od.ConsecutiveConnectionErrors,
+		SuccessRateStdevFactor:      od.SuccessRateStdevFactor,
+		SuccessRateMinimumHosts:     od.SuccessRateMinimumHosts,
+		SuccessRateRequestVolume:    od.SuccessRateRequestVolume,
+		Interval:                    parseDuration(od.Interval),
+		BaseEjectionTime:            parseDuration(od.BaseEjectionTime),
+		MaxEjectionTime:             parseDuration(od.MaxEjectionTime),
+		MaxEjectionPercent:          od.MaxEjectionPercent,
+	}
+}
+
+// Resolve must only be called on validated outlier detections.
+func (od OutlierDetection) Resolve() *config.OutlierDetection {
+	return od.parse().WithDefaults()
+}
+
+// parseDuration returns 0 for durations that are not set or cannot be parsed,
+// the zero values being set to their defaults once validated.
+func parseDuration(value string) time.Duration {
+	d, _ := time.ParseDuration(value)
+	return d
+}
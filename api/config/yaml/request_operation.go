@@ -23,17 +23,16 @@ func (w *RequestOperationWrapper) UnmarshalYAML(node *yaml.Node) error {
 		return err
 	}
 
+	// type errors let the decoder go on and report the other errors
 	if RequestOp.Type == "" {
-		return fmt.Errorf("request operation type is missing")
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: request operation type is missing", node.Line)}}
 	}
 
-	var op IRequestOperation
-	switch RequestOp.Type {
-	case addHeaderRequestOperationType:
-		op = &AddHeaderRequestOperation{}
-	default:
-		return fmt.Errorf("unknown request operation type: %s", RequestOp.Type)
+	newOp, ok := requestOperationTypes[RequestOp.Type]
+	if !ok {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: unknown request operation type: %s", node.Line, RequestOp.Type)}}
 	}
+	op := newOp()
 
 	if err := node.Decode(op); err != nil {
 		return err
@@ -54,6 +53,11 @@ const (
 	addHeaderRequestOperationType RequestOperationType = "add_header"
 )
 
+// requestOperationTypes creates the operation of each type, e.g. for decoding.
+var requestOperationTypes = map[RequestOperationType]func() IRequestOperation{
+	addHeaderRequestOperationType: func() IRequestOperation { return &AddHeaderRequestOperation{} },
+}
+
 type AddHeaderRequestOperation struct {
 	RequestOperation
 	Header string `yaml:"header"`
@@ -63,13 +67,7 @@ type AddHeaderRequestOperation struct {
 func (op *AddHeaderRequestOperation) Apply(req request.ServerRequest) {}
 
 func (op *AddHeaderRequestOperation) Validate() error {
-	if op.Header == "" {
-		return fmt.Errorf("header is missing")
-	}
-	if op.Value == "" {
-		return fmt.Errorf("value is missing")
-	}
-	return nil
+	return (&config.AddHeaderRequestOperation{Header: op.Header, Value: op.Value}).Validate()
 }
 
 func (op *AddHeaderRequestOperation) Resolve() config.RequestOperation {
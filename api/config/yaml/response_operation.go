@@ -24,17 +24,16 @@ func (w *ResponseOperationWrapper) UnmarshalYAML(node *yaml.Node) error {
 		return err
 	}
 
+	// type errors let the decoder go on and report the other errors
 	if ResponseOp.Type == "" {
-		return fmt.Errorf("response operation type is missing")
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: response operation type is missing", node.Line)}}
 	}
 
-	var op IResponseOperation
-	switch ResponseOp.Type {
-	case addHeaderResponseOperationType:
-		op = &AddHeaderResponseOperation{}
-	default:
-		return fmt.Errorf("unknown response operation type: %s", ResponseOp.Type)
+	newOp, ok := responseOperationTypes[ResponseOp.Type]
+	if !ok {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: unknown response operation type: %s", node.Line, ResponseOp.Type)}}
 	}
+	op := newOp()
 
 	if err := node.Decode(op); err != nil {
 		return err
@@ -55,6 +54,11 @@ const (
 	addHeaderResponseOperationType ResponseOperationType = "add_header"
 )
 
+// responseOperationTypes creates the operation of each type, e.g. for decoding.
+var responseOperationTypes = map[ResponseOperationType]func() IResponseOperation{
+	addHeaderResponseOperationType: func() IResponseOperation { return &AddHeaderResponseOperation{} },
+}
+
 type AddHeaderResponseOperation struct {
 	ResponseOperation
 	Header string `yaml:"header"`
@@ -64,13 +68,7 @@ type AddHeaderResponseOperation struct {
 func (op *AddHeaderResponseOperation) Apply(res *http.Response) {}
 
 func (op *AddHeaderResponseOperation) Validate() error {
-	if op.Header == "" {
-		return fmt.Errorf("header is missing")
-	}
-	if op.Value == "" {
-		return fmt.Errorf("value is missing")
-	}
-	return nil
+	return (&config.AddHeaderResponseOperation{Header: op.Header, Value: op.Value}).Validate()
 }
 
 func (op *AddHeaderResponseOperation) Resolve() config.ResponseOperation {
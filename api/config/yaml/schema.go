@@ -0,0 +1,142 @@
+package yaml
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+// Schema returns the JSON Schema of config files, in YAML or JSON, generated
+// from Config so that it accepts the keys the decoder accepts, e.g. for
+// editors to complete and check config files. It describes the structure of
+// the config: the rules that involve several keys, e.g. that backend groups
+// referenced by rules must exist, are only checked by Validate.
+func Schema() map[string]any {
+	schema := typeSchema(reflect.TypeFor[Config]())
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "wasseet config"
+	return schema
+}
+
+// requiredKeys are the keys that the objects of a type must have. Keys only
+// required in some cases, e.g. the path of http health checks, are left out.
+var requiredKeys = map[reflect.Type][]string{
+	reflect.TypeFor[BackendGroup]():  {"name", "servers"},
+	reflect.TypeFor[Server]():        {"address"},
+	reflect.TypeFor[Rule]():          {"backend_group"},
+	reflect.TypeFor[HealthCheck]():   {"interval", "timeout"},
+	reflect.TypeFor[Notifications](): {"webhook_url"},
+	reflect.TypeFor[Admin]():         {"address", "token"},
+}
+
+// deprecatedKeys are the keys of a type that are still accepted but replaced
+// by other keys.
+var deprecatedKeys = map[reflect.Type][]string{
+	reflect.TypeFor[HealthCheck](): {"retries"},
+}
+
+// enumValues are the values of the types whose values are enumerated.
+var enumValues = map[reflect.Type][]string{
+	reflect.TypeFor[LoadBalancingType](): sortedStrings(slices.Collect(maps.Keys(validLoadBalancingTypes))),
+	reflect.TypeFor[HealthCheckType]():   sortedStrings(config.HealthCheckTypes),
+}
+
+func sortedStrings[T ~string](values []T) []string {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i] = string(value)
+	}
+	slices.Sort(strs)
+	return strs
+}
+
+func typeSchema(typ reflect.Type) map[string]any {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	switch typ {
+	case reflect.TypeFor[Server]():
+		// see Server.UnmarshalYAML
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			structSchema(typ, nil),
+		}}
+	case reflect.TypeFor[RequestOperationWrapper]():
+		return operationSchema(requestOperationTypes)
+	case reflect.TypeFor[ResponseOperationWrapper]():
+		return operationSchema(responseOperationTypes)
+	}
+
+	if values, ok := enumValues[typ]; ok {
+		return map[string]any{"type": "string", "enum": values}
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		// the decoder turns any scalar into a string, e.g. 200 into "200"
+		return map[string]any{"type": []string{"string", "number", "boolean"}}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(typ.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(typ.Elem())}
+	case reflect.Struct:
+		return structSchema(typ, nil)
+	default:
+		panic(fmt.Sprintf("no schema for %s", typ))
+	}
+}
+
+// structSchema returns the schema of the objects decoded into a struct, with
+// the given properties replacing the schemas of the fields. Unknown keys are
+// rejected, as they are by checkKeys.
+func structSchema(typ reflect.Type, properties map[string]any) map[string]any {
+	props := make(map[string]any)
+	for key, field := range yamlFields(typ) {
+		props[key] = typeSchema(field)
+	}
+	maps.Copy(props, properties)
+	for _, key := range deprecatedKeys[typ] {
+		props[key].(map[string]any)["deprecated"] = true
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if required := requiredKeys[typ]; len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// operationSchema returns the schema of operations, whose keys depend on
+// their type key, e.g. the header and value of add_header operations.
+func operationSchema[T ~string, Op any](types map[T]func() Op) map[string]any {
+	var variants []any
+	for _, typ := range slices.Sorted(maps.Keys(types)) {
+		op := reflect.TypeOf(types[typ]())
+		variant := structSchema(op.Elem(), map[string]any{
+			"type": map[string]any{"const": string(typ)},
+		})
+		// every key of an operation is required, e.g. see
+		// AddHeaderRequestOperation.Validate
+		variant["required"] = slices.Sorted(maps.Keys(variant["properties"].(map[string]any)))
+		variants = append(variants, variant)
+	}
+	return map[string]any{
+		"type":     "object",
+		"required": []string{"type"},
+		"oneOf":    variants,
+	}
+}
@@ -0,0 +1,108 @@
+package yaml_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSchema checks that the schema matches the decoder: a config using every
+// key of the schema, with values of the types of the schema, is decoded
+// without type errors, and the keys the schema rejects are the ones the
+// decoder reports as unknown.
+func TestSchema(t *testing.T) {
+	var unknownKeys []string
+	doc := instance(yaml.Schema(), "", &unknownKeys)
+	content, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	_, err = yaml.Parse(content, yaml.FormatJSON)
+	var errs yaml.ValidationErrors
+	require.True(t, errors.As(err, &errs), err)
+
+	var reported []string
+	for _, err := range errs {
+		switch {
+		case err.Message == `unknown key "unknown"`:
+			reported = append(reported, err.Path)
+		case strings.Contains(err.Message, "cannot unmarshal"), strings.Contains(err.Message, "operation type"):
+			t.Errorf("the decoder rejects a value allowed by the schema: %s", err)
+		}
+	}
+	slices.Sort(unknownKeys)
+	slices.Sort(reported)
+	require.Equal(t, unknownKeys, reported)
+	require.Contains(t, unknownKeys, "rules[0].request_operations[0].unknown")
+	require.Contains(t, unknownKeys, "backend_groups[0].servers[1].unknown")
+}
+
+// instance returns a value matching the schema, using every key of its
+// objects and every variant of its arrays. An unknown key is added to the
+// objects that do not allow them and its path is recorded.
+func instance(schema map[string]any, path string, unknownKeys *[]string) any {
+	if variants, ok := schema["oneOf"].([]any); ok {
+		return instance(variants[0].(map[string]any), path, unknownKeys)
+	}
+	if value, ok := schema["const"]; ok {
+		return value
+	}
+	if values, ok := schema["enum"].([]string); ok {
+		return values[0]
+	}
+
+	typ := schema["type"]
+	if types, ok := typ.([]string); ok {
+		typ = types[0]
+	}
+	switch typ {
+	case "string":
+		return "x"
+	case "integer":
+		return 1
+	case "number":
+		return 0.5
+	case "boolean":
+		return true
+	case "array":
+		items := schema["items"].(map[string]any)
+		var values []any
+		variants, ok := items["oneOf"].([]any)
+		if !ok {
+			variants = []any{items}
+		}
+		for _, variant := range variants {
+			values = append(values, instance(variant.(map[string]any), fmt.Sprintf("%s[%d]", path, len(values)), unknownKeys))
+		}
+		return values
+	case "object":
+		object := make(map[string]any)
+		if properties, ok := schema["properties"].(map[string]any); ok {
+			for key, property := range properties {
+				object[key] = instance(property.(map[string]any), join(path, key), unknownKeys)
+			}
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			object["unknown"] = "x"
+			*unknownKeys = append(*unknownKeys, join(path, "unknown"))
+		case map[string]any:
+			object["key"] = instance(additional, join(path, "key"), unknownKeys)
+		}
+		return object
+	default:
+		panic(fmt.Sprintf("unexpected schema at %q: %v", path, schema))
+	}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,35 @@
+package yaml
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// Server is a backend server of a backend group.
+//
+// It is written either as a plain address:
+//
+//	servers:
+//	  - localhost:9000
+//
+// or as a mapping when the placement of the server matters:
+//
+//	servers:
+//	  - address: localhost:9000
+//	    priority: 1
+//	    zone: eu-west-1a
+type Server struct {
+	Address  string `yaml:"address"`
+	Priority int    `yaml:"priority"` // Optional, 0 is the highest priority
+	Zone     string `yaml:"zone"`     // Optional
+}
+
+func (s *Server) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Address)
+	}
+
+	// plainServer has the same fields as Server but not its UnmarshalYAML
+	// method, which would otherwise be called recursively.
+	type plainServer Server
+	return node.Decode((*plainServer)(s))
+}
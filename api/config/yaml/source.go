@@ -1,32 +1,44 @@
 package yaml
 
 import (
-	"fmt"
-	"os"
+	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
-	"gopkg.in/yaml.v3"
 )
 
 type Source struct {
 	Path string
+	// Format of the file, FormatJSON for .json files and FormatYAML for any
+	// other file by default.
+	Format Format
+	// AutoReload makes Watch report the changes of the file, so that the
+	// proxy reloads it without waiting for SIGHUP.
+	AutoReload bool
+	// Debounce is how long the file must stay untouched before a change is
+	// reported, so that a burst of writes results in a single reload.
+	// It defaults to 100ms.
+	Debounce time.Duration
+	// Polling checks the file every PollInterval instead of using inotify,
+	// e.g. for network file systems. Platforms other than Linux always poll.
+	Polling bool
+	// PollInterval defaults to 1s.
+	PollInterval time.Duration
 }
 
+// Load loads the config file along with the files it includes. References to
+// environment variables are expanded before the files are decoded.
 func (s *Source) Load() (config.Config, error) {
-	configBytes, err := os.ReadFile(s.Path)
+	files, err := s.read()
 	if err != nil {
-		return config.Config{}, fmt.Errorf("failed to read config file: %w", err)
+		return config.Config{}, err
 	}
+	return files.parse()
+}
 
-	var yamlconfig Config
-	if err := yaml.Unmarshal(configBytes, &yamlconfig); err != nil {
-		return config.Config{}, fmt.Errorf("failed to unmarshal config file: %w", err)
+// format returns the format of the file, from its extension by default.
+func (s *Source) format() Format {
+	if s.Format != "" {
+		return s.Format
 	}
-
-	err = yamlconfig.Validate()
-	if err != nil {
-		return config.Config{}, fmt.Errorf("failed to validate config file: %w", err)
-	}
-
-	return yamlconfig.Resolve(), nil
+	return FormatOf(s.Path)
 }
@@ -1,40 +1,34 @@
 package yaml
 
 import (
-	"fmt"
-	"net"
-	"regexp"
+	"time"
 )
 
-func isValidPort(port int, allowZero bool) bool {
-	if allowZero {
-		return port >= 0 && port <= 65535
-	}
-	return port >= 1 && port <= 65535
+func isValidLoadBalancingType(lbt LoadBalancingType) bool {
+	return lbt == "" || validLoadBalancingTypes[lbt]
 }
 
-var dnsRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`)
+type namedDuration struct {
+	name  string
+	value string
+}
 
-func isValidDNSOrIPWithPort(addr string) bool {
-	if addr == "" {
-		return false
-	}
-	// Try to split host and port
-	host, port, err := net.SplitHostPort(addr)
-	if err == nil {
-		// Has port: must be IP:port format or hostname:port format
-		if net.ParseIP(host) == nil && !dnsRegex.MatchString(host) {
-			return false
+// validatePositiveDurations reports the durations that are set but invalid or
+// not greater than 0, and tells whether they are all valid.
+func validatePositiveDurations(v validator, durations []namedDuration) bool {
+	valid := true
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			v.at(d.name).errorf("invalid %s %q: %s", d.name, d.value, err)
+			valid = false
+		} else if duration <= 0 {
+			v.at(d.name).errorf("invalid %s %q: must be greater than 0", d.name, d.value)
+			valid = false
 		}
-		// Validate port is a valid number
-		portNum := 0
-		_, err = fmt.Sscanf(port, "%d", &portNum)
-		return err == nil && isValidPort(portNum, false)
 	}
-	// No port: must be hostname only
-	return dnsRegex.MatchString(addr)
-}
-
-func isValidLoadBalancingType(lbt LoadBalancingType) bool {
-	return lbt == "" || validLoadBalancingTypes[lbt]
+	return valid
 }
@@ -0,0 +1,185 @@
+package yaml
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+const (
+	defaultDebounce     = 100 * time.Millisecond
+	defaultPollInterval = time.Second
+)
+
+// Watch loads the config file every time it or one of the files it includes
+// changes, and sends it until ctx is done, or returns nil when AutoReload is
+// false. The revision of the events is a hash of the content of the files.
+//
+// The directories of the file and of its symlink target are watched rather
+// than the file itself, so that editors replacing the file with a rename and
+// Kubernetes swapping the symlinks of a mounted ConfigMap are noticed. Changes
+// are reported once the file has not changed for Debounce, and only when its
+// content differs from the last reported one.
+func (s *Source) Watch(ctx context.Context) <-chan config.ConfigEvent {
+	if !s.AutoReload {
+		return nil
+	}
+
+	// start watching before returning, so that no change is missed
+	files, err := s.read()
+	var last string
+	if files.main != nil {
+		last = files.revision(err)
+	}
+	var w *dirWatcher
+	if !s.Polling {
+		if dw, err := newDirWatcher(); err == nil {
+			if err := dw.watch(s.watchedDirs(files)); err == nil {
+				w = dw
+			} else {
+				dw.close()
+			}
+		}
+	}
+	events := make(chan config.ConfigEvent)
+	go s.watch(ctx, w, last, events)
+	return events
+}
+
+// watch reports the changes of the file using w, or by polling if w is nil.
+func (s *Source) watch(ctx context.Context, w *dirWatcher, last string, events chan<- config.ConfigEvent) {
+	defer close(events)
+
+	debounce := s.Debounce
+	if debounce == 0 {
+		debounce = defaultDebounce
+	}
+	pollInterval := s.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	// inotify events, or ticks of the polling fallback
+	var changes <-chan struct{}
+	var poll <-chan time.Time
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	if w != nil {
+		defer w.close()
+		changes = w.events
+	} else {
+		poll = ticker.C
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	check := func() *config.ConfigEvent {
+		files, err := s.read()
+		if w != nil {
+			// the symlinks may point to other directories now, and the
+			// included files may have changed
+			w.watch(s.watchedDirs(files))
+		}
+		if files.main == nil {
+			if last == "" {
+				return nil
+			}
+			// report a missing file once
+			last = ""
+			return &config.ConfigEvent{Err: err}
+		}
+		current := files.revision(err)
+		if current == last {
+			return nil
+		}
+		last = current
+		if err != nil {
+			return &config.ConfigEvent{Revision: current, Err: err}
+		}
+		cfg, err := files.parse()
+		if err != nil {
+			return &config.ConfigEvent{Revision: current, Err: err}
+		}
+		return &config.ConfigEvent{Config: &cfg, Revision: current}
+	}
+	// send blocks until the event is received, while watching for changes
+	send := func(event *config.ConfigEvent) bool {
+		if event == nil {
+			return true
+		}
+		select {
+		case events <- *event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				// inotify failed, fall back to polling
+				w, changes, poll = nil, nil, ticker.C
+				continue
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			if !send(check()) {
+				return
+			}
+		case <-poll:
+			if !send(check()) {
+				return
+			}
+		}
+	}
+}
+
+// watchedDirs returns the directories of the config file and of the included
+// files, with the directories along the chain of symlinks leading to the
+// actual config file. Their symlinks are resolved.
+func (s *Source) watchedDirs(files *configFiles) []string {
+	var dirs []string
+	for _, pattern := range files.patterns {
+		// new files matching a glob are noticed if they are created in the
+		// directory of the glob, not in its subdirectories
+		dirs = append(dirs, resolveDir(filepath.Dir(pattern)))
+	}
+	for _, file := range files.included {
+		dirs = append(dirs, resolveDir(filepath.Dir(file.path)))
+	}
+	return append(dirs, symlinkDirs(s.Path)...)
+}
+
+// symlinkDirs returns the directory of the file and the directories along the
+// chain of symlinks leading to the actual file.
+func symlinkDirs(path string) []string {
+	dirs := []string{resolveDir(filepath.Dir(path))}
+	for i := 0; i < 40; i++ {
+		target, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		dirs = append(dirs, resolveDir(filepath.Dir(target)))
+		path = target
+	}
+	return dirs
+}
+
+// resolveDir resolves the symlinks of dir, so that a directory swapped by
+// renaming a symlink, as done by Kubernetes for ConfigMaps, is watched again.
+func resolveDir(dir string) string {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		return resolved
+	}
+	return dir
+}
@@ -0,0 +1,82 @@
+package yaml
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// dirWatcher sends a value on events whenever something changes in one of the
+// watched directories. The events are not decoded, the caller checks the
+// files it cares about.
+type dirWatcher struct {
+	fd     int
+	file   *os.File // wraps fd so that reads go through the runtime poller and can be interrupted
+	events chan struct{}
+	dirs   map[string]int // directory -> watch descriptor
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &dirWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+		dirs:   make(map[string]int),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *dirWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch makes dirs the watched directories. It fails if none of them can be watched.
+func (w *dirWatcher) watch(dirs []string) error {
+	wanted := make(map[string]bool)
+	var errs []error
+	for _, dir := range dirs {
+		wanted[dir] = true
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		w.dirs[dir] = wd
+	}
+	for dir, wd := range w.dirs {
+		if !wanted[dir] {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, dir)
+		}
+	}
+	if len(w.dirs) == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (w *dirWatcher) close() {
+	w.file.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package yaml
+
+import "errors"
+
+// dirWatcher is only implemented on Linux, other platforms poll the file.
+type dirWatcher struct {
+	events chan struct{}
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("watching directories is only supported on Linux")
+}
+
+func (w *dirWatcher) watch(dirs []string) error {
+	return nil
+}
+
+func (w *dirWatcher) close() {}
@@ -0,0 +1,218 @@
+package yaml_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	yamlapi "github.com/mouad-eh/wasseet/api/config/yaml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 8080)
+	src := &yamlapi.Source{Path: path, AutoReload: true}
+	changes := startWatch(t, src)
+
+	writeConfig(t, path, 8081)
+	requirePort(t, requireChange(t, changes), 8081)
+}
+
+func TestWatch_Debounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 8080)
+	src := &yamlapi.Source{Path: path, AutoReload: true, Debounce: 200 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	for port := 8081; port <= 8085; port++ {
+		writeConfig(t, path, port)
+		time.Sleep(10 * time.Millisecond)
+	}
+	event := requireChange(t, changes)
+	requireNoChange(t, changes)
+	requirePort(t, event, 8085)
+}
+
+func TestWatch_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 8080)
+	src := &yamlapi.Source{Path: path, AutoReload: true, Debounce: 10 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	require.NoError(t, os.WriteFile(path, []byte("port: -1\n"), 0o644))
+	event := requireChange(t, changes)
+	require.ErrorContains(t, event.Err, "port must be between 0 and 65535")
+	require.Nil(t, event.Config)
+
+	require.NoError(t, os.Remove(path))
+	event = requireChange(t, changes)
+	require.ErrorContains(t, event.Err, "failed to read config file")
+
+	writeConfig(t, path, 8081)
+	requirePort(t, requireChange(t, changes), 8081)
+}
+
+func TestWatch_UnchangedContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 8080)
+	changes := startWatch(t, &yamlapi.Source{Path: path, AutoReload: true, Debounce: 10 * time.Millisecond})
+
+	writeConfig(t, path, 8080)
+	now := time.Now()
+	require.NoError(t, os.Chtimes(path, now, now))
+	requireNoChange(t, changes)
+}
+
+func TestWatch_RenameReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, 8080)
+	src := &yamlapi.Source{Path: path, AutoReload: true, Debounce: 10 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	// like editors saving to a temporary file renamed over the original one
+	tmp := filepath.Join(dir, ".config.yaml.swp")
+	writeConfig(t, tmp, 8081)
+	require.NoError(t, os.Rename(tmp, path))
+	requirePort(t, requireChange(t, changes), 8081)
+
+	// the new file is watched as well
+	writeConfig(t, path, 8082)
+	requirePort(t, requireChange(t, changes), 8082)
+}
+
+func TestWatch_SymlinkSwap(t *testing.T) {
+	// mimic the layout of a ConfigMap mounted by Kubernetes:
+	// config.yaml -> ..data/config.yaml, ..data -> ..v1
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v1"), 0o755))
+	writeConfig(t, filepath.Join(dir, "..v1", "config.yaml"), 8080)
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), path))
+	src := &yamlapi.Source{Path: path, AutoReload: true, Debounce: 10 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	for version, port := range []int{8081, 8082} {
+		data := fmt.Sprintf("..v%d", version+2)
+		require.NoError(t, os.Mkdir(filepath.Join(dir, data), 0o755))
+		writeConfig(t, filepath.Join(dir, data, "config.yaml"), port)
+		require.NoError(t, os.Symlink(data, filepath.Join(dir, "..data_tmp")))
+		require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+		requirePort(t, requireChange(t, changes), port)
+	}
+}
+
+func TestWatch_Polling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, 8080)
+	src := &yamlapi.Source{Path: path, AutoReload: true, Polling: true, PollInterval: 20 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	writeConfig(t, path, 8081)
+	requirePort(t, requireChange(t, changes), 8081)
+}
+
+func TestWatch_Include(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", `
+port: 8080
+include: [conf.d/*.yaml]
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+`)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "conf.d"), 0o755))
+	src := &yamlapi.Source{Path: path, AutoReload: true, Debounce: 10 * time.Millisecond}
+	changes := startWatch(t, src)
+
+	// a file matching the glob is created
+	writeFile(t, dir, "conf.d/team.yaml", backendGroup("team", "localhost:9001"))
+	event := requireChange(t, changes)
+	require.NoError(t, event.Err)
+	require.Len(t, event.Config.BackendGroups, 2)
+
+	// an included file changes
+	writeFile(t, dir, "conf.d/team.yaml", backendGroup("team", "localhost:9002"))
+	event = requireChange(t, changes)
+	require.NoError(t, event.Err)
+	require.Equal(t, "localhost:9002", event.Config.BackendGroups[1].Servers[0].Host)
+
+	// an included file becomes invalid
+	writeFile(t, dir, "conf.d/team.yaml", backendGroup("backend1", "localhost:9002"))
+	event = requireChange(t, changes)
+	require.ErrorContains(t, event.Err, `name "backend1" is already used`)
+}
+
+func TestWatch_Disabled(t *testing.T) {
+	src := &yamlapi.Source{Path: filepath.Join(t.TempDir(), "config.yaml")}
+	require.Nil(t, src.Watch(context.Background()))
+}
+
+func startWatch(t *testing.T, src *yamlapi.Source) <-chan config.ConfigEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := src.Watch(ctx)
+	t.Cleanup(func() {
+		cancel()
+		// the channel is closed once the watcher is done
+		for range changes {
+		}
+	})
+	return changes
+}
+
+func writeConfig(t *testing.T, path string, port int) {
+	t.Helper()
+	content := fmt.Sprintf(`
+port: %d
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+`, port)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func backendGroup(name, server string) string {
+	return fmt.Sprintf("backend_groups:\n  - name: %s\n    servers:\n      - %s\n", name, server)
+}
+
+func requireChange(t *testing.T, changes <-chan config.ConfigEvent) config.ConfigEvent {
+	t.Helper()
+	select {
+	case event := <-changes:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not reported")
+		return config.ConfigEvent{}
+	}
+}
+
+func requireNoChange(t *testing.T, changes <-chan config.ConfigEvent) {
+	t.Helper()
+	select {
+	case <-changes:
+		t.Fatal("unexpected change reported")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func requirePort(t *testing.T, event config.ConfigEvent, port int) {
+	t.Helper()
+	require.NoError(t, event.Err)
+	require.Equal(t, port, event.Config.Port)
+	require.NotEmpty(t, event.Revision)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+)
+
+// dryRunResult is the output of the dry-run command in JSON.
+type dryRunResult struct {
+	Valid  bool                  `json:"valid"`
+	Errors yaml.ValidationErrors `json:"errors"`
+	Diff   []config.Change       `json:"diff"`
+}
+
+// dryRun validates a candidate config file, as the proxy would load it, and
+// prints the changes it brings to the active config, fetched from the admin
+// API, or to another config file, without applying them. It exits with 1 if
+// the candidate is invalid.
+func dryRun(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("dry-run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output format: text, one change per line, or json")
+	admin := flags.String("admin", "", "URL of the admin API serving the active config, e.g. http://127.0.0.1:9901")
+	token := flags.String("token", os.Getenv("WASSEET_ADMIN_TOKEN"), "token of the admin API, $WASSEET_ADMIN_TOKEN by default")
+	current := flags.String("current", "", "config file to compare the candidate with, instead of the active config")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: wasseet dry-run [-format text|json] (-admin URL [-token TOKEN] | -current config.yaml) candidate.yaml")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") || (*admin == "") == (*current == "") {
+		flags.Usage()
+		return 2
+	}
+
+	result := dryRunResult{Errors: yaml.ValidationErrors{}, Diff: []config.Change{}}
+	candidate, err := (&yaml.Source{Path: flags.Arg(0)}).Load()
+	if err != nil {
+		var validationErrs yaml.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			result.Errors = validationErrs
+		} else {
+			result.Errors = yaml.ValidationErrors{{File: flags.Arg(0), Message: err.Error()}}
+		}
+	} else {
+		var active config.Dump
+		if *admin != "" {
+			active, err = fetchActiveConfig(*admin, *token)
+		} else {
+			active, err = loadDump(*current)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "wasseet: %s\n", err)
+			return 2
+		}
+		result.Valid = true
+		result.Diff = config.DiffDumps(active, candidate.Dump())
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	} else {
+		for _, err := range result.Errors {
+			fmt.Fprintln(stdout, err)
+		}
+		for _, change := range result.Diff {
+			fmt.Fprintln(stdout, change)
+		}
+	}
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
+
+// fetchActiveConfig gets the dump of the active config from the admin API.
+func fetchActiveConfig(adminURL, token string) (config.Dump, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(adminURL, "/")+"/config", nil)
+	if err != nil {
+		return config.Dump{}, fmt.Errorf("invalid admin URL: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return config.Dump{}, fmt.Errorf("failed to get the active config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return config.Dump{}, fmt.Errorf("failed to get the active config: unexpected status %s", resp.Status)
+	}
+	var body struct {
+		Config config.Dump `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return config.Dump{}, fmt.Errorf("failed to decode the active config: %w", err)
+	}
+	return body.Config, nil
+}
+
+func loadDump(path string) (config.Dump, error) {
+	cfg, err := (&yaml.Source{Path: path}).Load()
+	if err != nil {
+		return config.Dump{}, err
+	}
+	return cfg.Dump(), nil
+}
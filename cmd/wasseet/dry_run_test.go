@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/stretchr/testify/require"
+)
+
+var candidateConfig = strings.Replace(validConfig, "      - localhost:9000", "      - localhost:9000\n      - localhost:9001", 1)
+
+func TestDryRun_Current(t *testing.T) {
+	current := writeConfig(t, "config.yaml", validConfig)
+	candidate := writeConfig(t, "candidate.yaml", candidateConfig)
+
+	code, stdout, _ := runCommand(t, "dry-run", "-current", current, candidate)
+	require.Equal(t, 0, code)
+	require.Equal(t, "+ backend_groups[backend1].servers: http://localhost:9001\n", stdout)
+
+	code, stdout, _ = runCommand(t, "dry-run", "-current", current, current)
+	require.Equal(t, 0, code)
+	require.Empty(t, stdout)
+}
+
+func TestDryRun_Admin(t *testing.T) {
+	active, err := (&config.Config{}).Load()
+	require.NoError(t, err)
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"version": 3, "config": active.Dump()})
+	}))
+	defer admin.Close()
+	candidate := writeConfig(t, "candidate.yaml", candidateConfig)
+
+	code, stdout, _ := runCommand(t, "dry-run", "-format", "json", "-admin", admin.URL, "-token", "secret", candidate)
+	require.Equal(t, 0, code)
+	var result dryRunResult
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	require.True(t, result.Valid)
+	require.Empty(t, result.Errors)
+	require.Equal(t, []config.Change{
+		{Type: config.Added, Path: "port", New: float64(8080)},
+		{Type: config.Added, Path: "backend_groups[backend1]", New: map[string]any{
+			"name":           "backend1",
+			"load_balancing": "round_robin",
+			"servers":        []any{"http://localhost:9000", "http://localhost:9001"},
+		}},
+		// the path / matches every request and is resolved to no path
+		{Type: config.Added, Path: "rules[*]", New: map[string]any{"backend_group": "backend1"}},
+	}, result.Diff)
+
+	code, _, stderr := runCommand(t, "dry-run", "-admin", admin.URL, "-token", "wrong", candidate)
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "unexpected status 401 Unauthorized")
+}
+
+func TestDryRun_Invalid(t *testing.T) {
+	current := writeConfig(t, "config.yaml", validConfig)
+	candidate := writeConfig(t, "candidate.yaml", invalidConfig)
+
+	code, stdout, _ := runCommand(t, "dry-run", "-current", current, candidate)
+	require.Equal(t, 1, code)
+	require.Contains(t, stdout, `rules[0].backend_grup: unknown key "backend_grup"`)
+}
+
+func TestDryRun_Usage(t *testing.T) {
+	candidate := writeConfig(t, "candidate.yaml", candidateConfig)
+
+	code, _, stderr := runCommand(t, "dry-run", candidate)
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "Usage: wasseet dry-run")
+
+	code, _, _ = runCommand(t, "dry-run", "-admin", "http://127.0.0.1:9901", "-current", candidate, candidate)
+	require.Equal(t, 2, code)
+}
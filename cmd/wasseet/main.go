@@ -0,0 +1,51 @@
+// Command wasseet provides tools to work with wasseet config files.
+//
+// Usage:
+//
+//	wasseet validate [-format text|json] config.yaml...
+//	wasseet dry-run [-format text|json] (-admin URL [-token TOKEN] | -current config.yaml) candidate.yaml
+//	wasseet schema
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command given by args and returns its exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	switch args[0] {
+	case "validate":
+		return validate(args[1:], stdout, stderr)
+	case "dry-run":
+		return dryRun(args[1:], stdout, stderr)
+	case "schema":
+		return schema(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "wasseet: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: wasseet <command> [arguments]
+
+Commands:
+  validate  check config files and report all their errors
+  dry-run   check a config file and show the changes it brings to the active config
+  schema    print the JSON Schema of config files
+`)
+}
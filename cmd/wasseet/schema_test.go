@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	code, stdout, _ := runCommand(t, "schema")
+	require.Equal(t, 0, code)
+
+	var schema struct {
+		Schema     string `json:"$schema"`
+		Properties map[string]struct {
+			Items struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &schema))
+	require.Equal(t, "https://json-schema.org/draft/2020-12/schema", schema.Schema)
+	require.Contains(t, schema.Properties["rules"].Items.Properties, "request_operations")
+
+	code, _, stderr := runCommand(t, "schema", "config.yaml")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "Usage: wasseet schema")
+}
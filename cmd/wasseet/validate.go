@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/mouad-eh/wasseet/api/config/yaml"
+)
+
+// validationResult is the output of the validate command in JSON.
+type validationResult struct {
+	Valid  bool                  `json:"valid"`
+	Errors yaml.ValidationErrors `json:"errors"`
+}
+
+// validate loads config files, as the proxy would, and prints all their
+// errors. It exits with 1 if any file is invalid.
+func validate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output format: text, one file:line:column: error per line, or json")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: wasseet validate [-format text|json] config.yaml...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	errs := yaml.ValidationErrors{}
+	for _, path := range flags.Args() {
+		_, err := (&yaml.Source{Path: path}).Load()
+		if err == nil {
+			continue
+		}
+		var validationErrs yaml.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			errs = append(errs, validationErrs...)
+		} else {
+			errs = append(errs, &yaml.ValidationError{File: path, Message: err.Error()})
+		}
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(validationResult{Valid: len(errs) == 0, Errors: errs}); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	} else {
+		for _, err := range errs {
+			fmt.Fprintln(stdout, err)
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
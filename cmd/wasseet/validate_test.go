@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_group: backend1
+`
+
+const invalidConfig = `
+port: 8080
+backend_groups:
+  - name: backend1
+    servers:
+      - localhost:9000
+rules:
+  - path: /
+    backend_grup: backend1
+`
+
+func TestValidate_Valid(t *testing.T) {
+	path := writeConfig(t, "config.yaml", validConfig)
+
+	code, stdout, _ := runCommand(t, "validate", path)
+	require.Equal(t, 0, code)
+	require.Empty(t, stdout)
+}
+
+func TestValidate_Text(t *testing.T) {
+	path := writeConfig(t, "config.yaml", invalidConfig)
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+
+	code, stdout, _ := runCommand(t, "validate", path, missing)
+	require.Equal(t, 1, code)
+	require.Equal(t, path+`:8:5: rules[0].backend_group: backend_group is required
+`+path+`:9:5: rules[0].backend_grup: unknown key "backend_grup"
+`+missing+`: failed to read config file: open `+missing+`: no such file or directory
+`, stdout)
+}
+
+func TestValidate_JSON(t *testing.T) {
+	path := writeConfig(t, "config.yaml", invalidConfig)
+
+	code, stdout, _ := runCommand(t, "validate", "-format", "json", path)
+	require.Equal(t, 1, code)
+	require.JSONEq(t, `{
+		"valid": false,
+		"errors": [
+			{"file": "`+path+`", "line": 8, "column": 5, "path": "rules[0].backend_group", "message": "backend_group is required"},
+			{"file": "`+path+`", "line": 9, "column": 5, "path": "rules[0].backend_grup", "message": "unknown key \"backend_grup\""}
+		]
+	}`, stdout)
+
+	code, stdout, _ = runCommand(t, "validate", "-format", "json", writeConfig(t, "valid.yaml", validConfig))
+	require.Equal(t, 0, code)
+	var result validationResult
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	require.True(t, result.Valid)
+	require.NotNil(t, result.Errors)
+}
+
+func TestValidate_Usage(t *testing.T) {
+	code, _, stderr := runCommand(t, "validate")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "Usage: wasseet validate")
+
+	code, _, _ = runCommand(t, "validate", "-format", "xml", "config.yaml")
+	require.Equal(t, 2, code)
+
+	code, _, stderr = runCommand(t, "serve")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, `unknown command "serve"`)
+}
+
+func runCommand(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
@@ -1,6 +1,6 @@
 module github.com/mouad-eh/wasseet
 
-go 1.23.4
+go 1.24.0
 
 require (
 	github.com/stretchr/testify v1.11.1
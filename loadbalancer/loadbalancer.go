@@ -1,11 +1,29 @@
 package loadbalancer
 
 import (
+	"errors"
 	"net/url"
+
+	"github.com/mouad-eh/wasseet/request"
 )
 
 //go:generate moq -pkg mocks -out ../testutils/mocks/loadbalancer.go .  LoadBalancer
 
+// ErrNoBackendAvailable is returned by Pick when there is no backend
+// that can serve the request.
+var ErrNoBackendAvailable = errors.New("no backend available")
+
+// DoneFunc must be called exactly once when the request sent to the picked
+// backend has completed, so that the load balancer can release any state it
+// associated with that request.
+type DoneFunc func()
+
+// LoadBalancer selects the backend that should serve a request.
+//
+// Implementations must be safe for concurrent use as Pick is called from
+// every request handled by the proxy.
 type LoadBalancer interface {
-	Next() *url.URL
+	Pick(req request.ServerRequest) (*url.URL, DoneFunc, error)
 }
+
+func noopDone() {}
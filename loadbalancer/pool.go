@@ -0,0 +1,447 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HealthAware is implemented by load balancers that restrict their choice
+// to healthy backends.
+//
+// The proxy uses it to propagate the status reported by health checks.
+type HealthAware interface {
+	SetHealthy(backend *url.URL, healthy bool)
+}
+
+// EjectionAware is implemented by load balancers that exclude backends
+// ejected by outlier detection.
+//
+// Ejection is tracked separately from health so that a backend only gets
+// traffic again once it is both healthy and no longer ejected.
+type EjectionAware interface {
+	SetEjected(backend *url.URL, ejected bool)
+}
+
+// Drainable is implemented by load balancers that can stop sending requests
+// to a backend, e.g. before it is taken down for maintenance.
+//
+// A drained backend gets no traffic at all, even in panic mode, until it is
+// enabled again.
+type Drainable interface {
+	SetDrained(backend *url.URL, drained bool)
+}
+
+// Membership is implemented by load balancers whose backends can be added and
+// removed after their creation, e.g. when servers register at runtime.
+//
+// Adding a backend that is already there, or removing one that is not, does
+// nothing. Added backends are primaries with the highest priority.
+type Membership interface {
+	AddBackend(backend *url.URL)
+	RemoveBackend(backend *url.URL)
+}
+
+// SlowStarter is implemented by load balancers that can gradually ramp up
+// the traffic sent to a backend, see WithSlowStart.
+type SlowStarter interface {
+	// SlowStart restarts the slow start window of the backend.
+	SlowStart(backend *url.URL)
+}
+
+// FailoverAware is implemented by load balancers that can route to backup
+// backends.
+//
+// The proxy uses it to report when a backend group fails over to its backups.
+type FailoverAware interface {
+	// FailedOver tells whether the traffic goes to the backup backends
+	// because no primary backend is healthy, not ejected and not drained.
+	FailedOver() bool
+}
+
+// StateInheritor is implemented by load balancers that can take over the
+// runtime state of the load balancer they replace, e.g. on a config reload.
+//
+// The backends that both load balancers share keep their health, ejection,
+// drain and slow start state, while the backends that are new to the
+// replacing load balancer are put in slow start.
+type StateInheritor interface {
+	InheritState(prev LoadBalancer)
+}
+
+// pooled is implemented by the load balancers that embed a pool.
+type pooled interface {
+	backendPool() *pool
+}
+
+// Option configures the behaviour shared by all load balancing algorithms.
+type Option func(*pool)
+
+// WithPanicThreshold sets the minimum fraction (between 0 and 1) of healthy
+// backends under which the load balancer stops filtering unhealthy backends
+// and routes to all of them instead.
+//
+// When most backends are reported unhealthy, it is often the health checks
+// that are wrong or the remaining backends would be overloaded anyway,
+// so spreading the load over every backend is the lesser evil.
+// A threshold of 0 disables this behaviour.
+func WithPanicThreshold(threshold float64) Option {
+	return func(p *pool) {
+		p.panicThreshold = threshold
+	}
+}
+
+// WithSlowStart makes a backend that recovers from being unhealthy, or that
+// is explicitly put in slow start, receive a share of the traffic that
+// increases linearly over the given window instead of its full share at once.
+//
+// This gives backends with cold caches or JIT compilers time to warm up.
+// A window of 0 disables slow start.
+func WithSlowStart(window time.Duration) Option {
+	return func(p *pool) {
+		p.slowStartWindow = window
+	}
+}
+
+// WithBackups adds backends that only receive traffic when none of the
+// primary backends is healthy.
+func WithBackups(backups []*url.URL) Option {
+	return func(p *pool) {
+		p.backups = backups
+	}
+}
+
+// WithPriorities assigns backends to priority levels, keyed by their URL.
+// Level 0 is the highest priority and backends that are not in the map
+// belong to it.
+//
+// Traffic goes to the highest priority level as long as enough of its
+// backends are healthy. When its health drops, the share of traffic it
+// cannot absorb spills over to the next levels, as with Envoy's priority levels.
+func WithPriorities(priorities map[string]int) Option {
+	return func(p *pool) {
+		p.priorities = priorities
+	}
+}
+
+// WithClock replaces the function used to get the current time.
+// It is meant for tests.
+func WithClock(now func() time.Time) Option {
+	return func(p *pool) {
+		p.now = now
+	}
+}
+
+// slowStartMinWeight is the weight of a backend at the beginning of its slow
+// start window, relative to a fully warmed up backend. It is not zero so that
+// the backend receives some traffic right away.
+const slowStartMinWeight = 0.1
+
+// overprovisioningFactor is applied to the fraction of healthy backends of a
+// priority level to compute the share of traffic it can absorb. With 1.4, a
+// level keeps all of its traffic as long as about 71% of its backends are healthy.
+const overprovisioningFactor = 1.4
+
+// endpoint is a backend along with its current weight.
+type endpoint struct {
+	url    *url.URL
+	weight float64
+}
+
+// pool holds the backends of a load balancer along with their runtime state.
+//
+// It is embedded by every load balancing algorithm so that backend filtering
+// and weighting behave the same regardless of how the final backend is chosen.
+type pool struct {
+	mu              sync.Mutex // protects backends, backups, unhealthy, ejected, drained and warmingSince
+	backends        []*url.URL
+	backups         []*url.URL
+	priorities      map[string]int       // backend -> priority level
+	unhealthy       map[string]bool      // backend -> unhealthy
+	ejected         map[string]bool      // backend -> ejected
+	drained         map[string]bool      // backend -> drained
+	warmingSince    map[string]time.Time // backend -> start of slow start window
+	panicThreshold  float64
+	slowStartWindow time.Duration
+	now             func() time.Time // defaults to time.Now
+}
+
+func newPool(backends []*url.URL, opts []Option) *pool {
+	p := &pool{
+		backends:     backends,
+		unhealthy:    make(map[string]bool),
+		ejected:      make(map[string]bool),
+		drained:      make(map[string]bool),
+		warmingSince: make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *pool) SetHealthy(backend *url.URL, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setExcluded(p.unhealthy, backend.String(), !healthy)
+}
+
+func (p *pool) SetEjected(backend *url.URL, ejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setExcluded(p.ejected, backend.String(), ejected)
+}
+
+func (p *pool) SetDrained(backend *url.URL, drained bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setExcluded(p.drained, backend.String(), drained)
+}
+
+// setExcluded records whether the backend is excluded for the reason tracked
+// by the given set, and puts the backend in slow start when it is back in
+// service. It must be called with p.mu held.
+func (p *pool) setExcluded(set map[string]bool, key string, excluded bool) {
+	if excluded {
+		set[key] = true
+		return
+	}
+	if set[key] {
+		delete(set, key)
+		if !p.unhealthy[key] && !p.ejected[key] && !p.drained[key] {
+			p.startSlowStart(key)
+		}
+	}
+}
+
+func (p *pool) AddBackend(backend *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := backend.String()
+	if slices.ContainsFunc(p.backends, sameURL(key)) || slices.ContainsFunc(p.backups, sameURL(key)) {
+		return
+	}
+	// the slice may be shared with the caller of the constructor
+	p.backends = append(slices.Clip(p.backends), backend)
+}
+
+func (p *pool) RemoveBackend(backend *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := backend.String()
+	p.backends = slices.DeleteFunc(slices.Clone(p.backends), sameURL(key))
+	p.backups = slices.DeleteFunc(slices.Clone(p.backups), sameURL(key))
+	delete(p.unhealthy, key)
+	delete(p.ejected, key)
+	delete(p.drained, key)
+	delete(p.warmingSince, key)
+}
+
+func sameURL(key string) func(*url.URL) bool {
+	return func(u *url.URL) bool { return u.String() == key }
+}
+
+func (p *pool) backendPool() *pool {
+	return p
+}
+
+// inherit takes over the state of the backends of prev that p shares, and puts
+// the others in slow start.
+func (p *pool) inherit(prev *pool) {
+	if prev == p {
+		return
+	}
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	known := make(map[string]bool)
+	for _, backend := range slices.Concat(prev.backends, prev.backups) {
+		known[backend.String()] = true
+	}
+	for _, backend := range slices.Concat(p.backends, p.backups) {
+		key := backend.String()
+		if !known[key] {
+			p.startSlowStart(key)
+			continue
+		}
+		// the state of prev is the latest one, e.g. p may have been the
+		// load balancer of an older config that is rolled back to
+		for _, set := range []struct{ from, to map[string]bool }{
+			{prev.unhealthy, p.unhealthy},
+			{prev.ejected, p.ejected},
+			{prev.drained, p.drained},
+		} {
+			if set.from[key] {
+				set.to[key] = true
+			} else {
+				delete(set.to, key)
+			}
+		}
+		if since, ok := prev.warmingSince[key]; ok && p.slowStartWindow > 0 {
+			p.warmingSince[key] = since
+		} else {
+			delete(p.warmingSince, key)
+		}
+	}
+}
+
+func (p *pool) SlowStart(backend *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startSlowStart(backend.String())
+}
+
+// startSlowStart must be called with p.mu held.
+func (p *pool) startSlowStart(key string) {
+	if p.slowStartWindow > 0 {
+		p.warmingSince[key] = p.currentTime()
+	}
+}
+
+// available returns the backends that can currently receive traffic along
+// with their weights.
+//
+// If the fraction of healthy backends is below the panic threshold, all
+// backends that are not drained are returned regardless of their health.
+// Backups are only returned when there is no healthy primary backend.
+func (p *pool) available() []endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.currentTime()
+	primaries := p.undrained(p.backends)
+	healthy := p.healthy(primaries)
+	switch {
+	case len(healthy) > 0 && float64(len(healthy)) >= p.panicThreshold*float64(len(primaries)):
+		return p.spread(primaries, healthy, now)
+	case len(healthy) > 0:
+		return p.endpoints(primaries, now)
+	}
+
+	if healthyBackups := p.healthy(p.undrained(p.backups)); len(healthyBackups) > 0 {
+		return p.endpoints(healthyBackups, now)
+	}
+	if p.panicThreshold > 0 {
+		return p.endpoints(primaries, now)
+	}
+	return nil
+}
+
+func (p *pool) FailedOver() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.healthy(p.undrained(p.backends))) == 0 && len(p.healthy(p.undrained(p.backups))) > 0
+}
+
+// undrained must be called with p.mu held.
+func (p *pool) undrained(backends []*url.URL) []*url.URL {
+	if len(p.drained) == 0 {
+		return backends
+	}
+	undrained := make([]*url.URL, 0, len(backends))
+	for _, backend := range backends {
+		if !p.drained[backend.String()] {
+			undrained = append(undrained, backend)
+		}
+	}
+	return undrained
+}
+
+// endpoints must be called with p.mu held.
+func (p *pool) endpoints(backends []*url.URL, now time.Time) []endpoint {
+	endpoints := make([]endpoint, len(backends))
+	for i, backend := range backends {
+		endpoints[i] = endpoint{url: backend, weight: p.weight(backend.String(), now)}
+	}
+	return endpoints
+}
+
+// spread distributes the traffic over the healthy backends according to the
+// health of their priority level. It must be called with p.mu held.
+func (p *pool) spread(primaries, healthy []*url.URL, now time.Time) []endpoint {
+	if len(p.priorities) == 0 {
+		return p.endpoints(healthy, now)
+	}
+
+	totalCount := make(map[int]int)
+	for _, backend := range primaries {
+		totalCount[p.priorities[backend.String()]]++
+	}
+	healthyCount := make(map[int]int)
+	for _, backend := range healthy {
+		healthyCount[p.priorities[backend.String()]]++
+	}
+	levels := make([]int, 0, len(totalCount))
+	for level := range totalCount {
+		levels = append(levels, level)
+	}
+	slices.Sort(levels)
+
+	// each level takes as much of the remaining traffic as its health allows
+	loads := make(map[int]float64)
+	remaining := 1.0
+	for _, level := range levels {
+		health := min(1, overprovisioningFactor*float64(healthyCount[level])/float64(totalCount[level]))
+		loads[level] = min(remaining, health)
+		remaining -= loads[level]
+	}
+
+	loadedLevels := 0
+	for _, level := range levels {
+		if loads[level] > 0 {
+			loadedLevels++
+		}
+	}
+
+	endpoints := make([]endpoint, 0, len(healthy))
+	for _, backend := range healthy {
+		level := p.priorities[backend.String()]
+		if loads[level] == 0 {
+			continue
+		}
+		weight := p.weight(backend.String(), now)
+		if loadedLevels > 1 {
+			// the weights only need to be relative to each other, so there is
+			// no need to normalize the loads when the levels are not healthy
+			// enough to take all the traffic.
+			weight *= loads[level] / float64(healthyCount[level])
+		}
+		endpoints = append(endpoints, endpoint{url: backend, weight: weight})
+	}
+	return endpoints
+}
+
+// healthy must be called with p.mu held.
+func (p *pool) healthy(backends []*url.URL) []*url.URL {
+	healthy := make([]*url.URL, 0, len(backends))
+	for _, backend := range backends {
+		if !p.unhealthy[backend.String()] && !p.ejected[backend.String()] {
+			healthy = append(healthy, backend)
+		}
+	}
+	return healthy
+}
+
+func (p *pool) currentTime() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+// weight must be called with p.mu held.
+func (p *pool) weight(key string, now time.Time) float64 {
+	since, ok := p.warmingSince[key]
+	if !ok {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= p.slowStartWindow {
+		delete(p.warmingSince, key)
+		return 1
+	}
+	return max(slowStartMinWeight, float64(elapsed)/float64(p.slowStartWindow))
+}
@@ -1,22 +1,112 @@
 package loadbalancer
 
 import (
+	"maps"
 	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/mouad-eh/wasseet/request"
 )
 
+// RoundRobin cycles through the available backends.
+//
+// It uses the smooth weighted round robin algorithm (as found in nginx) so that
+// backends in slow start get proportionally fewer requests while keeping the
+// plain round robin order when all weights are equal.
 type RoundRobin struct {
-	backends []*url.URL
-	current  int
+	*pool
+	mu             sync.Mutex         // protects currentWeights and lastBackends
+	currentWeights map[string]float64 // backend -> current weight
+	lastBackends   []endpoint
 }
 
-func NewRoundRobin(backends []*url.URL) *RoundRobin {
+func NewRoundRobin(backends []*url.URL, opts ...Option) *RoundRobin {
 	return &RoundRobin{
-		backends: backends,
+		pool:           newPool(backends, opts),
+		currentWeights: make(map[string]float64),
+	}
+}
+
+func (r *RoundRobin) Pick(req request.ServerRequest) (*url.URL, DoneFunc, error) {
+	backends := r.available()
+	if len(backends) == 0 {
+		return nil, nil, ErrNoBackendAvailable
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// start over when the set of available backends changes, otherwise
+	// weights accumulated by backends that left the set skew the distribution.
+	if !sameBackends(backends, r.lastBackends) {
+		clear(r.currentWeights)
+	}
+	r.lastBackends = backends
+
+	var best *url.URL
+	var bestWeight, total float64
+	for _, e := range backends {
+		key := e.url.String()
+		r.currentWeights[key] += e.weight
+		total += e.weight
+		if best == nil || r.currentWeights[key] > bestWeight {
+			best = e.url
+			bestWeight = r.currentWeights[key]
+		}
+	}
+	r.currentWeights[best.String()] -= total
+
+	return best, noopDone, nil
+}
+
+// InheritState takes over the state of the load balancer it replaces, see
+// StateInheritor. When it is a RoundRobin too, the rotation carries on where
+// it left off.
+func (r *RoundRobin) InheritState(prev LoadBalancer) {
+	pooled, ok := prev.(pooled)
+	if !ok {
+		return
+	}
+	r.pool.inherit(pooled.backendPool())
+
+	prevRR, ok := prev.(*RoundRobin)
+	if !ok || prevRR == r {
+		return
 	}
+	// the URLs of the backends are new instances, which Pick compares by address
+	backends := make(map[string]*url.URL)
+	r.pool.mu.Lock()
+	for _, backend := range slices.Concat(r.backends, r.backups) {
+		backends[backend.String()] = backend
+	}
+	r.pool.mu.Unlock()
+
+	prevRR.mu.Lock()
+	defer prevRR.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lastBackends := make([]endpoint, len(prevRR.lastBackends))
+	for i, e := range prevRR.lastBackends {
+		backend, ok := backends[e.url.String()]
+		if !ok {
+			// the set of available backends changed anyway
+			return
+		}
+		lastBackends[i] = endpoint{url: backend, weight: e.weight}
+	}
+	r.lastBackends = lastBackends
+	r.currentWeights = maps.Clone(prevRR.currentWeights)
 }
 
-func (r *RoundRobin) Next() *url.URL {
-	backend := r.backends[r.current]
-	r.current = (r.current + 1) % len(r.backends)
-	return backend
+func sameBackends(a, b []endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].url != b[i].url {
+			return false
+		}
+	}
+	return true
 }
@@ -1,10 +1,15 @@
 package loadbalancer_test
 
 import (
+	"errors"
+	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mouad-eh/wasseet/loadbalancer"
+	"github.com/mouad-eh/wasseet/request"
 )
 
 func TestRoundRobin(t *testing.T) {
@@ -15,9 +20,502 @@ func TestRoundRobin(t *testing.T) {
 	}
 	rr := loadbalancer.NewRoundRobin(backends)
 	for i := 0; i < len(backends)*2; i++ {
-		backend := rr.Next()
+		backend, done, err := rr.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		done()
 		if backend != backends[i%len(backends)] {
 			t.Errorf("Expected %s, got %s", backends[i%len(backends)], backend)
 		}
 	}
 }
+
+func TestRoundRobinNoBackends(t *testing.T) {
+	rr := loadbalancer.NewRoundRobin(nil)
+	_, _, err := rr.Pick(newRequest())
+	if !errors.Is(err, loadbalancer.ErrNoBackendAvailable) {
+		t.Errorf("Expected %v, got %v", loadbalancer.ErrNoBackendAvailable, err)
+	}
+}
+
+func TestRoundRobinSkipsUnhealthyBackends(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+		{Scheme: "http", Host: "backend3"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends)
+	rr.SetHealthy(backends[1], false)
+
+	for i := 0; i < 4; i++ {
+		backend, _, err := rr.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if backend == backends[1] {
+			t.Errorf("Unhealthy backend %s was picked", backend)
+		}
+	}
+
+	// once healthy again, the backend gets its share of the traffic
+	rr.SetHealthy(backends[1], true)
+	picked := false
+	for i := 0; i < len(backends); i++ {
+		backend, _, _ := rr.Pick(newRequest())
+		picked = picked || backend == backends[1]
+	}
+	if !picked {
+		t.Errorf("Expected %s to be picked after recovering", backends[1])
+	}
+}
+
+func TestRoundRobinAllBackendsUnhealthy(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends)
+	for _, backend := range backends {
+		rr.SetHealthy(backend, false)
+	}
+
+	_, _, err := rr.Pick(newRequest())
+	if !errors.Is(err, loadbalancer.ErrNoBackendAvailable) {
+		t.Errorf("Expected %v, got %v", loadbalancer.ErrNoBackendAvailable, err)
+	}
+}
+
+func TestRoundRobinPanicThreshold(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+		{Scheme: "http", Host: "backend3"},
+		{Scheme: "http", Host: "backend4"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends, loadbalancer.WithPanicThreshold(0.5))
+
+	// 2 out of 4 healthy backends is not below the threshold
+	rr.SetHealthy(backends[0], false)
+	rr.SetHealthy(backends[1], false)
+	for i := 0; i < len(backends); i++ {
+		backend, _, _ := rr.Pick(newRequest())
+		if backend == backends[0] || backend == backends[1] {
+			t.Errorf("Unhealthy backend %s was picked", backend)
+		}
+	}
+
+	// 1 out of 4 is, so every backend is used
+	rr.SetHealthy(backends[2], false)
+	counts := make(map[*url.URL]int)
+	for i := 0; i < len(backends); i++ {
+		backend, _, err := rr.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		counts[backend]++
+	}
+	for _, backend := range backends {
+		if counts[backend] != 1 {
+			t.Errorf("Expected 1 pick for %s in panic mode, got %d", backend, counts[backend])
+		}
+	}
+}
+
+func TestRoundRobinDrainedBackends(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends, loadbalancer.WithPanicThreshold(1))
+	rr.SetDrained(backends[1], true)
+
+	// the drained backend gets no traffic, not even in panic mode
+	rr.SetHealthy(backends[0], false)
+	for i := 0; i < 4; i++ {
+		backend, _, err := rr.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if backend == backends[1] {
+			t.Errorf("Drained backend %s was picked", backend)
+		}
+	}
+
+	rr.SetDrained(backends[1], false)
+	rr.SetHealthy(backends[0], true)
+	picked := false
+	for i := 0; i < len(backends); i++ {
+		backend, _, _ := rr.Pick(newRequest())
+		picked = picked || backend == backends[1]
+	}
+	if !picked {
+		t.Errorf("Expected %s to be picked once enabled", backends[1])
+	}
+}
+
+func TestRoundRobinMembership(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	added := &url.URL{Scheme: "http", Host: "backend3"}
+	rr := loadbalancer.NewRoundRobin(backends[:1], loadbalancer.WithBackups(backends[1:]))
+
+	rr.AddBackend(added)
+	rr.AddBackend(added)
+	picks := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		backend, _, err := rr.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		picks[backend.Host]++
+	}
+	if picks["backend1"] != 2 || picks["backend3"] != 2 {
+		t.Errorf("Expected the added backend to share the traffic, got %v", picks)
+	}
+	if len(backends) != 2 || backends[1].Host != "backend2" {
+		t.Errorf("Backends passed to the constructor were modified: %v", backends)
+	}
+
+	// the backup takes over once the primaries are removed
+	rr.RemoveBackend(backends[0])
+	rr.RemoveBackend(&url.URL{Scheme: "http", Host: "backend3"})
+	backend, _, err := rr.Pick(newRequest())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if backend != backends[1] {
+		t.Errorf("Expected %s, got %s", backends[1], backend)
+	}
+
+	rr.RemoveBackend(backends[1])
+	if _, _, err := rr.Pick(newRequest()); err != loadbalancer.ErrNoBackendAvailable {
+		t.Errorf("Expected ErrNoBackendAvailable, got %v", err)
+	}
+}
+
+func TestRoundRobinSlowStart(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	now := time.Now()
+	rr := loadbalancer.NewRoundRobin(backends,
+		loadbalancer.WithSlowStart(time.Minute),
+		loadbalancer.WithClock(func() time.Time { return now }),
+	)
+
+	// backend2 recovers and enters its slow start window
+	rr.SetHealthy(backends[1], false)
+	rr.SetHealthy(backends[1], true)
+
+	countPicks := func(n int) map[*url.URL]int {
+		counts := make(map[*url.URL]int)
+		for i := 0; i < n; i++ {
+			backend, _, err := rr.Pick(newRequest())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			counts[backend]++
+		}
+		return counts
+	}
+
+	// at the start of the window, the backend gets the minimum weight (0.1)
+	counts := countPicks(110)
+	if counts[backends[1]] != 10 {
+		t.Errorf("Expected 10 picks for %s, got %d", backends[1], counts[backends[1]])
+	}
+
+	// half way through the window, it gets half the weight
+	now = now.Add(30 * time.Second)
+	counts = countPicks(150)
+	if counts[backends[1]] != 50 {
+		t.Errorf("Expected 50 picks for %s, got %d", backends[1], counts[backends[1]])
+	}
+
+	// after the window, the traffic is evenly distributed again
+	now = now.Add(30 * time.Second)
+	counts = countPicks(100)
+	if counts[backends[1]] != 50 {
+		t.Errorf("Expected 50 picks for %s, got %d", backends[1], counts[backends[1]])
+	}
+}
+
+func TestRoundRobinExplicitSlowStart(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	now := time.Now()
+	rr := loadbalancer.NewRoundRobin(backends,
+		loadbalancer.WithSlowStart(time.Minute),
+		loadbalancer.WithClock(func() time.Time { return now }),
+	)
+
+	var lb loadbalancer.LoadBalancer = rr
+	slowStarter, ok := lb.(loadbalancer.SlowStarter)
+	if !ok {
+		t.Fatal("Expected RoundRobin to implement SlowStarter")
+	}
+	slowStarter.SlowStart(backends[0])
+
+	counts := make(map[*url.URL]int)
+	for i := 0; i < 110; i++ {
+		backend, _, _ := rr.Pick(newRequest())
+		counts[backend]++
+	}
+	if counts[backends[0]] != 10 {
+		t.Errorf("Expected 10 picks for %s, got %d", backends[0], counts[backends[0]])
+	}
+}
+
+func TestRoundRobinInheritState(t *testing.T) {
+	hosts := []string{"backend1", "backend2", "backend3"}
+	newBackends := func(hosts ...string) []*url.URL {
+		backends := make([]*url.URL, len(hosts))
+		for i, host := range hosts {
+			backends[i] = &url.URL{Scheme: "http", Host: host}
+		}
+		return backends
+	}
+	now := time.Now()
+	clock := loadbalancer.WithClock(func() time.Time { return now })
+	prev := loadbalancer.NewRoundRobin(newBackends(hosts...), loadbalancer.WithSlowStart(time.Minute), clock)
+	prev.SetHealthy(&url.URL{Scheme: "http", Host: "backend3"}, false)
+	if backend, _, _ := prev.Pick(newRequest()); backend.Host != "backend1" {
+		t.Fatalf("Expected backend1, got %s", backend)
+	}
+
+	// the backends of the new load balancer are new instances with the same URLs
+	var lb loadbalancer.LoadBalancer = loadbalancer.NewRoundRobin(newBackends(hosts...), loadbalancer.WithSlowStart(time.Minute), clock)
+	inheritor, ok := lb.(loadbalancer.StateInheritor)
+	if !ok {
+		t.Fatal("Expected RoundRobin to implement StateInheritor")
+	}
+	inheritor.InheritState(prev)
+	if backend, _, _ := lb.Pick(newRequest()); backend.Host != "backend2" {
+		t.Errorf("Expected the rotation to carry on with backend2, got %s", backend)
+	}
+
+	// backend3 is still unhealthy and the new backend4 is in slow start with
+	// the minimum weight (0.1)
+	next := loadbalancer.NewRoundRobin(newBackends(append(hosts, "backend4")...), loadbalancer.WithSlowStart(time.Minute), clock)
+	next.InheritState(lb)
+	counts := make(map[string]int)
+	for i := 0; i < 210; i++ {
+		backend, _, err := next.Pick(newRequest())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		counts[backend.Host]++
+	}
+	expected := map[string]int{"backend1": 100, "backend2": 100, "backend3": 0, "backend4": 10}
+	for host, count := range expected {
+		if counts[host] != count {
+			t.Errorf("Expected %d picks for %s, got %d", count, host, counts[host])
+		}
+	}
+
+	// the state is taken over as a whole: backend3 recovers in next, and lb,
+	// e.g. of an older config that is rolled back to, takes that over too,
+	// along with the slow start of backend3
+	next.SetHealthy(&url.URL{Scheme: "http", Host: "backend3"}, true)
+	lb.(*loadbalancer.RoundRobin).InheritState(next)
+	picked := false
+	for i := 0; i < 30; i++ {
+		if backend, _, _ := lb.Pick(newRequest()); backend.Host == "backend3" {
+			picked = true
+		}
+	}
+	if !picked {
+		t.Error("Expected the recovered backend3 to be picked")
+	}
+}
+
+func TestRoundRobinBackups(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+	}
+	backups := []*url.URL{
+		{Scheme: "http", Host: "backup1"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends, loadbalancer.WithBackups(backups))
+
+	pickAll := func() map[*url.URL]int {
+		counts := make(map[*url.URL]int)
+		for i := 0; i < 4; i++ {
+			backend, _, err := rr.Pick(newRequest())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			counts[backend]++
+		}
+		return counts
+	}
+
+	// backups are ignored while a primary backend is healthy
+	rr.SetHealthy(backends[0], false)
+	if counts := pickAll(); counts[backends[1]] != 4 {
+		t.Errorf("Expected all picks for %s, got %v", backends[1], counts)
+	}
+
+	// failover
+	rr.SetHealthy(backends[1], false)
+	if counts := pickAll(); counts[backups[0]] != 4 {
+		t.Errorf("Expected all picks for %s, got %v", backups[0], counts)
+	}
+
+	// failback
+	rr.SetHealthy(backends[0], true)
+	if counts := pickAll(); counts[backends[0]] != 4 {
+		t.Errorf("Expected all picks for %s, got %v", backends[0], counts)
+	}
+
+	// nothing to route to
+	rr.SetHealthy(backends[0], false)
+	rr.SetHealthy(backups[0], false)
+	if _, _, err := rr.Pick(newRequest()); !errors.Is(err, loadbalancer.ErrNoBackendAvailable) {
+		t.Errorf("Expected %v, got %v", loadbalancer.ErrNoBackendAvailable, err)
+	}
+}
+
+func TestRoundRobinFailedOver(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+		{Scheme: "http", Host: "backend3"},
+	}
+	backups := []*url.URL{
+		{Scheme: "http", Host: "backup1"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends, loadbalancer.WithBackups(backups))
+	if rr.FailedOver() {
+		t.Errorf("Expected no failover while the primary backends are available")
+	}
+
+	// primary backends are unavailable whether unhealthy, ejected or drained
+	rr.SetHealthy(backends[0], false)
+	rr.SetEjected(backends[1], true)
+	if rr.FailedOver() {
+		t.Errorf("Expected no failover while %s is available", backends[2])
+	}
+	rr.SetDrained(backends[2], true)
+	if !rr.FailedOver() {
+		t.Errorf("Expected failover once no primary backend is available")
+	}
+
+	// no failover when the backups are unavailable too
+	rr.SetHealthy(backups[0], false)
+	if rr.FailedOver() {
+		t.Errorf("Expected no failover to unhealthy backups")
+	}
+	rr.SetHealthy(backups[0], true)
+
+	rr.SetEjected(backends[1], false)
+	if rr.FailedOver() {
+		t.Errorf("Expected failback once %s is no longer ejected", backends[1])
+	}
+}
+
+func TestRoundRobinPriorities(t *testing.T) {
+	local := []*url.URL{
+		{Scheme: "http", Host: "local1"},
+		{Scheme: "http", Host: "local2"},
+		{Scheme: "http", Host: "local3"},
+		{Scheme: "http", Host: "local4"},
+	}
+	remote := []*url.URL{
+		{Scheme: "http", Host: "remote1"},
+		{Scheme: "http", Host: "remote2"},
+	}
+	priorities := map[string]int{
+		remote[0].String(): 1,
+		remote[1].String(): 1,
+	}
+	rr := loadbalancer.NewRoundRobin(append(local, remote...), loadbalancer.WithPriorities(priorities))
+
+	countRemote := func(n int) int {
+		remoteCount := 0
+		for i := 0; i < n; i++ {
+			backend, _, err := rr.Pick(newRequest())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if backend == remote[0] || backend == remote[1] {
+				remoteCount++
+			}
+		}
+		return remoteCount
+	}
+
+	// 3 out of 4 healthy local backends are enough to absorb all the traffic
+	rr.SetHealthy(local[0], false)
+	if remoteCount := countRemote(100); remoteCount != 0 {
+		t.Errorf("Expected no traffic to the remote backends, got %d", remoteCount)
+	}
+
+	// with 2 out of 4, the local level can absorb 2/4*1.4 = 70% of the traffic
+	rr.SetHealthy(local[1], false)
+	if remoteCount := countRemote(100); remoteCount < 29 || remoteCount > 31 {
+		t.Errorf("Expected about 30 requests to the remote backends, got %d", remoteCount)
+	}
+
+	// without any healthy local backend, everything goes to the remote ones
+	rr.SetHealthy(local[2], false)
+	rr.SetHealthy(local[3], false)
+	if remoteCount := countRemote(100); remoteCount != 100 {
+		t.Errorf("Expected all the traffic to go to the remote backends, got %d", remoteCount)
+	}
+}
+
+// TestRoundRobinConcurrentPick is meant to be run with -race.
+func TestRoundRobinConcurrentPick(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1"},
+		{Scheme: "http", Host: "backend2"},
+		{Scheme: "http", Host: "backend3"},
+	}
+	rr := loadbalancer.NewRoundRobin(backends)
+
+	numWorkers := 8
+	picksPerWorker := 300
+	var mu sync.Mutex
+	counts := make(map[*url.URL]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < picksPerWorker; j++ {
+				backend, done, err := rr.Pick(newRequest())
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				done()
+				mu.Lock()
+				counts[backend]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every pick advances the position by exactly one, so the
+	// distribution is perfectly even no matter how calls interleave.
+	for _, backend := range backends {
+		expected := numWorkers * picksPerWorker / len(backends)
+		if counts[backend] != expected {
+			t.Errorf("Expected %d picks for %s, got %d", expected, backend, counts[backend])
+		}
+	}
+}
+
+func newRequest() request.ServerRequest {
+	return request.ServerRequest{Request: httptest.NewRequest("GET", "http://proxy.io/", nil)}
+}
@@ -4,10 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 
 	"github.com/mouad-eh/wasseet/api/config"
-	"github.com/mouad-eh/wasseet/loadbalancer"
 	"github.com/mouad-eh/wasseet/proxy"
 )
 
@@ -18,19 +16,13 @@ func main() {
 	go RunBackend(backend1Port, "backend 1")
 	go RunBackend(backend2Port, "backend 2")
 
-	backendUrls := []*url.URL{
-		{Scheme: "http", Host: fmt.Sprintf("localhost:%d", backend1Port)},
-		{Scheme: "http", Host: fmt.Sprintf("localhost:%d", backend2Port)},
-	}
-
-	proxyConfig := &config.Config{
-		Port: 8080,
-		BackendGroups: []*config.BackendGroup{
-			{
-				Lb:      loadbalancer.NewRoundRobin(backendUrls),
-				Servers: backendUrls,
-			},
-		},
+	proxyConfig, err := config.New().
+		Port(8080).
+		Group("backends", fmt.Sprintf("localhost:%d", backend1Port), fmt.Sprintf("localhost:%d", backend2Port)).RoundRobin().
+		Rule().Path("/").To("backends").
+		Build()
+	if err != nil {
+		log.Fatalf("Invalid proxy config: %v", err)
 	}
 
 	p := proxy.NewProxy(proxyConfig, &proxy.HttpClient{Client: &http.Client{}})
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// AdminServer serves the admin API of a proxy on its own listener, so that it
+// can be restricted to an internal network or a unix socket.
+//
+// Every request must carry the token of the admin config as a bearer token.
+type AdminServer struct {
+	proxy    *Proxy
+	params   *config.Admin
+	logger   *zap.SugaredLogger
+	server   *http.Server
+	mu       sync.RWMutex // protects listener
+	listener net.Listener
+}
+
+func NewAdminServer(p *Proxy, params *config.Admin, logger *zap.SugaredLogger) *AdminServer {
+	a := &AdminServer{proxy: p, params: params, logger: logger}
+	a.server = &http.Server{Handler: a.Handler()}
+	return a
+}
+
+// Start starts listening and serving the admin API in the background.
+func (a *AdminServer) Start() error {
+	if a.params.Network == "unix" {
+		// remove the socket left behind by a previous run, if any
+		if info, err := os.Stat(a.params.Address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			os.Remove(a.params.Address)
+		}
+	}
+	listener, err := net.Listen(a.params.Network, a.params.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	a.mu.Lock()
+	a.listener = listener
+	a.mu.Unlock()
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Errorw("Admin API stopped", "err", err)
+		}
+	}()
+	a.logger.Infow("Admin API listening", "network", a.params.Network, "address", listener.Addr().String())
+	return nil
+}
+
+func (a *AdminServer) GetAddr() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.listener != nil {
+		return a.listener.Addr().String()
+	}
+	return ""
+}
+
+func (a *AdminServer) Stop() error {
+	return a.server.Shutdown(context.Background())
+}
+
+// Handler returns the handler of the admin API.
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", a.getConfig)
+	mux.HandleFunc("GET /backend_groups", a.getBackendGroups)
+	mux.HandleFunc("POST /reload", a.reload)
+	mux.HandleFunc("GET /config/versions", a.getConfigVersions)
+	mux.HandleFunc("POST /config/rollback", a.rollback)
+	mux.HandleFunc("POST /backend_groups/{group}/servers", a.addServer)
+	mux.HandleFunc("DELETE /backend_groups/{group}/servers/{server}", a.removeServer)
+	mux.HandleFunc("POST /backend_groups/{group}/servers/{server}/drain", a.setDrained(true))
+	mux.HandleFunc("POST /backend_groups/{group}/servers/{server}/enable", a.setDrained(false))
+	return a.authenticate(mux)
+}
+
+func (a *AdminServer) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.params.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type configResponse struct {
+	Version int         `json:"version" yaml:"version"`
+	Config  config.Dump `json:"config" yaml:"config"`
+}
+
+// getConfig dumps the active config as JSON, or as YAML with ?format=yaml.
+func (a *AdminServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, version := a.proxy.configManager.GetLatestConfigWithVersion()
+	resp := configResponse{Version: version, Config: cfg.Dump()}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "yaml") {
+		format = "yaml"
+	}
+	switch format {
+	case "", "json":
+		writeAdminJSON(w, http.StatusOK, resp)
+	case "yaml":
+		body, err := yaml.Marshal(resp)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(body)
+	default:
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, must be json or yaml", format))
+	}
+}
+
+type backendGroupsResponse struct {
+	Version       int                  `json:"version"`
+	BackendGroups []backendGroupStatus `json:"backend_groups"`
+}
+
+type backendGroupStatus struct {
+	Name    string         `json:"name"`
+	Servers []serverStatus `json:"servers"`
+}
+
+type serverStatus struct {
+	Address  string `json:"address"`
+	Backup   bool   `json:"backup,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Ejected  bool   `json:"ejected"`
+	Drained  bool   `json:"drained"`
+	InFlight int    `json:"in_flight"`
+	// Dynamic is true for the servers added through the admin API.
+	Dynamic bool `json:"dynamic,omitempty"`
+}
+
+// getBackendGroups lists the servers of every backend group along with their state.
+func (a *AdminServer) getBackendGroups(w http.ResponseWriter, r *http.Request) {
+	cfg, version := a.proxy.configManager.GetLatestConfigWithVersion()
+	resp := backendGroupsResponse{Version: version, BackendGroups: make([]backendGroupStatus, len(cfg.BackendGroups))}
+	for i, bg := range cfg.BackendGroups {
+		resp.BackendGroups[i].Name = bg.Name
+		for j, server := range bg.AllServers() {
+			backend := server.String()
+			resp.BackendGroups[i].Servers = append(resp.BackendGroups[i].Servers, serverStatus{
+				Address:  backend,
+				Backup:   j >= len(bg.Servers),
+				Healthy:  a.proxy.healthChecker.IsHealthy(bg.Name, backend),
+				Ejected:  a.proxy.outlierDetector.IsEjected(bg.Name, backend),
+				Drained:  a.proxy.isDrained(bg.Name, backend),
+				InFlight: a.proxy.inFlight.get(bg.Name, backend),
+				Dynamic:  a.proxy.membership.isAdded(bg.Name, backend),
+			})
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+type dryRunResponse struct {
+	Version int             `json:"version"`
+	Diff    []config.Change `json:"diff"`
+}
+
+// reload reloads the config from its source, like SIGHUP. With
+// ?dry_run=true, it only returns the changes the reload would bring.
+func (a *AdminServer) reload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dry_run") == "true" {
+		_, version := a.proxy.configManager.GetLatestConfigWithVersion()
+		diff, err := a.proxy.configManager.DryRun()
+		if err != nil {
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, dryRunResponse{Version: version, Diff: diff})
+		return
+	}
+	if err := a.proxy.configManager.Reload(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, version := a.proxy.configManager.GetLatestConfigWithVersion()
+	writeAdminJSON(w, http.StatusOK, map[string]int{"version": version})
+}
+
+type configVersionResponse struct {
+	Version  int       `json:"version"`
+	Cause    string    `json:"cause"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Revision string    `json:"revision,omitempty"`
+	Hash     string    `json:"hash"`
+}
+
+// getConfigVersions lists the versions of the config that can be rolled back
+// to, the latest one last.
+func (a *AdminServer) getConfigVersions(w http.ResponseWriter, r *http.Request) {
+	history := a.proxy.configManager.History()
+	resp := make([]configVersionResponse, len(history))
+	for i, v := range history {
+		resp[i] = configVersionResponse{
+			Version:  v.Version,
+			Cause:    v.Cause,
+			LoadedAt: v.LoadedAt,
+			Revision: v.Revision,
+			Hash:     v.Hash,
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+type rollbackRequest struct {
+	Version *int `json:"version"`
+}
+
+// rollback rolls back to the given version of the config or, without a body,
+// to the previous one, like SIGUSR1.
+func (a *AdminServer) rollback(w http.ResponseWriter, r *http.Request) {
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	var version int
+	var err error
+	if req.Version != nil {
+		version, err = a.proxy.configManager.Rollback(*req.Version)
+	} else {
+		version, err = a.proxy.configManager.RollbackToPrevious()
+	}
+	if err != nil {
+		writeAdminError(w, errorStatus(err), err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]int{"version": version})
+}
+
+// setDrained drains or enables a server, which is identified by its
+// host or by its URL.
+func (a *AdminServer) setDrained(drained bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := a.proxy.SetDrained(r.PathValue("group"), r.PathValue("server"), drained); err != nil {
+			writeAdminError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type addServerRequest struct {
+	Address string `json:"address"`
+}
+
+// addServer adds a server to a backend group, see Proxy.AddServer.
+func (a *AdminServer) addServer(w http.ResponseWriter, r *http.Request) {
+	var req addServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	server, err := a.proxy.AddServer(r.PathValue("group"), req.Address)
+	if err != nil {
+		writeAdminError(w, errorStatus(err), err)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, map[string]string{"address": server.String()})
+}
+
+// removeServer removes a server from a backend group, see Proxy.RemoveServer.
+func (a *AdminServer) removeServer(w http.ResponseWriter, r *http.Request) {
+	if err := a.proxy.RemoveServer(r.PathValue("group"), r.PathValue("server")); err != nil {
+		writeAdminError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidAddress):
+		return http.StatusBadRequest
+	case errors.Is(err, errAlreadyExists), errors.Is(err, errLastServer):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,402 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"github.com/mouad-eh/wasseet/proxy"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	_, adminURL := startAdmin(t)
+
+	for _, token := range []string{"", "wrong"} {
+		req, err := http.NewRequest("GET", adminURL+"/config", nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	_, adminURL := startAdmin(t)
+
+	resp := adminRequest(t, "GET", adminURL+"/config")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var body struct {
+		Version int         `json:"version"`
+		Config  config.Dump `json:"config"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, 0, body.Version)
+	require.Equal(t, "round_robin", body.Config.BackendGroups[0].LoadBalancing)
+	require.Equal(t, []string{"http://backend1.io", "http://backend2.io"}, body.Config.BackendGroups[0].Servers)
+	require.Equal(t, "127.0.0.1:0", body.Config.Admin.Address)
+
+	resp = adminRequest(t, "GET", adminURL+"/config?format=yaml")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "secret")
+	require.NoError(t, yaml.Unmarshal(raw, &body))
+	require.Equal(t, "group", body.Config.BackendGroups[0].Name)
+
+	resp = adminRequest(t, "GET", adminURL+"/config?format=xml")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAdminReload(t *testing.T) {
+	_, adminURL := startAdmin(t)
+
+	resp := adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, 1, body["version"])
+
+	resp = adminRequest(t, "GET", adminURL+"/config")
+	var dump struct {
+		Version int `json:"version"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dump))
+	require.Equal(t, 1, dump.Version)
+}
+
+func TestAdminReloadDryRun(t *testing.T) {
+	src := &switchingSource{cfg: newGroupConfig("backend1.io")}
+	p, adminURL := startAdminWithSource(t, src)
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+
+	resp := adminRequest(t, "POST", adminURL+"/reload?dry_run=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Version int             `json:"version"`
+		Diff    []config.Change `json:"diff"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, 0, body.Version)
+	require.Equal(t, []config.Change{
+		{Type: config.Added, Path: "backend_groups[group].servers", New: "http://backend2.io"},
+	}, body.Diff)
+
+	// nothing was applied
+	require.Equal(t, []string{"backend1.io"}, servedBy(p, 2))
+}
+
+func TestAdminRollback(t *testing.T) {
+	src := &switchingSource{cfg: newGroupConfig("backend1.io")}
+	p, adminURL := startAdminWithSource(t, src)
+	src.set(newGroupConfig("backend2.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend2.io"}, servedBy(p, 2))
+
+	resp := adminRequest(t, "GET", adminURL+"/config/versions")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var versions []struct {
+		Version int    `json:"version"`
+		Cause   string `json:"cause"`
+		Hash    string `json:"hash"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+	require.Len(t, versions, 2)
+	require.Equal(t, "initial", versions[0].Cause)
+	require.Equal(t, "reload", versions[1].Cause)
+
+	resp = adminRequest(t, "POST", adminURL+"/config/rollback")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, 2, body["version"])
+	require.Equal(t, []string{"backend1.io"}, servedBy(p, 2))
+
+	resp = adminRequestWithBody(t, "POST", adminURL+"/config/rollback", `{"version": 1}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{"backend2.io"}, servedBy(p, 2))
+
+	resp = adminRequestWithBody(t, "POST", adminURL+"/config/rollback", `{"version": 42}`)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminDrain(t *testing.T) {
+	p, adminURL := startAdmin(t)
+
+	resp := adminRequest(t, "POST", adminURL+"/backend_groups/group/servers/backend1.io/drain")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// the drained server stops receiving requests, even after a reload
+	requireServed(t, p, "backend2.io")
+	adminRequest(t, "POST", adminURL+"/reload")
+	requireServed(t, p, "backend2.io")
+
+	servers := backendGroupsStatus(t, adminURL).BackendGroups[0].Servers
+	require.Equal(t, "http://backend1.io", servers[0].Address)
+	require.True(t, servers[0].Healthy)
+	require.True(t, servers[0].Drained)
+	require.False(t, servers[1].Drained)
+
+	resp = adminRequest(t, "POST", adminURL+"/backend_groups/group/servers/http:%2F%2Fbackend1.io/enable")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.False(t, onlyServedBy(p, "backend2.io"))
+
+	resp = adminRequest(t, "POST", adminURL+"/backend_groups/group/servers/unknown.io/drain")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = adminRequest(t, "POST", adminURL+"/backend_groups/unknown/servers/backend1.io/drain")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminAddServer(t *testing.T) {
+	p, adminURL := startAdmin(t)
+
+	resp := adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend3.io:8080"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var added map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&added))
+	require.Equal(t, "http://backend3.io:8080", added["address"])
+
+	// the new server gets traffic right away, and after a reload
+	require.Contains(t, servedBy(p, 3), "backend3.io:8080")
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend1.io", "backend2.io", "backend3.io:8080"}, servedBy(p, 3))
+
+	status := backendGroupsStatus(t, adminURL)
+	require.Len(t, status.BackendGroups[0].Servers, 3)
+	require.True(t, status.BackendGroups[0].Servers[2].Dynamic)
+	require.False(t, status.BackendGroups[0].Servers[0].Dynamic)
+
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "http://backend3.io:8080"}`)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend4.io:99999"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend4.io/path"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	// servers follow the rules of the servers of config files
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend_4.io"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/unknown/servers", `{"address": "backend4.io"}`)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminRemoveServer(t *testing.T) {
+	p, adminURL := startAdmin(t)
+
+	resp := adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend1.io")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, []string{"backend2.io"}, servedBy(p, 2))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend2.io"}, servedBy(p, 2))
+
+	resp = adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend2.io")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend1.io")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// adding the server back undoes the removal
+	resp = adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend1.io"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend1.io", "backend2.io"}, servedBy(p, 2))
+	require.False(t, backendGroupsStatus(t, adminURL).BackendGroups[0].Servers[0].Dynamic)
+}
+
+func TestRuntimeChangesPrecedence(t *testing.T) {
+	src := &switchingSource{}
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	p, adminURL := startAdminWithSource(t, src)
+
+	adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend3.io"}`)
+	adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend1.io")
+
+	// runtime changes are applied on top of the reloaded config
+	src.set(newGroupConfig("backend1.io", "backend2.io", "backend4.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend2.io", "backend3.io", "backend4.io"}, servedBy(p, 3))
+
+	// until the config agrees with them, then the config takes over
+	src.set(newGroupConfig("backend2.io", "backend3.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend2.io", "backend3.io"}, servedBy(p, 2))
+	require.False(t, backendGroupsStatus(t, adminURL).BackendGroups[0].Servers[1].Dynamic)
+
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend1.io", "backend2.io"}, servedBy(p, 2))
+}
+
+func TestRuntimeChangesKeepLastServer(t *testing.T) {
+	src := &switchingSource{}
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	p, adminURL := startAdminWithSource(t, src)
+	adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend1.io")
+
+	// the removal would leave the group without servers, so it is forgotten
+	src.set(newGroupConfig("backend1.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend1.io"}, servedBy(p, 2))
+
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	adminRequest(t, "POST", adminURL+"/reload")
+	require.Equal(t, []string{"backend1.io", "backend2.io"}, servedBy(p, 2))
+}
+
+func TestRuntimeChangesStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	newConfig := func() *config.Config {
+		cfg := newGroupConfig("backend1.io", "backend2.io")
+		cfg.Admin.StateFile = stateFile
+		return cfg
+	}
+
+	_, adminURL := startAdminWithSource(t, newConfig())
+	adminRequestWithBody(t, "POST", adminURL+"/backend_groups/group/servers", `{"address": "backend3.io"}`)
+	adminRequest(t, "DELETE", adminURL+"/backend_groups/group/servers/backend1.io")
+
+	state, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"backend_groups": {"group": {"added": ["http://backend3.io"], "removed": ["http://backend1.io"]}}}`, string(state))
+
+	// the changes survive a restart
+	p, _ := startAdminWithSource(t, newConfig())
+	require.Equal(t, []string{"backend2.io", "backend3.io"}, servedBy(p, 2))
+}
+
+// startAdmin serves the admin API of a proxy balancing between two backends.
+func startAdmin(t *testing.T) (*proxy.Proxy, string) {
+	t.Helper()
+	return startAdminWithSource(t, newGroupConfig("backend1.io", "backend2.io"))
+}
+
+func startAdminWithSource(t *testing.T, src config.Source) (*proxy.Proxy, string) {
+	t.Helper()
+	beClient := NewBackendClientMock(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+	p := proxy.NewProxy(src, beClient)
+	admin := &config.Admin{Network: "tcp", Address: "127.0.0.1:0", Token: "secret"}
+	server := httptest.NewServer(proxy.NewAdminServer(p, admin, zap.NewNop().Sugar()).Handler())
+	t.Cleanup(server.Close)
+	return p, server.URL
+}
+
+// newGroupConfig returns a config with the admin API enabled and a single
+// backend group named group.
+func newGroupConfig(hosts ...string) *config.Config {
+	backends := make([]*url.URL, len(hosts))
+	for i, host := range hosts {
+		backends[i] = &url.URL{Scheme: "http", Host: host}
+	}
+	backendGroup := &config.BackendGroup{
+		Name:    "group",
+		Lb:      loadbalancer.NewRoundRobin(backends),
+		Servers: backends,
+	}
+	return &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules:         []*config.Rule{{Path: "/", BackendGroup: backendGroup}},
+		Admin:         &config.Admin{Network: "tcp", Address: "127.0.0.1:0", Token: "secret"},
+	}
+}
+
+// switchingSource loads the config it was last set to.
+type switchingSource struct {
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+func (s *switchingSource) set(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+func (s *switchingSource) Load() (config.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.cfg, nil
+}
+
+type backendGroupsResponse struct {
+	BackendGroups []struct {
+		Name    string `json:"name"`
+		Servers []struct {
+			Address string `json:"address"`
+			Healthy bool   `json:"healthy"`
+			Drained bool   `json:"drained"`
+			Dynamic bool   `json:"dynamic"`
+		} `json:"servers"`
+	} `json:"backend_groups"`
+}
+
+func backendGroupsStatus(t *testing.T, adminURL string) backendGroupsResponse {
+	t.Helper()
+	var body backendGroupsResponse
+	resp := adminRequest(t, "GET", adminURL+"/backend_groups")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body
+}
+
+// servedBy returns the sorted hosts serving the requests sent to the proxy.
+func servedBy(p *proxy.Proxy, requests int) []string {
+	hosts := make(map[string]bool)
+	for i := 0; i < requests; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.io/", nil))
+		hosts[w.Body.String()] = true
+	}
+	return slices.Sorted(maps.Keys(hosts))
+}
+
+func adminRequest(t *testing.T, method, url string) *http.Response {
+	t.Helper()
+	return adminRequestWithBody(t, method, url, "")
+}
+
+func adminRequestWithBody(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func requireServed(t *testing.T, p *proxy.Proxy, host string) {
+	t.Helper()
+	require.True(t, onlyServedBy(p, host))
+}
+
+// onlyServedBy tells whether a few requests are all served by host.
+func onlyServedBy(p *proxy.Proxy, host string) bool {
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.io/", nil))
+		if strings.TrimSpace(w.Body.String()) != host {
+			return false
+		}
+	}
+	return true
+}
@@ -26,3 +26,9 @@ type HttpClient struct {
 func (h *HttpClient) Do(req request.ClientRequest) (*http.Response, error) {
 	return h.Client.Do(req.Request)
 }
+
+// CloseIdleConnections closes the kept-alive connections that are not in use,
+// e.g. to servers that were removed from the config.
+func (h *HttpClient) CloseIdleConnections() {
+	h.Client.CloseIdleConnections()
+}
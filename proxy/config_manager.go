@@ -1,78 +1,428 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
-	"syscall"
-
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
 	"go.uber.org/zap"
 )
 
 type ConfigManager struct {
-	mu            sync.RWMutex // to protect the latestVersion and Configs map
-	latestVersion int
-	configSrc     config.Source
-	configs       map[int]*config.Config // map of config versions
-	logger        *zap.SugaredLogger
+	reloadMu  sync.Mutex   // serializes reloads
+	mu        sync.RWMutex // to protect the history
+	configSrc config.Source
+	// history holds the latest versions of the config, the latest one last.
+	history     []*configVersion
+	historySize int
+	// latestRevision is the revision of the latest config in the source, when
+	// it was pushed by a config.Watcher. It is only accessed with reloadMu held.
+	latestRevision string
+	loadHooks      []LoadHook
+	reloadHooks    []ReloadHook
+	releaseHooks   []ReleaseHook
+	logger         *zap.SugaredLogger
+}
+
+// ConfigVersion describes a version of the config.
+type ConfigVersion struct {
+	Version int
+	Config  *config.Config
+	// Cause is what made the version: "initial", "reload", "update" for the
+	// servers added or removed at runtime, or "rollback".
+	Cause    string
+	LoadedAt time.Time
+	// Revision identifies the config in the source, when it was pushed by a
+	// config.Watcher or rolled back to such a config.
+	Revision string
+	// Hash identifies the content of the config. Secrets are left out, like
+	// in the dump of the config.
+	Hash string
+}
+
+// configVersion counts the requests that use a version, so that the version
+// is only released once they are done, after it left the history.
+type configVersion struct {
+	ConfigVersion
+	refs     atomic.Int64
+	pruned   atomic.Bool
+	released atomic.Bool
 }
 
-func NewConfigManager(src config.Source, logger *zap.SugaredLogger) (*ConfigManager, error) {
+const defaultConfigHistorySize = 10
+
+type ConfigManagerOption func(*ConfigManager)
+
+// WithConfigHistory sets how many versions of the config are kept, including
+// the latest one, 10 by default. Older versions cannot be rolled back to.
+func WithConfigHistory(size int) ConfigManagerOption {
+	return func(cm *ConfigManager) {
+		cm.historySize = max(size, 1)
+	}
+}
+
+// LoadHook is called with every config loaded from the source before it is
+// reloaded, e.g. to amend it. The reload fails if it returns an error.
+type LoadHook func(cfg *config.Config) error
+
+// ReloadHook is called with the current and the new config when a config is
+// reloaded, right before the new config starts serving requests.
+type ReloadHook func(prev, next *config.Config)
+
+// ReleaseHook is called with a version of the config that left the history
+// once the requests that use it are done.
+type ReleaseHook func(version ConfigVersion)
+
+func NewConfigManager(src config.Source, logger *zap.SugaredLogger, opts ...ConfigManagerOption) (*ConfigManager, error) {
 	cm := &ConfigManager{
-		latestVersion: 0,
-		configs:       make(map[int]*config.Config),
-		configSrc:     src,
-		logger:        logger,
+		configSrc:   src,
+		historySize: defaultConfigHistorySize,
+		logger:      logger,
+	}
+	for _, opt := range opts {
+		opt(cm)
 	}
 	cfg, err := src.Load()
 	if err != nil {
 		logger.Error("Failed to load config:", err)
 		return nil, err
 	}
-	cm.configs[0] = &cfg
+	cm.history = []*configVersion{newConfigVersion(0, &cfg, "initial", "")}
 	return cm, nil
 }
 
-// Start starts a new goroutine that listens for SIGHUP signals and reloads the config
+func newConfigVersion(version int, cfg *config.Config, cause, revision string) *configVersion {
+	return &configVersion{ConfigVersion: ConfigVersion{
+		Version:  version,
+		Config:   cfg,
+		Cause:    cause,
+		LoadedAt: time.Now(),
+		Revision: revision,
+		Hash:     configHash(cfg),
+	}}
+}
+
+// configHash hashes the dump of the config.
+func configHash(cfg *config.Config) string {
+	dump, err := json.Marshal(cfg.Dump())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(dump)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Start starts a new goroutine that reloads the config on SIGHUP signals and,
+// if the source is a config.Watcher, whenever the source reports a change. It
+// rolls back to the previous version on SIGUSR1 signals, on Unix only.
 func (cm *ConfigManager) Start(shutdownCh chan struct{}) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	rollbackChan := make(chan os.Signal, 1)
+	notifyRollback(rollbackChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var events <-chan config.ConfigEvent
+	if watcher, ok := cm.configSrc.(config.Watcher); ok {
+		events = watcher.Watch(ctx)
+	}
+
 	go func() {
+		defer cancel()
 		for {
 			select {
 			case <-shutdownCh:
 				return
 			case <-sigChan:
-				err := cm.reloadConfig()
-				if err != nil {
+				if err := cm.Reload(); err != nil {
 					cm.logger.Error("Failed to load config:", err)
 				}
-				cm.logger.Info("Config reloaded")
-
+			case <-rollbackChan:
+				if _, err := cm.RollbackToPrevious(); err != nil {
+					cm.logger.Errorw("Failed to roll back config", "err", err)
+				}
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				cm.handleEvent(event)
 			}
 		}
 	}()
 }
 
-func (cm *ConfigManager) reloadConfig() error {
+// Reload loads the config from the source and makes it the latest config.
+// The current config keeps serving requests if the new one cannot be loaded.
+func (cm *ConfigManager) Reload() error {
+	cm.reloadMu.Lock()
+	defer cm.reloadMu.Unlock()
+
 	cfg, err := cm.configSrc.Load()
 	if err != nil {
 		return fmt.Errorf("failed to reload config: %w", err)
 	}
+	return cm.load(&cfg, "")
+}
 
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.latestVersion++
-	cm.configs[cm.latestVersion] = &cfg
+// DryRun loads the config from the source and returns the changes a reload
+// would bring, without applying them. The servers added and removed at runtime
+// are not applied to the loaded config, so they show up as changes too.
+func (cm *ConfigManager) DryRun() ([]config.Change, error) {
+	cfg, err := cm.configSrc.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return config.Diff(cm.GetLatestConfig(), &cfg), nil
+}
+
+// handleEvent reloads the config pushed by the source. A config that could
+// not be loaded, e.g. a file saved halfway through an edit, is skipped and
+// the current config keeps serving requests.
+func (cm *ConfigManager) handleEvent(event config.ConfigEvent) {
+	if event.Err != nil {
+		cm.logger.Errorw("Failed to load config, keeping the current one", "revision", event.Revision, "err", event.Err)
+		return
+	}
+
+	cm.reloadMu.Lock()
+	defer cm.reloadMu.Unlock()
+	if event.Revision != "" && event.Revision == cm.latestRevision {
+		cm.logger.Debugw("Config unchanged, skipping reload", "revision", event.Revision)
+		return
+	}
+	if err := cm.load(event.Config, event.Revision); err != nil {
+		cm.logger.Errorw("Failed to load config, keeping the current one", "revision", event.Revision, "err", err)
+	}
+}
 
+// load runs the load hooks and makes the config loaded from the source the
+// latest config. It must be called with cm.reloadMu held.
+func (cm *ConfigManager) load(cfg *config.Config, revision string) error {
+	for _, hook := range cm.loadHooks {
+		if err := hook(cfg); err != nil {
+			return fmt.Errorf("failed to reload config: %w", err)
+		}
+	}
+
+	version, diff := cm.commit(cfg, "reload", revision)
+	cm.latestRevision = revision
+	if revision != "" {
+		cm.logger.Infow("Config reloaded", "version", version, "revision", revision, "diff", diff)
+	} else {
+		cm.logger.Infow("Config reloaded", "version", version, "diff", diff)
+	}
 	return nil
 }
 
+// update makes a modified copy of the latest config the latest config, like a
+// reload that does not go through the config source. The copy is shallow, so
+// change must copy what it modifies.
+func (cm *ConfigManager) update(change func(cfg *config.Config) error) error {
+	cm.reloadMu.Lock()
+	defer cm.reloadMu.Unlock()
+
+	cfg := *cm.GetLatestConfig()
+	if err := change(&cfg); err != nil {
+		return err
+	}
+
+	version, diff := cm.commit(&cfg, "update", cm.latestRevision)
+	cm.logger.Infow("Config updated", "version", version, "diff", diff)
+	return nil
+}
+
+// Rollback makes a copy of a version of the history the latest config, as if
+// it was loaded from the source again: the load hooks apply to it, e.g. the
+// servers added and removed at runtime keep taking precedence. It returns the
+// new version.
+func (cm *ConfigManager) Rollback(version int) (int, error) {
+	cm.reloadMu.Lock()
+	defer cm.reloadMu.Unlock()
+	return cm.rollback(func(history []*configVersion) (*configVersion, error) {
+		for _, v := range history {
+			if v.Version == version {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: version %d is not in the history", errNotFound, version)
+	})
+}
+
+// RollbackToPrevious rolls back to the version that preceded the latest one.
+func (cm *ConfigManager) RollbackToPrevious() (int, error) {
+	cm.reloadMu.Lock()
+	defer cm.reloadMu.Unlock()
+	return cm.rollback(func(history []*configVersion) (*configVersion, error) {
+		if len(history) < 2 {
+			return nil, fmt.Errorf("%w: there is no previous version in the history", errNotFound)
+		}
+		return history[len(history)-2], nil
+	})
+}
+
+// rollback must be called with cm.reloadMu held.
+func (cm *ConfigManager) rollback(find func(history []*configVersion) (*configVersion, error)) (int, error) {
+	cm.mu.RLock()
+	target, err := find(cm.history)
+	cm.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// the load balancers of the target still have the state of the servers
+	// when it was replaced, and may still be used by requests
+	cfg := target.Config.Clone()
+	for _, hook := range cm.loadHooks {
+		if err := hook(cfg); err != nil {
+			return 0, fmt.Errorf("failed to roll back config: %w", err)
+		}
+	}
+	version, diff := cm.commit(cfg, "rollback", target.Revision)
+	cm.latestRevision = target.Revision
+	cm.logger.Infow("Config rolled back", "version", version, "to_version", target.Version, "hash", target.Hash, "diff", diff)
+	return version, nil
+}
+
+// commit runs the reload hooks and makes cfg the latest config, pruning the
+// oldest version of the history if it is full. It returns the new version
+// along with the changes it brings.
+// It must be called with cm.reloadMu held.
+func (cm *ConfigManager) commit(cfg *config.Config, cause, revision string) (int, []config.Change) {
+	prev := cm.GetLatestConfig()
+	diff := config.Diff(prev, cfg)
+	inheritLoadBalancerState(prev, cfg)
+	for _, hook := range cm.reloadHooks {
+		hook(prev, cfg)
+	}
+
+	cm.mu.Lock()
+	version := newConfigVersion(cm.history[len(cm.history)-1].Version+1, cfg, cause, revision)
+	cm.history = append(cm.history, version)
+	var pruned []*configVersion
+	if len(cm.history) > cm.historySize {
+		n := len(cm.history) - cm.historySize
+		pruned = slices.Clone(cm.history[:n])
+		cm.history = slices.Delete(cm.history, 0, n)
+	}
+	cm.mu.Unlock()
+
+	for _, v := range pruned {
+		v.pruned.Store(true)
+		if v.refs.Load() == 0 {
+			cm.release(v)
+		}
+	}
+	return version.Version, diff
+}
+
+// release releases a version that left the history once, when the last
+// request that uses it is done.
+func (cm *ConfigManager) release(v *configVersion) {
+	if !v.released.CompareAndSwap(false, true) {
+		return
+	}
+	cm.logger.Debugw("Config version released", "version", v.Version)
+	for _, hook := range cm.releaseHooks {
+		hook(v.ConfigVersion)
+	}
+}
+
+// OnLoad registers a hook called on every config loaded from the source,
+// except the initial one. It must be called before Start.
+func (cm *ConfigManager) OnLoad(hook LoadHook) {
+	cm.loadHooks = append(cm.loadHooks, hook)
+}
+
+// OnReload registers a hook called on every config reload.
+// It must be called before Start.
+func (cm *ConfigManager) OnReload(hook ReloadHook) {
+	cm.reloadHooks = append(cm.reloadHooks, hook)
+}
+
+// OnRelease registers a hook called on every version of the config that is
+// released. It must be called before Start.
+func (cm *ConfigManager) OnRelease(hook ReleaseHook) {
+	cm.releaseHooks = append(cm.releaseHooks, hook)
+}
+
+// inheritLoadBalancerState hands the runtime state of the load balancers of
+// the previous config over to the ones of the backend groups with the same
+// name in the next config, so that a reload does not reset the rotation, or
+// make the unhealthy servers look healthy. Their new servers are put in slow
+// start, so that they are not hit with a full share of the traffic right
+// after the reload.
+func inheritLoadBalancerState(prev, next *config.Config) {
+	prevLbs := make(map[string]loadbalancer.LoadBalancer) // backendGroup -> load balancer
+	for _, bg := range prev.BackendGroups {
+		prevLbs[bg.Name] = bg.Lb
+	}
+
+	for _, bg := range next.BackendGroups {
+		prevLb, ok := prevLbs[bg.Name]
+		if !ok {
+			// the whole group is new, there is no state to inherit
+			continue
+		}
+		if lb, ok := bg.Lb.(loadbalancer.StateInheritor); ok {
+			lb.InheritState(prevLb)
+		}
+	}
+}
+
 func (cm *ConfigManager) GetLatestConfig() *config.Config {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
-	return cm.configs[cm.latestVersion]
+	return cm.history[len(cm.history)-1].Config
+}
+
+// GetLatestConfigWithVersion returns the latest config along with its
+// version, which starts at 0 and is incremented on every reload.
+func (cm *ConfigManager) GetLatestConfigWithVersion() (*config.Config, int) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	latest := cm.history[len(cm.history)-1]
+	return latest.Config, latest.Version
+}
+
+// AcquireLatestConfig returns the latest config along with a function to call
+// once done with it, e.g. at the end of a request. Its version is not released
+// until then.
+func (cm *ConfigManager) AcquireLatestConfig() (*config.Config, func()) {
+	cm.mu.RLock()
+	latest := cm.history[len(cm.history)-1]
+	latest.refs.Add(1)
+	cm.mu.RUnlock()
+
+	var once sync.Once
+	return latest.Config, func() {
+		once.Do(func() {
+			if latest.refs.Add(-1) == 0 && latest.pruned.Load() {
+				cm.release(latest)
+			}
+		})
+	}
+}
+
+// History returns the versions of the config that can be rolled back to,
+// the latest one last.
+func (cm *ConfigManager) History() []ConfigVersion {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	history := make([]ConfigVersion, len(cm.history))
+	for i, v := range cm.history {
+		history[i] = v.ConfigVersion
+	}
+	return history
 }
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package proxy
+
+import "os"
+
+// notifyRollback does nothing: SIGUSR1 only exists on Unix, other platforms
+// roll back through the admin API.
+func notifyRollback(c chan<- os.Signal) {}
@@ -0,0 +1,228 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"github.com/mouad-eh/wasseet/proxy"
+	"github.com/mouad-eh/wasseet/request"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConfigManagerWatch(t *testing.T) {
+	src := newFakeSource(config.Config{Port: 8080})
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	var reloads [][2]int
+	cm.OnReload(func(prev, next *config.Config) {
+		reloads = append(reloads, [2]int{prev.Port, next.Port})
+	})
+	startConfigManager(t, cm)
+
+	src.push(config.ConfigEvent{Config: &config.Config{Port: 8081}, Revision: "r1"})
+	requireLatestConfig(t, cm, 1, 8081)
+
+	// a config that could not be loaded is skipped
+	src.push(config.ConfigEvent{Revision: "r2", Err: errors.New("invalid config")})
+
+	// a config with the revision of the current one is skipped
+	src.push(config.ConfigEvent{Config: &config.Config{Port: 8082}, Revision: "r1"})
+	src.push(config.ConfigEvent{Config: &config.Config{Port: 8083}, Revision: "r3"})
+	src.push(config.ConfigEvent{Config: &config.Config{Port: 8084}})
+	requireLatestConfig(t, cm, 3, 8084)
+	require.Equal(t, [][2]int{{8080, 8081}, {8081, 8083}, {8083, 8084}}, reloads)
+}
+
+func TestConfigManagerWatchStopsOnShutdown(t *testing.T) {
+	src := newFakeSource(config.Config{})
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	shutdownCh := make(chan struct{})
+	cm.Start(shutdownCh)
+
+	close(shutdownCh)
+	select {
+	case <-src.done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch not stopped")
+	}
+}
+
+// fakeSource is an in-memory source that pushes the events it is given.
+type fakeSource struct {
+	cfg    config.Config
+	events chan config.ConfigEvent
+	mu     sync.Mutex
+	ctx    context.Context
+}
+
+func newFakeSource(cfg config.Config) *fakeSource {
+	return &fakeSource{cfg: cfg, events: make(chan config.ConfigEvent)}
+}
+
+func (s *fakeSource) Load() (config.Config, error) {
+	return s.cfg, nil
+}
+
+func (s *fakeSource) Watch(ctx context.Context) <-chan config.ConfigEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	return s.events
+}
+
+// push blocks until the event is received.
+func (s *fakeSource) push(event config.ConfigEvent) {
+	s.events <- event
+}
+
+func (s *fakeSource) done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx.Done()
+}
+
+func startConfigManager(t *testing.T, cm *proxy.ConfigManager) {
+	t.Helper()
+	shutdownCh := make(chan struct{})
+	cm.Start(shutdownCh)
+	t.Cleanup(func() { close(shutdownCh) })
+}
+
+func requireLatestConfig(t *testing.T, cm *proxy.ConfigManager, version, port int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		cfg, latestVersion := cm.GetLatestConfigWithVersion()
+		return latestVersion == version && cfg.Port == port
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestConfigManagerHistory(t *testing.T) {
+	src := &switchingSource{cfg: &config.Config{Port: 8080}}
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar(), proxy.WithConfigHistory(3))
+	require.NoError(t, err)
+	var released []int
+	cm.OnRelease(func(v proxy.ConfigVersion) {
+		released = append(released, v.Version)
+	})
+
+	for port := 8081; port <= 8084; port++ {
+		src.set(&config.Config{Port: port})
+		require.NoError(t, cm.Reload())
+	}
+
+	history := cm.History()
+	require.Len(t, history, 3)
+	for i, v := range history {
+		require.Equal(t, i+2, v.Version)
+		require.Equal(t, 8082+i, v.Config.Port)
+		require.Equal(t, "reload", v.Cause)
+		require.NotZero(t, v.LoadedAt)
+		require.NotEmpty(t, v.Hash)
+	}
+	require.NotEqual(t, history[0].Hash, history[1].Hash)
+	require.Equal(t, []int{0, 1}, released)
+}
+
+func TestConfigManagerRollback(t *testing.T) {
+	src := &switchingSource{cfg: &config.Config{Port: 8080}}
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	_, err = cm.RollbackToPrevious()
+	require.Error(t, err)
+
+	src.set(&config.Config{Port: 8081})
+	require.NoError(t, cm.Reload())
+	src.set(&config.Config{Port: 8082})
+	require.NoError(t, cm.Reload())
+
+	version, err := cm.RollbackToPrevious()
+	require.NoError(t, err)
+	require.Equal(t, 3, version)
+	requireLatestConfig(t, cm, 3, 8081)
+
+	version, err = cm.Rollback(0)
+	require.NoError(t, err)
+	require.Equal(t, 4, version)
+	requireLatestConfig(t, cm, 4, 8080)
+
+	history := cm.History()
+	require.Equal(t, "rollback", history[len(history)-1].Cause)
+	require.Equal(t, history[0].Hash, history[len(history)-1].Hash)
+
+	_, err = cm.Rollback(42)
+	require.Error(t, err)
+}
+
+func TestConfigManagerReleasesAfterInFlightRequests(t *testing.T) {
+	src := &switchingSource{cfg: &config.Config{Port: 8080}}
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar(), proxy.WithConfigHistory(1))
+	require.NoError(t, err)
+	var released []int
+	cm.OnRelease(func(v proxy.ConfigVersion) {
+		released = append(released, v.Version)
+	})
+
+	cfg, release := cm.AcquireLatestConfig()
+	require.Equal(t, 8080, cfg.Port)
+	src.set(&config.Config{Port: 8081})
+	require.NoError(t, cm.Reload())
+	require.Empty(t, released)
+
+	release()
+	release()
+	require.Equal(t, []int{0}, released)
+}
+
+func TestConfigManagerReloadKeepsLoadBalancerState(t *testing.T) {
+	src := &switchingSource{cfg: newGroupConfig("backend1.io", "backend2.io")}
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	prev := cm.GetLatestConfig().BackendGroups[0]
+	prev.Lb.(loadbalancer.HealthAware).SetHealthy(prev.Servers[0], false)
+
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	require.NoError(t, cm.Reload())
+	next := cm.GetLatestConfig().BackendGroups[0]
+	require.NotSame(t, prev.Lb, next.Lb)
+	for i := 0; i < 4; i++ {
+		backend, _, err := next.Lb.Pick(request.ServerRequest{Request: httptest.NewRequest("GET", "http://proxy.io/", nil)})
+		require.NoError(t, err)
+		require.Equal(t, "backend2.io", backend.Host)
+	}
+}
+
+func TestConfigManagerRollbackTakesOverLoadBalancerState(t *testing.T) {
+	src := &switchingSource{cfg: newGroupConfig("backend1.io", "backend2.io")}
+	cm, err := proxy.NewConfigManager(src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	v0 := cm.GetLatestConfig().BackendGroups[0]
+	v0.Lb.(loadbalancer.HealthAware).SetHealthy(v0.Servers[0], false)
+
+	// backend1.io recovers after a reload
+	src.set(newGroupConfig("backend1.io", "backend2.io"))
+	require.NoError(t, cm.Reload())
+	v1 := cm.GetLatestConfig().BackendGroups[0]
+	v1.Lb.(loadbalancer.HealthAware).SetHealthy(v1.Servers[0], true)
+
+	_, err = cm.Rollback(0)
+	require.NoError(t, err)
+	rolledBack := cm.GetLatestConfig()
+	require.NotSame(t, v0.Lb, rolledBack.BackendGroups[0].Lb)
+	require.Same(t, rolledBack.BackendGroups[0], rolledBack.Rules[0].BackendGroup)
+	picked := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		backend, _, err := rolledBack.BackendGroups[0].Lb.Pick(request.ServerRequest{Request: httptest.NewRequest("GET", "http://proxy.io/", nil)})
+		require.NoError(t, err)
+		picked[backend.Host] = true
+	}
+	require.Equal(t, map[string]bool{"backend1.io": true, "backend2.io": true}, picked)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRollback relays the SIGUSR1 signals, which roll back the config, to c.
+func notifyRollback(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
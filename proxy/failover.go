@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"go.uber.org/zap"
+)
+
+// failover logs when backend groups start or stop routing to their backup
+// servers.
+//
+// It asks the load balancer of the group rather than the health checker, so
+// that primary servers that are ejected by outlier detection or drained count
+// as unavailable too. It must be told about every change to the health,
+// ejection or drain of a server.
+type failover struct {
+	logger     *zap.SugaredLogger
+	mu         sync.Mutex      // protects failedOver
+	failedOver map[string]bool // backendGroup -> routing to backup servers
+}
+
+func newFailover(logger *zap.SugaredLogger) *failover {
+	return &failover{logger: logger, failedOver: make(map[string]bool)}
+}
+
+// update logs when the backend group fails over or back. It does nothing on a
+// nil failover, e.g. for a health checker that is not part of a proxy.
+func (f *failover) update(bg *config.BackendGroup) {
+	if f == nil {
+		return
+	}
+	lb, ok := bg.Lb.(loadbalancer.FailoverAware)
+	if !ok {
+		return
+	}
+	// held while asking the load balancer so that concurrent updates cannot
+	// log the changes out of order
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failedOver := lb.FailedOver()
+	if failedOver == f.failedOver[bg.Name] {
+		return
+	}
+	if failedOver {
+		f.failedOver[bg.Name] = true
+		f.logger.Warnw("No primary server is available, failing over to backup servers", "backend_group", bg.Name)
+	} else {
+		delete(f.failedOver, bg.Name)
+		f.logger.Infow("A primary server is available again, failing back from backup servers", "backend_group", bg.Name)
+	}
+}
+
+// reload updates every backend group of a new config and forgets about the
+// ones that are gone.
+func (f *failover) reload(backendGroups []*config.BackendGroup) {
+	names := make(map[string]bool)
+	for _, bg := range backendGroups {
+		names[bg.Name] = true
+	}
+	f.mu.Lock()
+	for name := range f.failedOver {
+		if !names[name] {
+			delete(f.failedOver, name)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, bg := range backendGroups {
+		f.update(bg)
+	}
+}
@@ -1,99 +1,614 @@
 package proxy
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
 	"github.com/mouad-eh/wasseet/request"
 	"go.uber.org/zap"
 )
 
+// HealthChecker actively probes the backends of the backend groups with a
+// health check and reports their status to the load balancers of the groups.
+//
+// Probes are run by a bounded pool of workers in the order of a single
+// schedule, and a backend shared by several groups with the same health
+// check is only probed once for all of them.
 type HealthChecker struct {
 	logger        *zap.SugaredLogger
+	failover      *failover // set by the proxy, nil otherwise
 	client        BackendClient
+	grpcClient    *http.Client
+	clock         Clock
+	workers       int
+	jobs          chan *probe
+	wakeCh        chan struct{}
+	subscribersMu sync.Mutex // protects subscribers and orders the publication of events
+	subscribers   map[int]func(HealthEvent)
+	nextID        int
+	mu            sync.Mutex // protects all the fields below
 	backendGroups []*config.BackendGroup
-	mu            sync.RWMutex               // protect health map
 	health        map[string]map[string]bool // backendGroup -> backend -> healthy
-	retries       map[string]map[string]int  // backendGroup -> backend -> retries
+	failures      map[string]map[string]int  // backendGroup -> backend -> consecutive failed checks
+	successes     map[string]map[string]int  // backendGroup -> backend -> consecutive passed checks
+	probes        map[string][]*probe        // backend -> one probe per distinct health check
+	queue         probeQueue                 // probes waiting for their next run
+	events        []HealthEvent              // changes not published to the subscribers yet
+	shutdownCh    chan struct{}              // nil until Start is called
 }
 
-func NewHealthChecker(backendGroups []*config.BackendGroup, client BackendClient, logger *zap.SugaredLogger) *HealthChecker {
-	hc := &HealthChecker{
-		logger:        logger,
-		client:        client,
-		backendGroups: backendGroups,
-		health:        make(map[string]map[string]bool),
-		retries:       make(map[string]map[string]int),
+// HealthCheckerOption configures a HealthChecker.
+type HealthCheckerOption func(*HealthChecker)
+
+// WithHealthCheckClock replaces the clock used to schedule probes.
+// It is meant for tests.
+func WithHealthCheckClock(clock Clock) HealthCheckerOption {
+	return func(hc *HealthChecker) {
+		hc.clock = clock
 	}
-	for _, bg := range backendGroups {
-		hc.health[bg.Name] = make(map[string]bool)
-		hc.retries[bg.Name] = make(map[string]int)
+}
+
+// WithHealthCheckWorkers sets the maximum number of probes running at the same time.
+func WithHealthCheckWorkers(workers int) HealthCheckerOption {
+	return func(hc *HealthChecker) {
+		hc.workers = workers
 	}
-	for _, bg := range backendGroups {
-		for _, backend := range bg.Servers {
-			hc.health[bg.Name][backend.String()] = true
-			hc.retries[bg.Name][backend.String()] = 0
-		}
+}
+
+const defaultHealthCheckWorkers = 64
+
+func NewHealthChecker(backendGroups []*config.BackendGroup, client BackendClient, logger *zap.SugaredLogger, opts ...HealthCheckerOption) *HealthChecker {
+	hc := &HealthChecker{
+		logger:      logger,
+		client:      client,
+		grpcClient:  newGRPCClient(),
+		clock:       realClock{},
+		workers:     defaultHealthCheckWorkers,
+		jobs:        make(chan *probe),
+		wakeCh:      make(chan struct{}, 1),
+		health:      make(map[string]map[string]bool),
+		failures:    make(map[string]map[string]int),
+		successes:   make(map[string]map[string]int),
+		probes:      make(map[string][]*probe),
+		subscribers: make(map[int]func(HealthEvent)),
+	}
+	for _, opt := range opts {
+		opt(hc)
 	}
+	hc.Update(backendGroups)
 	return hc
 }
 
+// newGRPCClient returns a client speaking HTTP/2 only, over TLS for https URLs
+// and in cleartext (h2c) for http URLs, as gRPC servers expect.
+func newGRPCClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// Start starts probing the backends of every backend group with a health check.
 func (hc *HealthChecker) Start(shutdownCh chan struct{}) {
-	for _, bg := range hc.backendGroups {
-		if bg.HealthCheck == nil {
-			continue
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.shutdownCh = shutdownCh
+	go hc.schedule(shutdownCh)
+	for range hc.workers {
+		go hc.work(shutdownCh)
+	}
+	hc.syncProbes()
+}
+
+// Update replaces the backend groups being checked, typically after a config reload.
+//
+// Probes of removed backends are stopped and probes of new backends are started.
+// Backends that are still part of the same backend group with the same health
+// check keep their status, which is also applied to the load balancer of the group.
+func (hc *HealthChecker) Update(backendGroups []*config.BackendGroup) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	health := make(map[string]map[string]bool)
+	failures := make(map[string]map[string]int)
+	successes := make(map[string]map[string]int)
+	for _, bg := range backendGroups {
+		if health[bg.Name] == nil {
+			health[bg.Name] = make(map[string]bool)
+			failures[bg.Name] = make(map[string]int)
+			successes[bg.Name] = make(map[string]int)
 		}
-		for _, backend := range bg.Servers {
-			go hc.checkHealth(bg.Name, backend.String(), bg.HealthCheck, shutdownCh)
+		for _, backend := range bg.AllServers() {
+			key := backend.String()
+			healthy, known := hc.health[bg.Name][key]
+			if !known {
+				healthy = true
+			}
+			health[bg.Name][key] = healthy
+			failures[bg.Name][key] = hc.failures[bg.Name][key]
+			successes[bg.Name][key] = hc.successes[bg.Name][key]
+
+			// both ways: the load balancer may have inherited a status
+			// that changed since from the previous load balancer
+			if lb, ok := bg.Lb.(loadbalancer.HealthAware); ok {
+				lb.SetHealthy(backend, healthy)
+			}
 		}
 	}
+
+	hc.backendGroups = backendGroups
+	hc.health = health
+	hc.failures = failures
+	hc.successes = successes
+	hc.syncProbes()
 }
 
-func (hc *HealthChecker) checkHealth(backendGroup, backend string, params *config.HealthCheck, shutdownCh chan struct{}) {
-	ticker := time.NewTicker(params.Interval)
-	for {
-		select {
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), params.Timeout)
-			defer cancel()
+// IsHealthy tells whether the backend of the backend group passes its health
+// check. Backends without health check are healthy.
+func (hc *HealthChecker) IsHealthy(backendGroup, backend string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	healthy, known := hc.health[backendGroup][backend]
+	return healthy || !known
+}
+
+// syncProbes starts and stops probes so that there is exactly one probe per
+// backend and distinct health check of the backend groups.
+// It must be called with hc.mu held.
+func (hc *HealthChecker) syncProbes() {
+	if hc.shutdownCh == nil {
+		return
+	}
 
-			req, err := http.NewRequestWithContext(ctx, "GET", backend+params.Path, nil)
-			if err != nil {
-				hc.logger.Errorw("Failed to create health check request", "backend", backend, "err", err)
+	now := hc.clock.Now()
+	probes := make(map[string][]*probe)
+	for _, bg := range hc.backendGroups {
+		if bg.HealthCheck == nil {
+			continue
+		}
+		for _, backend := range bg.AllServers() {
+			key := backend.String()
+			if p := findProbe(probes[key], bg.HealthCheck); p != nil {
+				if !slices.Contains(p.backendGroups, bg.Name) {
+					p.backendGroups = append(p.backendGroups, bg.Name)
+				}
 				continue
 			}
 
-			resp, err := hc.client.Do(request.ClientRequest{Request: req})
-			if err != nil || resp.StatusCode != http.StatusOK {
-				hc.retries[backendGroup][backend]++
-				if hc.retries[backendGroup][backend] >= params.Retries && hc.getHealthStatus(backendGroup, backend) {
-					hc.logger.Warnw("Backend is unhealthy", "backend_group", backendGroup, "backend", backend)
-					hc.setHealthStatus(backendGroup, backend, false)
+			// keep the probes that already run so that reloads do not reset their schedule
+			p := findProbe(hc.probes[key], bg.HealthCheck)
+			if p == nil {
+				p = &probe{
+					backend: backend,
+					params:  bg.HealthCheck,
+					checker: hc.newChecker(bg.HealthCheck),
+					// spread the first runs over the interval so that the probes of
+					// all the backends do not run at the same time after a start or a reload
+					next:  now.Add(rand.N(bg.HealthCheck.Interval)),
+					index: -1,
 				}
-			} else {
-				if !hc.getHealthStatus(backendGroup, backend) {
-					hc.logger.Infow("Backend is healthy", "backend_group", backendGroup, "backend", backend)
-					hc.retries[backendGroup][backend] = 0
-					hc.setHealthStatus(backendGroup, backend, true)
+				heap.Push(&hc.queue, p)
+			}
+			p.backendGroups = []string{bg.Name}
+			probes[key] = append(probes[key], p)
+		}
+	}
+
+	for key, old := range hc.probes {
+		for _, p := range old {
+			if !slices.Contains(probes[key], p) {
+				p.stopped = true
+				if p.index >= 0 {
+					heap.Remove(&hc.queue, p.index)
 				}
 			}
-		case <-shutdownCh:
-			return
 		}
 	}
+	hc.probes = probes
+	hc.wake()
+}
+
+// findProbe returns the probe running the given health check, if any.
+func findProbe(probes []*probe, params *config.HealthCheck) *probe {
+	for _, p := range probes {
+		if reflect.DeepEqual(p.params, params) {
+			return p
+		}
+	}
+	return nil
 }
 
-func (hc *HealthChecker) setHealthStatus(backendGroup, backend string, status bool) {
+// run probes a backend and records the result for every backend group
+// sharing the probe, before scheduling the next run.
+func (hc *HealthChecker) run(p *probe) {
 	hc.mu.Lock()
-	defer hc.mu.Unlock()
-	hc.health[backendGroup][backend] = status
+	stopped := p.stopped
+	hc.mu.Unlock()
+	if stopped {
+		return
+	}
+
+	start := hc.clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), p.params.Timeout)
+	err := p.checker.check(ctx, p.backend)
+	cancel()
+
+	hc.mu.Lock()
+	if p.stopped {
+		hc.mu.Unlock()
+		return
+	}
+	for _, backendGroup := range p.backendGroups {
+		hc.recordResult(backendGroup, p.backend.String(), p.params, err)
+	}
+	p.next = start.Add(p.params.Interval)
+	heap.Push(&hc.queue, p)
+	hc.wake()
+	hc.publishEvents()
+}
+
+// checker probes a backend once. It returns nil when the backend is healthy.
+type checker interface {
+	check(ctx context.Context, backend *url.URL) error
 }
 
-func (hc *HealthChecker) getHealthStatus(backendGroup, backend string) bool {
-	hc.mu.RLock()
-	defer hc.mu.RUnlock()
-	return hc.health[backendGroup][backend]
+func (hc *HealthChecker) newChecker(params *config.HealthCheck) checker {
+	switch params.Type {
+	case config.TCPHealthCheck:
+		return &tcpChecker{params: params}
+	case config.GRPCHealthCheck:
+		return &grpcChecker{client: hc.grpcClient, params: params}
+	case config.ExecHealthCheck:
+		return &execChecker{params: params}
+	default:
+		return &httpChecker{client: hc.client, params: params}
+	}
+}
+
+// maxHealthCheckBodySize is the maximum number of bytes of a response matched
+// against the expected response of a health check.
+const maxHealthCheckBodySize = 64 * 1024
+
+// httpChecker sends a request to the backend and checks the status and body of the response.
+type httpChecker struct {
+	client BackendClient
+	params *config.HealthCheck
+}
+
+func (c *httpChecker) check(ctx context.Context, backend *url.URL) error {
+	target := healthCheckURL(backend, c.params).String() + c.params.Path
+	req, err := http.NewRequestWithContext(ctx, c.params.Method, target, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.params.Headers {
+		req.Header[name] = values
+	}
+	if c.params.Host != "" {
+		req.Host = c.params.Host
+	}
+
+	resp, err := c.client.Do(request.ClientRequest{Request: req})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection can be reused by the next check
+	defer io.Copy(io.Discard, resp.Body)
+
+	if !slices.ContainsFunc(c.params.ExpectedStatuses, func(r config.StatusRange) bool {
+		return r.Contains(resp.StatusCode)
+	}) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if c.params.ExpectedBody == "" && c.params.ExpectedBodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return err
+	}
+	if c.params.ExpectedBody != "" && !bytes.Contains(body, []byte(c.params.ExpectedBody)) {
+		return fmt.Errorf("body does not contain %q", c.params.ExpectedBody)
+	}
+	if c.params.ExpectedBodyRegex != nil && !c.params.ExpectedBodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", c.params.ExpectedBodyRegex)
+	}
+	return nil
+}
+
+// tcpChecker opens a connection to the backend, optionally sending data and
+// waiting for an expected answer.
+type tcpChecker struct {
+	params *config.HealthCheck
+}
+
+func (c *tcpChecker) check(ctx context.Context, backend *url.URL) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", healthCheckURL(backend, c.params).Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if c.params.Send != "" {
+		if _, err := io.WriteString(conn, c.params.Send); err != nil {
+			return err
+		}
+	}
+	if c.params.Expect == "" {
+		return nil
+	}
+
+	var received []byte
+	buf := make([]byte, 4096)
+	for len(received) < maxHealthCheckBodySize {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if bytes.Contains(received, []byte(c.params.Expect)) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("did not receive %q: %w", c.params.Expect, err)
+		}
+	}
+	return fmt.Errorf("did not receive %q", c.params.Expect)
+}
+
+// grpcServingStatus is the SERVING value of the status of grpc.health.v1.HealthCheckResponse.
+const grpcServingStatus = 1
+
+// grpcChecker calls the Check method of the grpc.health.v1.Health service of the backend.
+//
+// The messages of the protocol are small enough to be encoded by hand, which
+// saves depending on a gRPC implementation.
+type grpcChecker struct {
+	client *http.Client
+	params *config.HealthCheck
+}
+
+func (c *grpcChecker) check(ctx context.Context, backend *url.URL) error {
+	// HealthCheckRequest has a single field: string service = 1
+	var msg []byte
+	if c.params.Service != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(c.params.Service)))
+		msg = append(msg, c.params.Service...)
+	}
+
+	target := healthCheckURL(backend, c.params)
+	target.Path = "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return err
+	}
+	// the status is in the trailers, unless the server only sent headers
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	if grpcStatus != "0" {
+		return fmt.Errorf("grpc status %q: %s", grpcStatus, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	status, err := parseGRPCHealthCheckResponse(body)
+	if err != nil {
+		return err
+	}
+	if status != grpcServingStatus {
+		return fmt.Errorf("service is not serving, status %d", status)
+	}
+	return nil
+}
+
+// grpcFrame prefixes the message with the uncompressed flag and its length.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseGRPCHealthCheckResponse returns the status of the
+// grpc.health.v1.HealthCheckResponse framed in body.
+func parseGRPCHealthCheckResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, fmt.Errorf("truncated grpc response")
+	}
+	if body[0] != 0 {
+		return 0, fmt.Errorf("compressed grpc responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(length) {
+		return 0, fmt.Errorf("truncated grpc response")
+	}
+	msg := body[5 : 5+length]
+
+	// HealthCheckResponse has a single field: ServingStatus status = 1,
+	// which is 0 (UNKNOWN) when absent. Other fields are skipped.
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid grpc response")
+		}
+		msg = msg[n:]
+
+		var size uint64
+		switch tag & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, fmt.Errorf("invalid grpc response")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			size = uint64(n)
+		case 1: // 64-bit
+			size = 8
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, fmt.Errorf("invalid grpc response")
+			}
+			size = uint64(n) + l
+		case 5: // 32-bit
+			size = 4
+		default:
+			return 0, fmt.Errorf("invalid grpc response")
+		}
+		if uint64(len(msg)) < size {
+			return 0, fmt.Errorf("invalid grpc response")
+		}
+		msg = msg[size:]
+	}
+	return status, nil
+}
+
+// maxExecOutputSize is the maximum number of bytes of the output of a failed
+// exec health check included in its error.
+const maxExecOutputSize = 256
+
+// execChecker runs a local command, which is given the address of the backend
+// in its environment. The backend is healthy when the command exits with 0.
+type execChecker struct {
+	params *config.HealthCheck
+}
+
+func (c *execChecker) check(ctx context.Context, backend *url.URL) error {
+	target := healthCheckURL(backend, c.params)
+	cmd := exec.CommandContext(ctx, c.params.Command[0], c.params.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"WASSEET_BACKEND_URL="+backend.String(),
+		"WASSEET_BACKEND_ADDRESS="+target.Host,
+		"WASSEET_BACKEND_HOST="+target.Hostname(),
+		"WASSEET_BACKEND_PORT="+target.Port(),
+	)
+	// do not wait forever for the output of processes started by the command
+	// and still running after it has been killed
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) > maxExecOutputSize {
+			output = output[:maxExecOutputSize]
+		}
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+// healthCheckURL returns the backend URL with the scheme and port of the
+// health check, if any. The port is always explicit so that it can be dialed.
+func healthCheckURL(backend *url.URL, params *config.HealthCheck) *url.URL {
+	u := *backend
+	if params.Scheme != "" {
+		u.Scheme = params.Scheme
+	}
+	port := u.Port()
+	if params.Port != 0 {
+		port = strconv.Itoa(params.Port)
+	}
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return &u
+}
+
+// recordResult must be called with hc.mu held.
+func (hc *HealthChecker) recordResult(backendGroup, backend string, params *config.HealthCheck, err error) {
+	if _, ok := hc.health[backendGroup][backend]; !ok {
+		// the backend has been removed while it was being checked
+		return
+	}
+
+	if err == nil {
+		hc.failures[backendGroup][backend] = 0
+		hc.successes[backendGroup][backend]++
+		if hc.successes[backendGroup][backend] >= params.HealthyThreshold && !hc.health[backendGroup][backend] {
+			hc.logger.Infow("Backend is healthy", "backend_group", backendGroup, "backend", backend)
+			reason := fmt.Sprintf("passed %d consecutive health checks", hc.successes[backendGroup][backend])
+			hc.setHealthStatus(backendGroup, backend, true, reason)
+		}
+		return
+	}
+
+	hc.successes[backendGroup][backend] = 0
+	hc.failures[backendGroup][backend]++
+	if hc.failures[backendGroup][backend] >= params.UnhealthyThreshold && hc.health[backendGroup][backend] {
+		hc.logger.Warnw("Backend is unhealthy", "backend_group", backendGroup, "backend", backend, "err", err)
+		reason := fmt.Sprintf("failed %d consecutive health checks: %v", hc.failures[backendGroup][backend], err)
+		hc.setHealthStatus(backendGroup, backend, false, reason)
+	}
+}
+
+// setHealthStatus must be called with hc.mu held.
+func (hc *HealthChecker) setHealthStatus(backendGroup, backend string, status bool, reason string) {
+	hc.health[backendGroup][backend] = status
+	hc.events = append(hc.events, HealthEvent{
+		BackendGroup: backendGroup,
+		Backend:      backend,
+		OldState:     healthState(!status),
+		NewState:     healthState(status),
+		Reason:       reason,
+		Timestamp:    hc.clock.Now(),
+	})
+
+	// let the load balancer of the group know so that it stops (or resumes)
+	// sending traffic to the backend
+	for _, bg := range hc.backendGroups {
+		if bg.Name != backendGroup {
+			continue
+		}
+		if lb, ok := bg.Lb.(loadbalancer.HealthAware); ok {
+			for _, server := range bg.AllServers() {
+				if server.String() == backend {
+					lb.SetHealthy(server, status)
+				}
+			}
+		}
+		hc.failover.update(bg)
+	}
 }
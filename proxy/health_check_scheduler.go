@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"container/heap"
+	"net/url"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+)
+
+// Clock tells the time to the health checker.
+type Clock interface {
+	Now() time.Time
+	// After sends the current time on the returned channel once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// probe is the periodic health check of a backend, shared by all the backend
+// groups checking the backend with the same health check.
+type probe struct {
+	backend       *url.URL
+	params        *config.HealthCheck
+	checker       checker
+	backendGroups []string
+	next          time.Time // time of the next run
+	index         int       // index in the queue, -1 while running
+	stopped       bool      // set when the backend is no longer checked
+}
+
+// probeQueue is a min-heap of probes ordered by the time of their next run,
+// see container/heap.
+type probeQueue []*probe
+
+func (q probeQueue) Len() int           { return len(q) }
+func (q probeQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q probeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *probeQueue) Push(x any) {
+	p := x.(*probe)
+	p.index = len(*q)
+	*q = append(*q, p)
+}
+
+func (q *probeQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	p.index = -1
+	*q = old[:len(old)-1]
+	return p
+}
+
+// schedule hands the probes over to the workers as they become due.
+func (hc *HealthChecker) schedule(shutdownCh chan struct{}) {
+	for {
+		hc.mu.Lock()
+		var due *probe
+		var timer <-chan time.Time
+		if len(hc.queue) > 0 {
+			if wait := hc.queue[0].next.Sub(hc.clock.Now()); wait > 0 {
+				timer = hc.clock.After(wait)
+			} else {
+				due = heap.Pop(&hc.queue).(*probe)
+			}
+		}
+		hc.mu.Unlock()
+
+		if due != nil {
+			// block until a worker is free, the other due probes wait in the queue
+			select {
+			case hc.jobs <- due:
+			case <-shutdownCh:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-timer:
+		case <-hc.wakeCh:
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+func (hc *HealthChecker) work(shutdownCh chan struct{}) {
+	for {
+		select {
+		case p := <-hc.jobs:
+			hc.run(p)
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// wake lets the scheduler know that the queue changed.
+func (hc *HealthChecker) wake() {
+	select {
+	case hc.wakeCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,428 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"github.com/mouad-eh/wasseet/proxy"
+	"github.com/mouad-eh/wasseet/request"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTCPHealthCheck(t *testing.T) {
+	healthy := startTCPServer(t, "+PONG\r\n")
+	wrongAnswer := startTCPServer(t, "-ERR\r\n")
+
+	lb := startHealthChecker(t, []*url.URL{healthy, wrongAnswer}, &config.HealthCheck{
+		Type:               config.TCPHealthCheck,
+		Send:               "PING\r\n",
+		Expect:             "+PONG",
+		Interval:           50 * time.Millisecond,
+		Timeout:            40 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	})
+
+	requireOnlyPicked(t, lb, healthy)
+}
+
+func TestTCPHealthCheckConnectionRefused(t *testing.T) {
+	healthy := startTCPServer(t, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	listener.Close()
+
+	lb := startHealthChecker(t, []*url.URL{healthy, closed}, &config.HealthCheck{
+		Type:               config.TCPHealthCheck,
+		Interval:           50 * time.Millisecond,
+		Timeout:            40 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	})
+
+	requireOnlyPicked(t, lb, healthy)
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	serving := startGRPCHealthServer(t, "orders", 1)    // SERVING
+	notServing := startGRPCHealthServer(t, "orders", 2) // NOT_SERVING
+
+	lb := startHealthChecker(t, []*url.URL{serving, notServing}, &config.HealthCheck{
+		Type:               config.GRPCHealthCheck,
+		Service:            "orders",
+		Interval:           50 * time.Millisecond,
+		Timeout:            40 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	})
+
+	requireOnlyPicked(t, lb, serving)
+}
+
+func TestExecHealthCheck(t *testing.T) {
+	healthy := &url.URL{Scheme: "http", Host: "localhost:9001"}
+	unhealthy := &url.URL{Scheme: "http", Host: "localhost:9002"}
+
+	lb := startHealthChecker(t, []*url.URL{healthy, unhealthy}, &config.HealthCheck{
+		Type:               config.ExecHealthCheck,
+		Command:            []string{"sh", "-c", `test "$WASSEET_BACKEND_ADDRESS" = localhost:9001`},
+		Interval:           200 * time.Millisecond,
+		Timeout:            150 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	})
+
+	requireOnlyPicked(t, lb, healthy)
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var probes atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+
+	clock := newFakeClock()
+	lb := loadbalancer.NewRoundRobin([]*url.URL{backend})
+	bg := &config.BackendGroup{Name: "test", Lb: lb, Servers: []*url.URL{backend}, HealthCheck: &config.HealthCheck{
+		Type:               config.HTTPHealthCheck,
+		Path:               "/health",
+		Method:             http.MethodGet,
+		ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+		Interval:           10 * time.Second,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}}
+	startHealthCheckerWithClock(t, clock, bg)
+
+	// runs the next probe and waits for the backend to become (un)healthy after it
+	probeUntil := func(n int32, healthy bool) {
+		t.Helper()
+		clock.Advance(10 * time.Second)
+		require.Eventually(t, func() bool { return probes.Load() == n }, time.Second, time.Millisecond)
+		require.Eventually(t, func() bool { return isHealthy(lb) == healthy }, time.Second, time.Millisecond)
+	}
+
+	failing.Store(true)
+	probeUntil(1, true)
+	probeUntil(2, true)
+	probeUntil(3, false)
+
+	failing.Store(false)
+	probeUntil(4, false)
+	probeUntil(5, true)
+}
+
+// TestHealthCheckUpdateClearsStaleStatus checks that Update pushes the status
+// of the checker to the load balancer of a reloaded config even when it is
+// healthy, since the load balancer may have inherited an older status, e.g. when
+// the backend recovered between the reload and the update.
+func TestHealthCheckUpdateClearsStaleStatus(t *testing.T) {
+	backend := &url.URL{Scheme: "http", Host: "backend.io"}
+	params := &config.HealthCheck{Type: config.TCPHealthCheck, Interval: time.Minute, Timeout: time.Second}
+	bg := &config.BackendGroup{Name: "test", Lb: loadbalancer.NewRoundRobin([]*url.URL{backend}), Servers: []*url.URL{backend}, HealthCheck: params}
+	hc := proxy.NewHealthChecker([]*config.BackendGroup{bg}, &proxy.HttpClient{Client: &http.Client{}}, zap.NewNop().Sugar())
+
+	lb := loadbalancer.NewRoundRobin([]*url.URL{backend})
+	lb.SetHealthy(backend, false)
+	hc.Update([]*config.BackendGroup{{Name: "test", Lb: lb, Servers: []*url.URL{backend}, HealthCheck: params}})
+	require.True(t, isHealthy(lb))
+}
+
+func TestHealthCheckDeduplicatesProbes(t *testing.T) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+
+	newBackendGroup := func(name string) *config.BackendGroup {
+		return &config.BackendGroup{
+			Name:    name,
+			Lb:      loadbalancer.NewRoundRobin([]*url.URL{backend}),
+			Servers: []*url.URL{backend},
+			HealthCheck: &config.HealthCheck{
+				Type:               config.HTTPHealthCheck,
+				Path:               "/health",
+				Method:             http.MethodGet,
+				ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+				Interval:           10 * time.Second,
+				Timeout:            time.Second,
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 1,
+			},
+		}
+	}
+	bg1, bg2 := newBackendGroup("group1"), newBackendGroup("group2")
+
+	clock := newFakeClock()
+	startHealthCheckerWithClock(t, clock, bg1, bg2)
+	clock.Advance(10 * time.Second)
+
+	// a single probe marks the backend unhealthy in both groups
+	require.Eventually(t, func() bool {
+		return !isHealthy(bg1.Lb) && !isHealthy(bg2.Lb)
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int32(1), probes.Load())
+}
+
+func TestHealthCheckWorkers(t *testing.T) {
+	var probes, running, maxRunning atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		probes.Add(1)
+	})
+	var servers []*url.URL
+	for range 3 {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		backend, _ := url.Parse(server.URL)
+		servers = append(servers, backend)
+	}
+	bg := &config.BackendGroup{Name: "test", Lb: loadbalancer.NewRoundRobin(servers), Servers: servers, HealthCheck: &config.HealthCheck{
+		Type:               config.HTTPHealthCheck,
+		Path:               "/health",
+		Method:             http.MethodGet,
+		ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+		Interval:           10 * time.Second,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}}
+
+	clock := newFakeClock()
+	hc := proxy.NewHealthChecker([]*config.BackendGroup{bg}, &proxy.HttpClient{Client: &http.Client{}}, zap.NewNop().Sugar(),
+		proxy.WithHealthCheckClock(clock), proxy.WithHealthCheckWorkers(1))
+	shutdownCh := make(chan struct{})
+	hc.Start(shutdownCh)
+	defer close(shutdownCh)
+
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool { return probes.Load() == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, int32(1), maxRunning.Load())
+}
+
+func TestHealthCheckSubscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+
+	bg := &config.BackendGroup{
+		Name:    "test",
+		Lb:      loadbalancer.NewRoundRobin([]*url.URL{backend}),
+		Servers: []*url.URL{backend},
+		HealthCheck: &config.HealthCheck{
+			Type:               config.HTTPHealthCheck,
+			Path:               "/health",
+			Method:             http.MethodGet,
+			ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+			Interval:           10 * time.Second,
+			Timeout:            time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+		},
+	}
+	clock := newFakeClock()
+	hc := proxy.NewHealthChecker([]*config.BackendGroup{bg}, &proxy.HttpClient{Client: &http.Client{}}, zap.NewNop().Sugar(),
+		proxy.WithHealthCheckClock(clock))
+	events := make(chan proxy.HealthEvent, 1)
+	hc.Subscribe(func(event proxy.HealthEvent) { events <- event })
+	shutdownCh := make(chan struct{})
+	hc.Start(shutdownCh)
+	defer close(shutdownCh)
+
+	clock.Advance(10 * time.Second)
+	select {
+	case event := <-events:
+		require.Equal(t, "test", event.BackendGroup)
+		require.Equal(t, backend.String(), event.Backend)
+		require.Equal(t, proxy.Healthy, event.OldState)
+		require.Equal(t, proxy.Unhealthy, event.NewState)
+		require.Contains(t, event.Reason, "unexpected status code 503")
+		require.Equal(t, clock.Now(), event.Timestamp)
+	case <-time.After(time.Second):
+		t.Fatal("no health event")
+	}
+}
+
+func startHealthCheckerWithClock(t *testing.T, clock proxy.Clock, backendGroups ...*config.BackendGroup) {
+	t.Helper()
+	hc := proxy.NewHealthChecker(backendGroups, &proxy.HttpClient{Client: &http.Client{}}, zap.NewNop().Sugar(),
+		proxy.WithHealthCheckClock(clock))
+	shutdownCh := make(chan struct{})
+	hc.Start(shutdownCh)
+	t.Cleanup(func() { close(shutdownCh) })
+}
+
+// isHealthy tells whether the load balancer has a backend to pick.
+func isHealthy(lb loadbalancer.LoadBalancer) bool {
+	_, _, err := lb.Pick(request.ServerRequest{Request: httptest.NewRequest("GET", "/", nil)})
+	return err == nil
+}
+
+// fakeClock only moves forward when it is advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeTimer{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// startHealthChecker checks the health of the servers and returns the load
+// balancer reflecting their status.
+func startHealthChecker(t *testing.T, servers []*url.URL, params *config.HealthCheck) *loadbalancer.RoundRobin {
+	t.Helper()
+	lb := loadbalancer.NewRoundRobin(servers)
+	bg := &config.BackendGroup{Name: "test", Lb: lb, Servers: servers, HealthCheck: params}
+
+	hc := proxy.NewHealthChecker([]*config.BackendGroup{bg}, &proxy.HttpClient{Client: &http.Client{}}, zap.NewNop().Sugar())
+	shutdownCh := make(chan struct{})
+	hc.Start(shutdownCh)
+	t.Cleanup(func() { close(shutdownCh) })
+	return lb
+}
+
+// requireOnlyPicked waits until the load balancer only picks the given backend.
+func requireOnlyPicked(t *testing.T, lb loadbalancer.LoadBalancer, backend *url.URL) {
+	t.Helper()
+	req := request.ServerRequest{Request: httptest.NewRequest("GET", "/", nil)}
+	require.Eventually(t, func() bool {
+		for i := 0; i < 4; i++ {
+			picked, _, err := lb.Pick(req)
+			require.NoError(t, err)
+			if picked.String() != backend.String() {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+// startTCPServer answers every line it receives with reply.
+func startTCPServer(t *testing.T, reply string) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					io.WriteString(conn, reply)
+				}
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// startGRPCHealthServer starts an h2c server implementing the Check method of
+// grpc.health.v1.Health, reporting status for service.
+func startGRPCHealthServer(t *testing.T, service string, status byte) *url.URL {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" ||
+			r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		// HealthCheckRequest{service} framed with a 5 bytes prefix
+		wanted := append([]byte{0x0a, byte(len(service))}, service...)
+		if len(body) < 5 || string(body[5:]) != string(wanted) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "5") // NOT_FOUND
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		msg := []byte{0x08, status} // HealthCheckResponse{status}
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	return u
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import "time"
+
+// HealthState is the health of a backend as reported by its health check.
+type HealthState string
+
+const (
+	Healthy   HealthState = "healthy"
+	Unhealthy HealthState = "unhealthy"
+)
+
+func healthState(healthy bool) HealthState {
+	if healthy {
+		return Healthy
+	}
+	return Unhealthy
+}
+
+// HealthEvent is a change of the health of a backend of a backend group.
+type HealthEvent struct {
+	BackendGroup string      `json:"backend_group"`
+	Backend      string      `json:"backend"`
+	OldState     HealthState `json:"old_state"`
+	NewState     HealthState `json:"new_state"`
+	Reason       string      `json:"reason"`
+	Timestamp    time.Time   `json:"timestamp"`
+}
+
+// Subscribe registers a function called on every change of the health of a
+// backend. The changes of a backend are received in order.
+//
+// The function is called from the health check workers, so it should hand
+// slow work over to another goroutine, and it must not call Subscribe or the
+// returned unsubscribe function.
+func (hc *HealthChecker) Subscribe(fn func(HealthEvent)) (unsubscribe func()) {
+	hc.subscribersMu.Lock()
+	defer hc.subscribersMu.Unlock()
+	id := hc.nextID
+	hc.nextID++
+	hc.subscribers[id] = fn
+
+	return func() {
+		hc.subscribersMu.Lock()
+		defer hc.subscribersMu.Unlock()
+		delete(hc.subscribers, id)
+	}
+}
+
+// publishEvents sends the pending events to the subscribers.
+// It must be called with hc.mu held, which it releases.
+func (hc *HealthChecker) publishEvents() {
+	events := hc.events
+	hc.events = nil
+	// take the subscribers lock before releasing hc.mu so that a later
+	// change cannot be published before this one
+	hc.subscribersMu.Lock()
+	defer hc.subscribersMu.Unlock()
+	hc.mu.Unlock()
+
+	for _, event := range events {
+		for _, fn := range hc.subscribers {
+			fn(event)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"go.uber.org/zap"
+)
+
+// portListener serves the proxy on a port of the config.
+type portListener struct {
+	port     int // as configured, 0 for any port
+	listener net.Listener
+	server   *http.Server
+}
+
+// listeners serve the proxy on the port of the latest config. When a reload
+// changes the port, the new port is bound before the config is committed, so
+// that the reload fails if it cannot be, and the previous listener is drained
+// once the new one serves requests.
+type listeners struct {
+	handler http.Handler
+	logger  *zap.SugaredLogger
+
+	mu       sync.Mutex // protects the fields below
+	current  *portListener
+	pending  *portListener // bound by prepare, served by apply
+	draining []*portListener
+	stopped  bool
+	errCh    chan error // receives why the current listener stopped serving
+}
+
+func newListeners(handler http.Handler, logger *zap.SugaredLogger) *listeners {
+	return &listeners{handler: handler, logger: logger, errCh: make(chan error, 1)}
+}
+
+// serve binds port and serves it until the listeners are stopped, and returns
+// http.ErrServerClosed then.
+func (l *listeners) serve(port int) error {
+	pl, err := l.listen(port)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		pl.listener.Close()
+		return http.ErrServerClosed
+	}
+	l.current = pl
+	l.mu.Unlock()
+
+	l.logger.Infow("Proxy listening", "port", port, "address", pl.listener.Addr().String())
+	l.start(pl)
+	return <-l.errCh
+}
+
+func (l *listeners) listen(port int) (*portListener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	return &portListener{
+		port:     port,
+		listener: listener,
+		server:   &http.Server{Handler: l.handler},
+	}, nil
+}
+
+func (l *listeners) start(pl *portListener) {
+	go func() {
+		err := pl.server.Serve(pl.listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.current == pl {
+			l.stop(err)
+		}
+	}()
+}
+
+// prepare binds the port of cfg if it changed, so that the reload fails if the
+// port cannot be bound. It is a load hook.
+func (l *listeners) prepare(cfg *config.Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending != nil {
+		// left behind by a reload that failed after prepare
+		l.pending.listener.Close()
+		l.pending = nil
+	}
+	if l.current == nil || l.stopped || cfg.Port == l.current.port {
+		return nil
+	}
+	pl, err := l.listen(cfg.Port)
+	if err != nil {
+		return err
+	}
+	l.pending = pl
+	return nil
+}
+
+// apply serves the listener bound by prepare, if any, and drains the previous
+// one. It is a reload hook.
+func (l *listeners) apply(prev, next *config.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pl := l.pending
+	if pl == nil || pl.port != next.Port {
+		return
+	}
+	l.pending = nil
+	old := l.current
+	l.current = pl
+	l.start(pl)
+	l.logger.Infow("Listener changed",
+		"old_port", old.port, "old_address", old.listener.Addr().String(),
+		"new_port", pl.port, "new_address", pl.listener.Addr().String())
+
+	// stop accepting connections on the previous port and let the requests in
+	// flight finish
+	l.draining = append(l.draining, old)
+	go func() {
+		if err := old.server.Shutdown(context.Background()); err != nil {
+			l.logger.Warnw("Failed to drain listener", "port", old.port, "err", err)
+		}
+		l.mu.Lock()
+		l.draining = slices.DeleteFunc(l.draining, func(d *portListener) bool { return d == old })
+		l.mu.Unlock()
+		l.logger.Infow("Listener closed", "port", old.port, "address", old.listener.Addr().String())
+	}()
+}
+
+func (l *listeners) addr() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil {
+		return ""
+	}
+	return l.current.listener.Addr().String()
+}
+
+// shutdown gracefully shuts down every listener, see http.Server.Shutdown.
+func (l *listeners) shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	servers := make([]*http.Server, 0, len(l.draining)+1)
+	if l.current != nil {
+		servers = append(servers, l.current.server)
+	}
+	for _, pl := range l.draining {
+		servers = append(servers, pl.server)
+	}
+	if l.pending != nil {
+		l.pending.listener.Close()
+		l.pending = nil
+	}
+	l.stop(http.ErrServerClosed)
+	l.mu.Unlock()
+
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// stop makes serve return err. It must be called with l.mu held.
+func (l *listeners) stop(err error) {
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	l.errCh <- err
+}
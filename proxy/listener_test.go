@@ -0,0 +1,84 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/proxy"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReloadRebindsListener(t *testing.T) {
+	cfg := newGroupConfig("backend1.io")
+	cfg.Admin = nil
+	cfg.Port = freePort(t)
+	src := &switchingSource{cfg: cfg}
+	p := proxy.NewProxy(src, NewBackendClientMock(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	admin := proxy.NewAdminServer(p, &config.Admin{Token: "secret"}, zap.NewNop().Sugar()).Handler()
+	reload := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/reload", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Start() }()
+	require.Eventually(t, func() bool { return p.GetAddr() != "" }, 2*time.Second, 10*time.Millisecond)
+	oldPort := cfg.Port
+	require.Equal(t, "backend1.io", get(t, oldPort))
+
+	// a port that cannot be bound fails the reload
+	busy, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer busy.Close()
+	next := newGroupConfig("backend2.io")
+	next.Admin = nil
+	next.Port = busy.Addr().(*net.TCPAddr).Port
+	src.set(next)
+	w := reload()
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Contains(t, w.Body.String(), fmt.Sprintf("failed to listen on port %d", next.Port))
+	require.Equal(t, "backend1.io", get(t, oldPort))
+
+	next.Port = freePort(t)
+	src.set(next)
+	require.Equal(t, http.StatusOK, reload().Code)
+	require.Equal(t, "backend2.io", get(t, next.Port))
+	require.Contains(t, p.GetAddr(), fmt.Sprintf(":%d", next.Port))
+	require.Eventually(t, func() bool {
+		_, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", oldPort))
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, p.Stop())
+	require.ErrorIs(t, <-errCh, http.ErrServerClosed)
+}
+
+// freePort returns a port that is free to be bound.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func get(t *testing.T, port int) string {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"go.uber.org/zap"
+)
+
+// membership records the servers added to and removed from backend groups at
+// runtime, so that the changes survive config reloads and, when the admin
+// config has a state file, restarts.
+//
+// Runtime changes take precedence over the config source: they are applied on
+// top of every config loaded from it until they are undone at runtime. A
+// change is forgotten once the config source agrees with it, that is when an
+// added server gets listed in the config or a removed server is no longer
+// listed. From then on, the server is managed by the config source alone.
+// Changes to backend groups that are removed from the config are forgotten too.
+type membership struct {
+	logger *zap.SugaredLogger
+	mu     sync.Mutex // protects all the fields below
+	loaded bool       // whether the state file has been read
+	path   string     // state file, empty when changes are not persisted
+	groups map[string]*membershipChanges
+}
+
+// membershipChanges are the changes to a backend group, as stored in the
+// state file. Servers are identified by their URL.
+type membershipChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+type membershipState struct {
+	BackendGroups map[string]*membershipChanges `json:"backend_groups"`
+}
+
+func newMembership(logger *zap.SugaredLogger) *membership {
+	return &membership{logger: logger, groups: make(map[string]*membershipChanges)}
+}
+
+// apply applies the runtime changes to a config freshly loaded from the
+// config source. The state file is read the first time, so its path can only
+// change on restart.
+func (m *membership) apply(cfg *config.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.loaded {
+		if cfg.Admin != nil && cfg.Admin.StateFile != "" {
+			if err := m.read(cfg.Admin.StateFile); err != nil {
+				return err
+			}
+		}
+		m.loaded = true
+	}
+
+	changed := false
+	for name, changes := range m.groups {
+		i := slices.IndexFunc(cfg.BackendGroups, func(bg *config.BackendGroup) bool { return bg.Name == name })
+		if i < 0 {
+			m.logger.Warnw("Backend group removed from the config, forgetting its runtime changes", "backend_group", name)
+			delete(m.groups, name)
+			changed = true
+			continue
+		}
+		bg := *cfg.BackendGroups[i]
+		lb, ok := bg.Lb.(loadbalancer.Membership)
+		if !ok {
+			return fmt.Errorf("load balancer of backend group %q does not support adding or removing servers", name)
+		}
+		listed := make(map[string]bool)
+		for _, server := range bg.AllServers() {
+			listed[server.String()] = true
+		}
+
+		added := changes.Added[:0]
+		for _, server := range changes.Added {
+			if listed[server] {
+				m.logger.Infow("Server added at runtime is now in the config", "backend_group", name, "backend", server)
+				changed = true
+				continue
+			}
+			u, err := parseServer(server)
+			if err != nil {
+				m.logger.Warnw("Ignoring invalid server of the state file", "backend_group", name, "err", err)
+				changed = true
+				continue
+			}
+			added = append(added, server)
+			bg.Servers = append(slices.Clip(bg.Servers), u)
+			lb.AddBackend(u)
+		}
+		removed := changes.Removed[:0]
+		for _, server := range changes.Removed {
+			if !listed[server] {
+				m.logger.Infow("Server removed at runtime is no longer in the config", "backend_group", name, "backend", server)
+				changed = true
+				continue
+			}
+			if len(bg.AllServers()) == 1 {
+				// like RemoveServer, never leave the group without servers
+				m.logger.Warnw("Not removing the last server of the backend group, forgetting its runtime removal",
+					"backend_group", name, "backend", server)
+				changed = true
+				continue
+			}
+			removed = append(removed, server)
+			bg.Servers = withoutServer(bg.Servers, server)
+			bg.BackupServers = withoutServer(bg.BackupServers, server)
+			u, _ := url.Parse(server)
+			lb.RemoveBackend(u)
+		}
+		changes.Added, changes.Removed = added, removed
+		if len(added) == 0 && len(removed) == 0 {
+			delete(m.groups, name)
+		}
+		replaceBackendGroup(cfg, &bg)
+	}
+
+	if changed {
+		if err := m.write(); err != nil {
+			m.logger.Errorw("Failed to save runtime changes", "state_file", m.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// add records that the server was added to the backend group.
+func (m *membership) add(backendGroup, server string) error {
+	return m.change(backendGroup, func(changes *membershipChanges) {
+		if i := slices.Index(changes.Removed, server); i >= 0 {
+			changes.Removed = slices.Delete(changes.Removed, i, i+1)
+			return
+		}
+		changes.Added = append(changes.Added, server)
+	})
+}
+
+// remove records that the server was removed from the backend group.
+func (m *membership) remove(backendGroup, server string) error {
+	return m.change(backendGroup, func(changes *membershipChanges) {
+		if i := slices.Index(changes.Added, server); i >= 0 {
+			changes.Added = slices.Delete(changes.Added, i, i+1)
+			return
+		}
+		changes.Removed = append(changes.Removed, server)
+	})
+}
+
+// change applies fn to the changes of the backend group and saves them,
+// leaving them untouched if they cannot be saved.
+func (m *membership) change(backendGroup string, fn func(changes *membershipChanges)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.groups[backendGroup]
+	changes := &membershipChanges{}
+	if prev != nil {
+		changes.Added = slices.Clone(prev.Added)
+		changes.Removed = slices.Clone(prev.Removed)
+	}
+	fn(changes)
+	m.groups[backendGroup] = changes
+	if len(changes.Added) == 0 && len(changes.Removed) == 0 {
+		delete(m.groups, backendGroup)
+	}
+
+	if err := m.write(); err != nil {
+		if prev != nil {
+			m.groups[backendGroup] = prev
+		} else {
+			delete(m.groups, backendGroup)
+		}
+		return fmt.Errorf("failed to save state file: %w", err)
+	}
+	return nil
+}
+
+// isAdded tells whether the server was added to the backend group at runtime.
+func (m *membership) isAdded(backendGroup, server string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes, ok := m.groups[backendGroup]
+	return ok && slices.Contains(changes.Added, server)
+}
+
+// read must be called with m.mu held.
+func (m *membership) read(path string) error {
+	m.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state membershipState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	for name, changes := range state.BackendGroups {
+		if changes != nil {
+			m.groups[name] = changes
+		}
+	}
+	return nil
+}
+
+// write replaces the state file, if any, atomically so that a crash cannot
+// leave it half written. It must be called with m.mu held.
+func (m *membership) write() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(membershipState{BackendGroups: m.groups}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// replaceBackendGroup replaces the backend group of cfg that has the same name
+// as bg, including in the rules. The slices of cfg are copied, not modified.
+func replaceBackendGroup(cfg *config.Config, bg *config.BackendGroup) {
+	cfg.BackendGroups = slices.Clone(cfg.BackendGroups)
+	for i, candidate := range cfg.BackendGroups {
+		if candidate.Name == bg.Name {
+			cfg.BackendGroups[i] = bg
+		}
+	}
+	cfg.Rules = slices.Clone(cfg.Rules)
+	for i, rule := range cfg.Rules {
+		if rule.BackendGroup != nil && rule.BackendGroup.Name == bg.Name {
+			updated := *rule
+			updated.BackendGroup = bg
+			cfg.Rules[i] = &updated
+		}
+	}
+}
+
+func withoutServer(servers []*url.URL, server string) []*url.URL {
+	return slices.DeleteFunc(slices.Clone(servers), func(u *url.URL) bool { return u.String() == server })
+}
+
+// parseServer parses the address of a server with the rules of the servers of
+// the config, see config.ValidateServers.
+func parseServer(address string) (*url.URL, error) {
+	if errs := config.ValidateServers([]string{address}, nil); len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", errInvalidAddress, errs[0].Message)
+	}
+	return config.ParseServers([]string{address})[0], nil
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"go.uber.org/zap"
+)
+
+// notificationQueueSize is the number of events waiting for delivery above
+// which new events are dropped.
+const notificationQueueSize = 256
+
+// WebhookNotifier posts health events as JSON to the webhook of the
+// notifications config, one at a time and in order.
+type WebhookNotifier struct {
+	logger *zap.SugaredLogger
+	client *http.Client
+	queue  chan HealthEvent
+	mu     sync.Mutex // protects all the fields below
+	params *config.Notifications
+	// token bucket limiting the events sent to MaxEventsPerMinute
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewWebhookNotifier returns a notifier that drops all events while params is nil.
+func NewWebhookNotifier(params *config.Notifications, logger *zap.SugaredLogger) *WebhookNotifier {
+	n := &WebhookNotifier{
+		logger: logger,
+		client: &http.Client{},
+		queue:  make(chan HealthEvent, notificationQueueSize),
+	}
+	n.Update(params)
+	return n
+}
+
+// Start starts delivering the events.
+func (n *WebhookNotifier) Start(shutdownCh chan struct{}) {
+	go n.deliver(shutdownCh)
+}
+
+// Update replaces the notifications config, typically after a config reload.
+func (n *WebhookNotifier) Update(params *config.Notifications) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if params != nil && (n.params == nil || params.MaxEventsPerMinute != n.params.MaxEventsPerMinute) {
+		n.tokens = float64(params.MaxEventsPerMinute)
+		n.lastRefill = time.Now()
+	}
+	n.params = params
+}
+
+// Notify queues the event for delivery. It does not block, events are dropped
+// when notifications are disabled, rate limited or when the queue is full.
+// It can be passed to HealthChecker.Subscribe.
+func (n *WebhookNotifier) Notify(event HealthEvent) {
+	n.mu.Lock()
+	enabled := n.params != nil
+	allowed := enabled && n.take(time.Now())
+	n.mu.Unlock()
+	if !enabled {
+		return
+	}
+	if !allowed {
+		n.logger.Warnw("Health event not notified, rate limit exceeded",
+			"backend_group", event.BackendGroup, "backend", event.Backend)
+		return
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		n.logger.Warnw("Health event not notified, too many events are waiting for delivery",
+			"backend_group", event.BackendGroup, "backend", event.Backend)
+	}
+}
+
+// take must be called with n.mu held.
+func (n *WebhookNotifier) take(now time.Time) bool {
+	limit := float64(n.params.MaxEventsPerMinute)
+	n.tokens = min(limit, n.tokens+now.Sub(n.lastRefill).Minutes()*limit)
+	n.lastRefill = now
+	if n.tokens < 1 {
+		return false
+	}
+	n.tokens--
+	return true
+}
+
+func (n *WebhookNotifier) deliver(shutdownCh chan struct{}) {
+	for {
+		select {
+		case event := <-n.queue:
+			n.send(event, shutdownCh)
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// send posts the event, retrying with an exponential backoff on failure.
+func (n *WebhookNotifier) send(event HealthEvent, shutdownCh chan struct{}) {
+	n.mu.Lock()
+	params := n.params
+	n.mu.Unlock()
+	if params == nil {
+		// notifications have been disabled by a reload
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Errorw("Failed to encode health event", "err", err)
+		return
+	}
+
+	backoff := params.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(params, body)
+		if err == nil {
+			return
+		}
+		if attempt == params.MaxRetries || !retryable(err) {
+			n.logger.Errorw("Failed to notify health event", "webhook_url", config.RedactURL(params.WebhookURL),
+				"backend_group", event.BackendGroup, "backend", event.Backend, "attempts", attempt+1, "err", err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// webhookStatusError is returned when the webhook answers with an error status.
+type webhookStatusError struct {
+	statusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook answered with status %d", e.statusCode)
+}
+
+// retryable tells whether a failed delivery may succeed later, which is not
+// the case when the webhook rejects the event.
+func retryable(err error) bool {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.statusCode >= 500 || statusErr.statusCode == http.StatusTooManyRequests
+}
+
+func (n *WebhookNotifier) post(params *config.Notifications, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), params.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, params.WebhookURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range params.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// the errors of the client contain the URL, which is redacted
+		// since they are logged
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = config.RedactURL(params.WebhookURL)
+		}
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &webhookStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/proxy"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWebhookNotifierSendsEvent(t *testing.T) {
+	type request struct {
+		method, contentType, authorization string
+		event                              proxy.HealthEvent
+	}
+	received := make(chan request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, contentType: r.Header.Get("Content-Type"), authorization: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&req.event)
+		received <- req
+	}))
+	defer receiver.Close()
+
+	params := newNotifications(t, receiver.URL)
+	params.Headers = http.Header{"Authorization": {"Bearer secret"}}
+	notifier := startNotifier(t, params)
+
+	event := proxy.HealthEvent{
+		BackendGroup: "group",
+		Backend:      "http://localhost:9000",
+		OldState:     proxy.Healthy,
+		NewState:     proxy.Unhealthy,
+		Reason:       "failed 3 consecutive health checks",
+		Timestamp:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	notifier.Notify(event)
+
+	select {
+	case req := <-received:
+		require.Equal(t, http.MethodPost, req.method)
+		require.Equal(t, "application/json", req.contentType)
+		require.Equal(t, "Bearer secret", req.authorization)
+		require.Equal(t, event, req.event)
+	case <-time.After(time.Second):
+		t.Fatal("event not received")
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	notifier := startNotifier(t, newNotifications(t, receiver.URL))
+	notifier.Notify(proxy.HealthEvent{BackendGroup: "group"})
+
+	require.Eventually(t, func() bool { return attempts.Load() == 3 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(3), attempts.Load())
+}
+
+func TestWebhookNotifierDoesNotRetryRejectedEvents(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	notifier := startNotifier(t, newNotifications(t, receiver.URL))
+	notifier.Notify(proxy.HealthEvent{BackendGroup: "group"})
+
+	require.Eventually(t, func() bool { return attempts.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWebhookNotifierRateLimit(t *testing.T) {
+	var received atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer receiver.Close()
+
+	params := newNotifications(t, receiver.URL)
+	params.MaxEventsPerMinute = 2
+	notifier := startNotifier(t, params)
+	for range 5 {
+		notifier.Notify(proxy.HealthEvent{BackendGroup: "group"})
+	}
+
+	require.Eventually(t, func() bool { return received.Load() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(2), received.Load())
+}
+
+func TestWebhookNotifierRedactsURLInLogs(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, webhookURL := range []string{receiver.URL, closed.URL} {
+		core, logs := observer.New(zap.ErrorLevel)
+		u, err := url.Parse(webhookURL)
+		require.NoError(t, err)
+		u.User = url.UserPassword("user", "secret")
+		u.RawQuery = "token=secret"
+		params := newNotifications(t, u.String())
+		params.MaxRetries = 0
+		notifier := proxy.NewWebhookNotifier(params, zap.New(core).Sugar())
+		shutdownCh := make(chan struct{})
+		notifier.Start(shutdownCh)
+		notifier.Notify(proxy.HealthEvent{BackendGroup: "group"})
+
+		require.Eventually(t, func() bool { return logs.Len() == 1 }, time.Second, time.Millisecond)
+		close(shutdownCh)
+		entry := logs.All()[0]
+		require.NotContains(t, fmt.Sprint(entry.ContextMap()), "secret")
+		require.Contains(t, entry.ContextMap()["webhook_url"], "?<redacted>")
+	}
+}
+
+func newNotifications(t *testing.T, webhookURL string) *config.Notifications {
+	t.Helper()
+	u, err := url.Parse(webhookURL)
+	require.NoError(t, err)
+	return &config.Notifications{
+		WebhookURL:         u,
+		Timeout:            time.Second,
+		MaxRetries:         3,
+		RetryBackoff:       time.Millisecond,
+		MaxEventsPerMinute: 60,
+	}
+}
+
+func startNotifier(t *testing.T, params *config.Notifications) *proxy.WebhookNotifier {
+	t.Helper()
+	notifier := proxy.NewWebhookNotifier(params, zap.NewNop().Sugar())
+	shutdownCh := make(chan struct{})
+	notifier.Start(shutdownCh)
+	t.Cleanup(func() { close(shutdownCh) })
+	return notifier
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
+	"go.uber.org/zap"
+)
+
+// OutlierDetector ejects backends from the load balancing pool based on the
+// responses to the requests they serve, which catches failing backends much
+// faster than periodic health checks.
+type OutlierDetector struct {
+	logger        *zap.SugaredLogger
+	failover      *failover  // set by the proxy, nil otherwise
+	mu            sync.Mutex // protects all the fields below
+	backendGroups []*config.BackendGroup
+	stats         map[string]map[string]*outlierStats // backendGroup -> backend -> stats
+	sweepers      map[string]*sweeper                 // backendGroup -> running sweeper
+	shutdownCh    chan struct{}                       // nil until Start is called
+}
+
+type outlierStats struct {
+	consecutive5xx              int
+	consecutiveConnectionErrors int
+	// requests and successes since the last sweep
+	requests  int
+	successes int
+	// ejections is the multiplier of the base ejection time. It is increased
+	// on every ejection and decreased on every sweep where the backend is not
+	// ejected, so that backends that keep failing are ejected for longer.
+	ejections    int
+	ejected      bool
+	ejectedUntil time.Time
+}
+
+// sweeper is a goroutine periodically unejecting backends and running the
+// success rate analysis of a backend group.
+type sweeper struct {
+	params *config.OutlierDetection
+	stopCh chan struct{}
+}
+
+func NewOutlierDetector(backendGroups []*config.BackendGroup, logger *zap.SugaredLogger) *OutlierDetector {
+	od := &OutlierDetector{
+		logger:   logger,
+		stats:    make(map[string]map[string]*outlierStats),
+		sweepers: make(map[string]*sweeper),
+	}
+	od.Update(backendGroups)
+	return od
+}
+
+// Start starts the periodic sweeps of every backend group with outlier detection.
+func (od *OutlierDetector) Start(shutdownCh chan struct{}) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	od.shutdownCh = shutdownCh
+	od.syncSweepers()
+}
+
+// Update replaces the backend groups being monitored, typically after a config reload.
+//
+// Backends that are still part of the same backend group keep their
+// statistics and ejection state, which is also applied to the load balancer of the group.
+func (od *OutlierDetector) Update(backendGroups []*config.BackendGroup) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	stats := make(map[string]map[string]*outlierStats)
+	for _, bg := range backendGroups {
+		if bg.OutlierDetection == nil {
+			continue
+		}
+		if stats[bg.Name] == nil {
+			stats[bg.Name] = make(map[string]*outlierStats)
+		}
+		for _, backend := range bg.AllServers() {
+			key := backend.String()
+			s, ok := od.stats[bg.Name][key]
+			if !ok {
+				s = &outlierStats{}
+			}
+			stats[bg.Name][key] = s
+
+			// both ways: the load balancer may have inherited an ejection
+			// that changed since from the previous load balancer
+			if lb, ok := bg.Lb.(loadbalancer.EjectionAware); ok {
+				lb.SetEjected(backend, s.ejected)
+			}
+		}
+	}
+
+	od.backendGroups = backendGroups
+	od.stats = stats
+	od.syncSweepers()
+}
+
+// syncSweepers starts and stops sweepers so that there is exactly one sweeper
+// per backend group with outlier detection. It must be called with od.mu held.
+func (od *OutlierDetector) syncSweepers() {
+	if od.shutdownCh == nil {
+		return
+	}
+
+	wanted := make(map[string]*config.OutlierDetection)
+	for _, bg := range od.backendGroups {
+		if bg.OutlierDetection != nil {
+			wanted[bg.Name] = bg.OutlierDetection
+		}
+	}
+
+	for name, s := range od.sweepers {
+		if params, ok := wanted[name]; !ok || *params != *s.params {
+			close(s.stopCh)
+			delete(od.sweepers, name)
+		}
+	}
+	for name, params := range wanted {
+		if _, ok := od.sweepers[name]; ok {
+			continue
+		}
+		s := &sweeper{params: params, stopCh: make(chan struct{})}
+		od.sweepers[name] = s
+		go od.sweepPeriodically(name, params.Interval, s.stopCh, od.shutdownCh)
+	}
+}
+
+func (od *OutlierDetector) sweepPeriodically(backendGroup string, interval time.Duration, stopCh, shutdownCh chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			od.sweep(backendGroup, time.Now())
+		case <-stopCh:
+			return
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// IsEjected tells whether the backend of the backend group is currently ejected.
+func (od *OutlierDetector) IsEjected(backendGroup, backend string) bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	s, ok := od.stats[backendGroup][backend]
+	return ok && s.ejected
+}
+
+// Record accounts for the outcome of a request proxied to a backend.
+// err is the error returned by the backend client, if any.
+func (od *OutlierDetector) Record(bg *config.BackendGroup, backend *url.URL, statusCode int, err error) {
+	if bg.OutlierDetection == nil {
+		return
+	}
+	params := bg.OutlierDetection
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	s, ok := od.stats[bg.Name][backend.String()]
+	if !ok {
+		// the backend has been removed by a reload while the request was in flight
+		return
+	}
+
+	s.requests++
+	switch {
+	case err != nil:
+		s.consecutive5xx++
+		s.consecutiveConnectionErrors++
+	case statusCode >= 500:
+		s.consecutive5xx++
+		s.consecutiveConnectionErrors = 0
+	default:
+		s.successes++
+		s.consecutive5xx = 0
+		s.consecutiveConnectionErrors = 0
+		return
+	}
+
+	if params.ConsecutiveConnectionErrors > 0 && s.consecutiveConnectionErrors >= params.ConsecutiveConnectionErrors {
+		od.eject(bg.Name, backend.String(), "consecutive connection errors", time.Now())
+	} else if params.Consecutive5xx > 0 && s.consecutive5xx >= params.Consecutive5xx {
+		od.eject(bg.Name, backend.String(), "consecutive 5xx", time.Now())
+	}
+}
+
+// sweep unejects the backends whose ejection time is over and ejects the
+// backends with an abnormally low success rate.
+func (od *OutlierDetector) sweep(backendGroup string, now time.Time) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	bg := od.backendGroup(backendGroup)
+	if bg == nil {
+		return
+	}
+	params := bg.OutlierDetection
+
+	for backend, s := range od.stats[backendGroup] {
+		if s.ejected && !now.Before(s.ejectedUntil) {
+			od.uneject(bg, backend)
+		} else if !s.ejected && s.ejections > 0 {
+			s.ejections--
+		}
+	}
+
+	if params.SuccessRateStdevFactor > 0 {
+		od.ejectLowSuccessRates(bg, now)
+	}
+
+	for _, s := range od.stats[backendGroup] {
+		s.requests = 0
+		s.successes = 0
+	}
+}
+
+// ejectLowSuccessRates must be called with od.mu held.
+func (od *OutlierDetector) ejectLowSuccessRates(bg *config.BackendGroup, now time.Time) {
+	params := bg.OutlierDetection
+
+	rates := make(map[string]float64)
+	var sum float64
+	for backend, s := range od.stats[bg.Name] {
+		if s.ejected || s.requests < params.SuccessRateRequestVolume {
+			continue
+		}
+		rates[backend] = float64(s.successes) / float64(s.requests)
+		sum += rates[backend]
+	}
+	if len(rates) == 0 || len(rates) < params.SuccessRateMinimumHosts {
+		return
+	}
+
+	mean := sum / float64(len(rates))
+	var variance float64
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(rates)))
+	threshold := mean - params.SuccessRateStdevFactor*stdev
+
+	for backend, rate := range rates {
+		if rate < threshold {
+			od.eject(bg.Name, backend, "low success rate", now)
+		}
+	}
+}
+
+// eject must be called with od.mu held.
+func (od *OutlierDetector) eject(backendGroup, backend, reason string, now time.Time) {
+	bg := od.backendGroup(backendGroup)
+	if bg == nil {
+		return
+	}
+	params := bg.OutlierDetection
+	s := od.stats[backendGroup][backend]
+	if s.ejected {
+		return
+	}
+
+	ejected := 0
+	for _, other := range od.stats[backendGroup] {
+		if other.ejected {
+			ejected++
+		}
+	}
+	maxEjected := max(1, len(od.stats[backendGroup])*params.MaxEjectionPercent/100)
+	if ejected >= maxEjected {
+		od.logger.Warnw("Backend not ejected, too many backends are ejected already",
+			"backend_group", backendGroup, "backend", backend, "reason", reason)
+		return
+	}
+
+	s.ejections++
+	ejectionTime := min(params.BaseEjectionTime*time.Duration(s.ejections), params.MaxEjectionTime)
+	s.ejected = true
+	s.ejectedUntil = now.Add(ejectionTime)
+	s.consecutive5xx = 0
+	s.consecutiveConnectionErrors = 0
+	od.logger.Warnw("Backend ejected", "backend_group", backendGroup, "backend", backend,
+		"reason", reason, "ejection_time", ejectionTime)
+	od.setEjected(bg, backend, true)
+}
+
+// uneject must be called with od.mu held.
+func (od *OutlierDetector) uneject(bg *config.BackendGroup, backend string) {
+	od.stats[bg.Name][backend].ejected = false
+	od.logger.Infow("Backend unejected", "backend_group", bg.Name, "backend", backend)
+	od.setEjected(bg, backend, false)
+}
+
+// setEjected must be called with od.mu held.
+func (od *OutlierDetector) setEjected(bg *config.BackendGroup, backend string, ejected bool) {
+	lb, ok := bg.Lb.(loadbalancer.EjectionAware)
+	if !ok {
+		return
+	}
+	for _, server := range bg.AllServers() {
+		if server.String() == backend {
+			lb.SetEjected(server, ejected)
+		}
+	}
+	od.failover.update(bg)
+}
+
+// backendGroup must be called with od.mu held.
+func (od *OutlierDetector) backendGroup(name string) *config.BackendGroup {
+	for _, bg := range od.backendGroups {
+		if bg.Name == name && bg.OutlierDetection != nil {
+			return bg
+		}
+	}
+	return nil
+}
@@ -2,28 +2,43 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"math"
 	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
 	"github.com/mouad-eh/wasseet/request"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 type Proxy struct {
-	configManager *ConfigManager
-	healthChecker *HealthChecker
-	listener      net.Listener
-	server        *http.Server
-	client        BackendClient
-	logger        *zap.SugaredLogger
-	shutdownCh    chan struct{}
+	configManager   *ConfigManager
+	healthChecker   *HealthChecker
+	outlierDetector *OutlierDetector
+	notifier        *WebhookNotifier
+	admin           *AdminServer // nil when the admin API is disabled
+	membership      *membership
+	failover        *failover
+	inFlight        *inFlightCounter
+	drainMu         sync.Mutex                 // protects drained
+	drained         map[string]map[string]bool // backendGroup -> backend -> drained
+	listeners       *listeners
+	client          BackendClient
+	logger          *zap.SugaredLogger
+	shutdownCh      chan struct{}
 }
 
-func NewProxy(config config.Source, bc BackendClient) *Proxy {
+func NewProxy(configSrc config.Source, bc BackendClient) *Proxy {
 	loggerConfig := zap.Config{
 		Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
 		Development: true,
@@ -42,57 +57,305 @@ func NewProxy(config config.Source, bc BackendClient) *Proxy {
 
 	logger, _ := loggerConfig.Build()
 	sugaredLogger := logger.Sugar()
-	// healthChecker := NewHealthChecker(config.BackendGroups, bc, sugaredLogger)
-	configManager, err := NewConfigManager(config, sugaredLogger)
+	configManager, err := NewConfigManager(configSrc, sugaredLogger)
 	if err != nil {
 		sugaredLogger.Fatalf("failed to create config manager: %v", err)
 	}
-	return &Proxy{
-		server:        &http.Server{},
-		client:        bc,
-		configManager: configManager,
-		// healthChecker: healthChecker,
-		logger:     sugaredLogger,
-		shutdownCh: make(chan struct{}),
+	// the servers added and removed at runtime take precedence over the source
+	membership := newMembership(sugaredLogger)
+	if err := membership.apply(configManager.GetLatestConfig()); err != nil {
+		sugaredLogger.Fatalf("failed to apply runtime changes: %v", err)
+	}
+	configManager.OnLoad(membership.apply)
+	healthChecker := NewHealthChecker(configManager.GetLatestConfig().BackendGroups, bc, sugaredLogger)
+	outlierDetector := NewOutlierDetector(configManager.GetLatestConfig().BackendGroups, sugaredLogger)
+	failover := newFailover(sugaredLogger)
+	healthChecker.failover = failover
+	outlierDetector.failover = failover
+	failover.reload(configManager.GetLatestConfig().BackendGroups)
+	notifier := NewWebhookNotifier(configManager.GetLatestConfig().Notifications, sugaredLogger)
+	healthChecker.Subscribe(notifier.Notify)
+	p := &Proxy{
+		client:          bc,
+		configManager:   configManager,
+		healthChecker:   healthChecker,
+		outlierDetector: outlierDetector,
+		notifier:        notifier,
+		membership:      membership,
+		failover:        failover,
+		inFlight:        &inFlightCounter{counts: make(map[string]map[string]int)},
+		drained:         make(map[string]map[string]bool),
+		logger:          sugaredLogger,
+		shutdownCh:      make(chan struct{}),
+	}
+	if admin := configManager.GetLatestConfig().Admin; admin != nil {
+		p.admin = NewAdminServer(p, admin, sugaredLogger)
+	}
+	defaultServerMux := &http.ServeMux{}
+	defaultServerMux.Handle("/", p)
+	p.listeners = newListeners(defaultServerMux, sugaredLogger)
+	// last, so that a port is only bound once the other load hooks succeeded
+	configManager.OnLoad(p.listeners.prepare)
+	configManager.OnReload(p.listeners.apply)
+	configManager.OnRelease(p.closeIdleConnections)
+	configManager.OnReload(func(prev, next *config.Config) {
+		healthChecker.Update(next.BackendGroups)
+		outlierDetector.Update(next.BackendGroups)
+		notifier.Update(next.Notifications)
+		p.applyDrained(next)
+		failover.reload(next.BackendGroups)
+		if !reflect.DeepEqual(prev.Admin, next.Admin) {
+			sugaredLogger.Warnw("Admin API config changed, it will only be applied on restart")
+		}
+	})
+	return p
+}
+
+// closeIdleConnections closes the idle connections of the backend client once
+// a released version of the config used servers that the latest config no
+// longer has, so that their connections are not kept alive for nothing. The
+// client can only close all its idle connections, the others are reopened on
+// demand.
+func (p *Proxy) closeIdleConnections(released ConfigVersion) {
+	closer, ok := p.client.(interface{ CloseIdleConnections() })
+	if !ok {
+		return
+	}
+	latest := make(map[string]bool)
+	for _, bg := range p.configManager.GetLatestConfig().BackendGroups {
+		for _, server := range bg.AllServers() {
+			latest[server.String()] = true
+		}
+	}
+	for _, bg := range released.Config.BackendGroups {
+		for _, server := range bg.AllServers() {
+			if !latest[server.String()] {
+				p.logger.Debugw("Closing idle connections of removed servers", "version", released.Version, "server", server.String())
+				closer.CloseIdleConnections()
+				return
+			}
+		}
 	}
 }
 
 func (p *Proxy) Start() error {
 	p.configManager.Start(p.shutdownCh)
-	// p.healthChecker.Start(p.shutdownCh)
-	// start http server
-	defaultServerMux := &http.ServeMux{}
-	defaultServerMux.Handle("/", p)
-	p.server.Handler = defaultServerMux
+	p.healthChecker.Start(p.shutdownCh)
+	p.outlierDetector.Start(p.shutdownCh)
+	p.notifier.Start(p.shutdownCh)
+	if p.admin != nil {
+		if err := p.admin.Start(); err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
+		}
+	}
+	// serve until stopped, moving to the new port when a reload changes it
+	return p.listeners.serve(p.configManager.GetLatestConfig().Port)
+}
+
+func (p *Proxy) GetAddr() string {
+	return p.listeners.addr()
+}
+
+// GetHealthChecker returns the health checker of the proxy, e.g. to subscribe
+// to the changes of the health of the backends.
+func (p *Proxy) GetHealthChecker() *HealthChecker {
+	return p.healthChecker
+}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", p.configManager.GetLatestConfig().Port))
+// GetAdminAddr returns the address of the admin API, or an empty string when it is disabled.
+func (p *Proxy) GetAdminAddr() string {
+	if p.admin == nil {
+		return ""
+	}
+	return p.admin.GetAddr()
+}
+
+func (p *Proxy) Stop() error {
+	close(p.shutdownCh)
+	if p.admin != nil {
+		p.admin.Stop()
+	}
+	return p.listeners.shutdown(context.Background())
+}
+
+var (
+	errNotFound       = errors.New("not found")
+	errAlreadyExists  = errors.New("already exists")
+	errInvalidAddress = errors.New("invalid server address")
+	errLastServer     = errors.New("cannot remove the last server of a backend group")
+)
+
+// AddServer adds a server to a backend group, as a primary server. The change
+// is picked up by the load balancer and the health checker right away, and
+// kept across config reloads and restarts, see membership for the details.
+func (p *Proxy) AddServer(backendGroup, address string) (*url.URL, error) {
+	server, err := parseServer(address)
 	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+		return nil, err
 	}
-	p.listener = listener
+	err = p.configManager.update(func(cfg *config.Config) error {
+		bg, err := findBackendGroup(cfg, backendGroup)
+		if err != nil {
+			return err
+		}
+		if _, _, err := findServer(cfg, backendGroup, server.String()); err == nil {
+			return fmt.Errorf("server %q of backend group %q %w", server.String(), backendGroup, errAlreadyExists)
+		}
+		lb, ok := bg.Lb.(loadbalancer.Membership)
+		if !ok {
+			return fmt.Errorf("load balancer of backend group %q does not support adding servers", backendGroup)
+		}
+		if err := p.membership.add(backendGroup, server.String()); err != nil {
+			return err
+		}
+
+		updated := *bg
+		updated.Servers = append(slices.Clip(bg.Servers), server)
+		// ramp up the traffic from the very first request
+		if lb, ok := bg.Lb.(loadbalancer.SlowStarter); ok {
+			lb.SlowStart(server)
+		}
+		lb.AddBackend(server)
+		replaceBackendGroup(cfg, &updated)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.logger.Infow("Server added", "backend_group", backendGroup, "backend", server.String())
+	return server, nil
+}
 
-	if err := p.server.Serve(listener); err != nil {
+// RemoveServer removes a server from a backend group. The server is
+// identified by its host or by its URL. Like AddServer, the change is applied
+// right away and kept across config reloads and restarts.
+func (p *Proxy) RemoveServer(backendGroup, server string) error {
+	var removed *url.URL
+	err := p.configManager.update(func(cfg *config.Config) error {
+		bg, backend, err := findServer(cfg, backendGroup, server)
+		if err != nil {
+			return err
+		}
+		if len(bg.AllServers()) == 1 {
+			return fmt.Errorf("%w %q", errLastServer, backendGroup)
+		}
+		lb, ok := bg.Lb.(loadbalancer.Membership)
+		if !ok {
+			return fmt.Errorf("load balancer of backend group %q does not support removing servers", backendGroup)
+		}
+		if err := p.membership.remove(backendGroup, backend.String()); err != nil {
+			return err
+		}
+
+		updated := *bg
+		updated.Servers = withoutServer(bg.Servers, backend.String())
+		updated.BackupServers = withoutServer(bg.BackupServers, backend.String())
+		lb.RemoveBackend(backend)
+		replaceBackendGroup(cfg, &updated)
+		removed = backend
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+	p.logger.Infow("Server removed", "backend_group", backendGroup, "backend", removed.String())
 	return nil
 }
 
-func (p *Proxy) GetAddr() string {
-	if p.listener != nil {
-		return p.listener.Addr().String()
+func findBackendGroup(cfg *config.Config, backendGroup string) (*config.BackendGroup, error) {
+	for _, bg := range cfg.BackendGroups {
+		if bg.Name == backendGroup {
+			return bg, nil
+		}
 	}
-	return ""
+	return nil, fmt.Errorf("backend group %q %w", backendGroup, errNotFound)
 }
 
-func (p *Proxy) Stop() error {
-	close(p.shutdownCh)
-	return p.server.Shutdown(context.Background())
+// findServer finds a server of a backend group by its host or by its URL.
+func findServer(cfg *config.Config, backendGroup, server string) (*config.BackendGroup, *url.URL, error) {
+	bg, err := findBackendGroup(cfg, backendGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, backend := range bg.AllServers() {
+		if backend.Host == server || backend.String() == server {
+			return bg, backend, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("server %q of backend group %q %w", server, backendGroup, errNotFound)
+}
+
+// SetDrained drains a server of a backend group, so that it stops receiving
+// requests, or enables it again. The server is identified by its host or
+// by its URL. The state is kept across config reloads.
+func (p *Proxy) SetDrained(backendGroup, server string, drained bool) error {
+	// hold off reloads so that the new config cannot miss this change
+	p.configManager.reloadMu.Lock()
+	defer p.configManager.reloadMu.Unlock()
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+
+	bg, backend, err := findServer(p.configManager.GetLatestConfig(), backendGroup, server)
+	if err != nil {
+		return err
+	}
+	lb, ok := bg.Lb.(loadbalancer.Drainable)
+	if !ok {
+		return fmt.Errorf("load balancer of backend group %q does not support draining", backendGroup)
+	}
+
+	lb.SetDrained(backend, drained)
+	if drained {
+		if p.drained[backendGroup] == nil {
+			p.drained[backendGroup] = make(map[string]bool)
+		}
+		p.drained[backendGroup][backend.String()] = true
+		p.logger.Infow("Server drained", "backend_group", backendGroup, "backend", backend.String())
+	} else {
+		delete(p.drained[backendGroup], backend.String())
+		p.logger.Infow("Server enabled", "backend_group", backendGroup, "backend", backend.String())
+	}
+	p.failover.update(bg)
+	return nil
+}
+
+func (p *Proxy) isDrained(backendGroup, backend string) bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	return p.drained[backendGroup][backend]
+}
+
+// applyDrained drains the servers of the new config that were drained before
+// the reload and forgets about the servers that are gone.
+func (p *Proxy) applyDrained(next *config.Config) {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+
+	drained := make(map[string]map[string]bool)
+	for _, bg := range next.BackendGroups {
+		lb, ok := bg.Lb.(loadbalancer.Drainable)
+		for _, server := range bg.AllServers() {
+			if !p.drained[bg.Name][server.String()] {
+				continue
+			}
+			if drained[bg.Name] == nil {
+				drained[bg.Name] = make(map[string]bool)
+			}
+			drained[bg.Name][server.String()] = true
+			if ok {
+				lb.SetDrained(server, true)
+			}
+		}
+	}
+	p.drained = drained
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	serverReq := request.ServerRequest{r}
+	serverReq := request.ServerRequest{Request: r}
 
-	latestConfig := p.configManager.GetLatestConfig()
+	// the config is kept until the request is done, even if reloaded meanwhile
+	latestConfig, release := p.configManager.AcquireLatestConfig()
+	defer release()
 
 	rule, err := latestConfig.GetFirstMatchingRule(serverReq)
 	if err != nil {
@@ -104,22 +367,29 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	rule.ApplyRequestOperations(serverReq)
 
-	targetBackend := rule.BackendGroup.Lb.Next()
-	// here we assume that at least one backend is healthy
-	// TODO: handle case when all backends are unhealthy
-	// for !p.healthChecker.getHealthStatus(rule.BackendGroup.Name, targetBackend.String()) {
-	// 	targetBackend = rule.BackendGroup.Lb.Next()
-	// }
+	targetBackend, done, err := rule.BackendGroup.Lb.Pick(serverReq)
+	if err != nil {
+		p.logger.Errorw(err.Error(), "request_type", "server", "backend_group", rule.BackendGroup.Name,
+			"request_method", r.Method, "request_path", r.URL.Path)
+		w.Header().Set("Retry-After", retryAfter(rule.BackendGroup))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+	p.inFlight.add(rule.BackendGroup.Name, targetBackend.String(), 1)
+	defer p.inFlight.add(rule.BackendGroup.Name, targetBackend.String(), -1)
 
 	clientReq := serverReq.ToClientRequest(targetBackend)
 	resp, err := p.client.Do(clientReq)
 	if err != nil {
+		p.outlierDetector.Record(rule.BackendGroup, targetBackend, 0, err)
 		p.logger.Errorw(err.Error(), "request_type", "client",
 			"request_method", r.Method, "request_url", r.URL.String())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
+	p.outlierDetector.Record(rule.BackendGroup, targetBackend, resp.StatusCode, nil)
 
 	rule.ApplyResponseOperations(resp)
 
@@ -129,3 +399,43 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
+
+// defaultRetryAfter is used when a backend group has no health check
+// that could bring its backends back.
+const defaultRetryAfter = 5 * time.Second
+
+// retryAfter returns the value of the Retry-After header sent to clients when
+// there is no backend to route to.
+//
+// The earliest a backend can become available again is the next health check.
+func retryAfter(bg *config.BackendGroup) string {
+	delay := defaultRetryAfter
+	if bg.HealthCheck != nil {
+		delay = bg.HealthCheck.Interval
+	}
+	return strconv.Itoa(int(math.Ceil(delay.Seconds())))
+}
+
+// inFlightCounter counts the requests being proxied to every backend.
+type inFlightCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int // backendGroup -> backend -> requests
+}
+
+func (c *inFlightCounter) add(backendGroup, backend string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[backendGroup] == nil {
+		c.counts[backendGroup] = make(map[string]int)
+	}
+	c.counts[backendGroup][backend] += delta
+	if c.counts[backendGroup][backend] == 0 {
+		delete(c.counts[backendGroup], backend)
+	}
+}
+
+func (c *inFlightCounter) get(backendGroup, backend string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[backendGroup][backend]
+}
@@ -1,24 +1,29 @@
 package proxy_test
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mouad-eh/wasseet/api/config"
+	"github.com/mouad-eh/wasseet/loadbalancer"
 	"github.com/mouad-eh/wasseet/proxy"
 	"github.com/mouad-eh/wasseet/request"
 	"github.com/mouad-eh/wasseet/testutils/mocks"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestNoRuleMatchesRequest(t *testing.T) {
 	backend := &url.URL{Scheme: "http", Host: "backend.io"}
 
 	backendGroup := &config.BackendGroup{
-		Lb:      &mocks.LoadBalancerMock{NextFunc: func() *url.URL { return backend }},
+		Lb:      newLoadBalancerMock(backend),
 		Servers: []*url.URL{backend},
 	}
 
@@ -51,7 +56,7 @@ func TestNoRuleMatchesRequest(t *testing.T) {
 func TestRuleMatchesRequest(t *testing.T) {
 	backend := &url.URL{Scheme: "http", Host: "backend.io"}
 
-	loadBalancer := &mocks.LoadBalancerMock{NextFunc: func() *url.URL { return backend }}
+	loadBalancer := newLoadBalancerMock(backend)
 
 	backendGroup := &config.BackendGroup{
 		Lb:      loadBalancer,
@@ -92,7 +97,7 @@ func TestRuleMatchesRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	p.ServeHTTP(w, req)
 
-	require.Equal(t, 1, len(loadBalancer.NextCalls()))
+	require.Equal(t, 1, len(loadBalancer.PickCalls()))
 
 	require.Equal(t, 1, len(requestOperation.ApplyCalls()))
 	require.Equal(t, "/foo", requestOperation.ApplyCalls()[0].Req.URL.Path)
@@ -112,8 +117,247 @@ func TestRuleMatchesRequest(t *testing.T) {
 	require.Equal(t, string(body), backend.String())
 }
 
+func TestNoBackendAvailable(t *testing.T) {
+	loadBalancer := &mocks.LoadBalancerMock{
+		PickFunc: func(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error) {
+			return nil, nil, loadbalancer.ErrNoBackendAvailable
+		},
+	}
+
+	backendGroup := &config.BackendGroup{
+		Lb: loadBalancer,
+	}
+
+	config := &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "/foo",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	beClient := NewBackendClientMock(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	)
+	p := proxy.NewProxy(config, beClient)
+
+	req := httptest.NewRequest("GET", "http://proxy.io/foo", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	require.Equal(t, 1, len(loadBalancer.PickCalls()))
+	require.Equal(t, 0, len(beClient.DoCalls()))
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	require.NotEmpty(t, w.Result().Header.Get("Retry-After"))
+}
+
+func TestDoneCalledAfterResponse(t *testing.T) {
+	backend := &url.URL{Scheme: "http", Host: "backend.io"}
+
+	doneCalls := 0
+	loadBalancer := &mocks.LoadBalancerMock{
+		PickFunc: func(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error) {
+			return backend, func() { doneCalls++ }, nil
+		},
+	}
+
+	backendGroup := &config.BackendGroup{
+		Lb:      loadBalancer,
+		Servers: []*url.URL{backend},
+	}
+
+	config := &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "/foo",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	beClient := NewBackendClientMock(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	)
+	p := proxy.NewProxy(config, beClient)
+
+	req := httptest.NewRequest("GET", "http://proxy.io/foo", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, 1, doneCalls)
+}
+
+func TestOutlierDetectionEjectsBackend(t *testing.T) {
+	healthyBackend := &url.URL{Scheme: "http", Host: "healthy.io"}
+	failingBackend := &url.URL{Scheme: "http", Host: "failing.io"}
+	backends := []*url.URL{healthyBackend, failingBackend}
+
+	backendGroup := &config.BackendGroup{
+		Name:    "group",
+		Lb:      loadbalancer.NewRoundRobin(backends),
+		Servers: backends,
+		OutlierDetection: &config.OutlierDetection{
+			Consecutive5xx:     2,
+			Interval:           time.Minute,
+			BaseEjectionTime:   time.Minute,
+			MaxEjectionTime:    time.Minute,
+			MaxEjectionPercent: 50,
+		},
+	}
+
+	config := &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "/foo",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	beClient := NewBackendClientMock(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == failingBackend.Host {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	)
+	p := proxy.NewProxy(config, beClient)
+
+	statusCodes := make([]int, 0)
+	for i := 0; i < 8; i++ {
+		req := httptest.NewRequest("GET", "http://proxy.io/foo", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		statusCodes = append(statusCodes, w.Result().StatusCode)
+	}
+
+	// the failing backend is ejected after its second 5xx response
+	require.Equal(t, []int{200, 500, 200, 500, 200, 200, 200, 200}, statusCodes)
+}
+
+func TestOutlierDetectionMaxEjectionPercent(t *testing.T) {
+	backends := []*url.URL{
+		{Scheme: "http", Host: "backend1.io"},
+		{Scheme: "http", Host: "backend2.io"},
+		{Scheme: "http", Host: "backend3.io"},
+	}
+
+	backendGroup := &config.BackendGroup{
+		Name:    "group",
+		Lb:      loadbalancer.NewRoundRobin(backends),
+		Servers: backends,
+		OutlierDetection: &config.OutlierDetection{
+			ConsecutiveConnectionErrors: 1,
+			Interval:                    time.Minute,
+			BaseEjectionTime:            time.Minute,
+			MaxEjectionTime:             time.Minute,
+			MaxEjectionPercent:          10,
+		},
+	}
+
+	config := &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "/foo",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	// every backend is unreachable
+	beClient := &mocks.BackendClientMock{
+		DoFunc: func(clientRequest request.ClientRequest) (*http.Response, error) {
+			return nil, fmt.Errorf("connection refused")
+		},
+	}
+	p := proxy.NewProxy(config, beClient)
+
+	for i := 0; i < 9; i++ {
+		req := httptest.NewRequest("GET", "http://proxy.io/foo", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+	}
+
+	// only one backend out of three can be ejected, so the two others
+	// keep getting traffic
+	hosts := make(map[string]int)
+	for _, call := range beClient.DoCalls() {
+		hosts[call.ClientRequest.URL.Host]++
+	}
+	require.Len(t, hosts, 3)
+	require.Equal(t, 1, hosts[backends[0].Host])
+}
+
+// TestOutlierDetectionUpdateClearsStaleEjection checks that Update pushes the
+// ejections of the detector to the load balancer of a reloaded config even
+// when the backend is not ejected, since the load balancer may have inherited
+// an older ejection.
+func TestOutlierDetectionUpdateClearsStaleEjection(t *testing.T) {
+	backend := &url.URL{Scheme: "http", Host: "backend.io"}
+	params := &config.OutlierDetection{Consecutive5xx: 1, Interval: time.Minute, BaseEjectionTime: time.Minute, MaxEjectionTime: time.Minute}
+	bg := &config.BackendGroup{Name: "group", Lb: loadbalancer.NewRoundRobin([]*url.URL{backend}), Servers: []*url.URL{backend}, OutlierDetection: params}
+	od := proxy.NewOutlierDetector([]*config.BackendGroup{bg}, zap.NewNop().Sugar())
+
+	lb := loadbalancer.NewRoundRobin([]*url.URL{backend})
+	lb.SetEjected(backend, true)
+	od.Update([]*config.BackendGroup{{Name: "group", Lb: lb, Servers: []*url.URL{backend}, OutlierDetection: params}})
+	_, _, err := lb.Pick(request.ServerRequest{Request: httptest.NewRequest("GET", "/", nil)})
+	require.NoError(t, err)
+}
+
+// closingClient counts the calls to CloseIdleConnections.
+type closingClient struct {
+	*mocks.BackendClientMock
+	closed atomic.Int64
+}
+
+func (c *closingClient) CloseIdleConnections() {
+	c.closed.Add(1)
+}
+
+func TestReleaseClosesIdleConnectionsOfRemovedServers(t *testing.T) {
+	src := &switchingSource{cfg: newGroupConfig("backend1.io")}
+	client := &closingClient{BackendClientMock: NewBackendClientMock(func(w http.ResponseWriter, r *http.Request) {})}
+	p := proxy.NewProxy(src, client)
+	admin := &config.Admin{Network: "tcp", Address: "127.0.0.1:0", Token: "secret"}
+	server := httptest.NewServer(proxy.NewAdminServer(p, admin, zap.NewNop().Sugar()).Handler())
+	t.Cleanup(server.Close)
+
+	// the versions that leave the history have the same servers as the latest one
+	for range 10 {
+		adminRequest(t, "POST", server.URL+"/reload")
+	}
+	require.Zero(t, client.closed.Load())
+
+	src.set(newGroupConfig("backend2.io"))
+	for range 10 {
+		adminRequest(t, "POST", server.URL+"/reload")
+	}
+	require.NotZero(t, client.closed.Load())
+}
+
 //TODO: After implementing backend healthchecks, add test for http client error
 
+func newLoadBalancerMock(backend *url.URL) *mocks.LoadBalancerMock {
+	return &mocks.LoadBalancerMock{
+		PickFunc: func(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error) {
+			return backend, func() {}, nil
+		},
+	}
+}
+
 func NewBackendClientMock(handler http.HandlerFunc) *mocks.BackendClientMock {
 	return &mocks.BackendClientMock{
 		DoFunc: func(clientRequest request.ClientRequest) (*http.Response, error) {
@@ -1,14 +1,18 @@
 package integration_tests
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -242,7 +246,6 @@ func TestAddHeaderResponseOperation(t *testing.T) {
 }
 
 func TestHealthChecks(t *testing.T) {
-	t.Skip("health checks feature has been commented out in order to easily refactor config loading")
 	// start two backend servers
 	responseBodyServer1 := "backend1"
 	backendServer1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -256,14 +259,18 @@ func TestHealthChecks(t *testing.T) {
 	defer backendServer1.Close()
 
 	responseBodyServer2 := "backend2"
-	healthyHandlerServer2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var server2Down atomic.Bool
+	backendServer2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server2Down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		if r.URL.Path == "/health" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 		w.Write([]byte(responseBodyServer2))
-	})
-	backendServer2 := httptest.NewServer(healthyHandlerServer2)
+	}))
 	backendURL2, _ := url.Parse(backendServer2.URL)
 	defer backendServer2.Close()
 
@@ -274,10 +281,13 @@ func TestHealthChecks(t *testing.T) {
 		Lb:      loadbalancer.NewRoundRobin(backendURLs),
 		Servers: backendURLs,
 		HealthCheck: &config.HealthCheck{
-			Path:     "/health",
-			Interval: 20 * time.Millisecond,
-			Timeout:  5 * time.Millisecond,
-			Retries:  3,
+			Path:               "/health",
+			Method:             http.MethodGet,
+			ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+			Interval:           20 * time.Millisecond,
+			Timeout:            5 * time.Millisecond,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 3,
 		},
 	}
 
@@ -322,10 +332,7 @@ func TestHealthChecks(t *testing.T) {
 	require.GreaterOrEqual(t, numOfRespFromServer2, 1)
 
 	// simulate server 2 going down
-	unhealthyHandlerServer2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusServiceUnavailable)
-	})
-	backendServer2.Config.Handler = unhealthyHandlerServer2
+	server2Down.Store(true)
 
 	// wait for the proxy to detect that backend server 2 is down
 	time.Sleep(100 * time.Millisecond)
@@ -353,7 +360,7 @@ func TestHealthChecks(t *testing.T) {
 	require.Equal(t, numOfRespFromServer2, 0)
 
 	// bring back server 2 to life
-	backendServer2.Config.Handler = healthyHandlerServer2
+	server2Down.Store(false)
 	time.Sleep(100 * time.Millisecond)
 
 	// send requests to proxy after server 2 is back up
@@ -379,6 +386,229 @@ func TestHealthChecks(t *testing.T) {
 	require.GreaterOrEqual(t, numOfRespFromServer2, 1)
 }
 
+func TestHealthCheckExpectedBody(t *testing.T) {
+	healthyBody := "healthy"
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.Write([]byte("status: up"))
+			return
+		}
+		w.Write([]byte(healthyBody))
+	}))
+	healthyURL, _ := url.Parse(healthyServer.URL)
+	defer healthyServer.Close()
+
+	// the degraded server keeps answering 200 to its health checks,
+	// only the body tells that it should not receive traffic.
+	degradedBody := "degraded"
+	var degraded atomic.Bool
+	degradedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.Write([]byte(degradedBody))
+			return
+		}
+		if r.Host != "health.internal" || r.Header.Get("X-Probe") != "wasseet" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if degraded.Load() {
+			w.Write([]byte("status: down"))
+			return
+		}
+		w.Write([]byte("status: up"))
+	}))
+	degradedURL, _ := url.Parse(degradedServer.URL)
+	defer degradedServer.Close()
+
+	backendURLs := []*url.URL{healthyURL, degradedURL}
+	backendGroup := &config.BackendGroup{
+		Name:    "test-group",
+		Lb:      loadbalancer.NewRoundRobin(backendURLs),
+		Servers: backendURLs,
+		HealthCheck: &config.HealthCheck{
+			Path:               "/health",
+			Method:             http.MethodGet,
+			Host:               "health.internal",
+			Headers:            http.Header{"X-Probe": {"wasseet"}},
+			ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 299}},
+			ExpectedBodyRegex:  regexp.MustCompile("^status: up$"),
+			Interval:           20 * time.Millisecond,
+			Timeout:            10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	}
+	proxyConfig := &config.Config{
+		Port:          0,
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules:         []*config.Rule{{Path: "", BackendGroup: backendGroup}},
+	}
+
+	proxyServer := proxy.NewProxy(proxyConfig, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxyServer)
+	defer proxyServer.Stop()
+
+	countResponses := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			resp, err := http.Get(proxyURL + "/")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			counts[string(body)]++
+		}
+		return counts
+	}
+
+	// wait for a few checks so that a misconfigured request would have
+	// marked the degraded server unhealthy already
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 3, countResponses()[degradedBody])
+
+	degraded.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, countResponses()[degradedBody])
+
+	degraded.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 3, countResponses()[degradedBody])
+}
+
+func TestOutlierDetection(t *testing.T) {
+	healthyBody := "healthy"
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(healthyBody))
+	}))
+	healthyURL, _ := url.Parse(healthyServer.URL)
+	defer healthyServer.Close()
+
+	flakyBody := "flaky"
+	var flakyDown atomic.Bool
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(flakyBody))
+	}))
+	flakyURL, _ := url.Parse(flakyServer.URL)
+	defer flakyServer.Close()
+
+	backendURLs := []*url.URL{healthyURL, flakyURL}
+	backendGroup := &config.BackendGroup{
+		Name:    "test-group",
+		Lb:      loadbalancer.NewRoundRobin(backendURLs),
+		Servers: backendURLs,
+		OutlierDetection: &config.OutlierDetection{
+			Consecutive5xx:     1,
+			Interval:           20 * time.Millisecond,
+			BaseEjectionTime:   50 * time.Millisecond,
+			MaxEjectionTime:    time.Second,
+			MaxEjectionPercent: 50,
+		},
+	}
+	proxyConfig := &config.Config{
+		Port:          0,
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	proxyServer := proxy.NewProxy(proxyConfig, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxyServer)
+	defer proxyServer.Stop()
+
+	get := func() (int, string) {
+		resp, err := http.Get(proxyURL + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	// the flaky server fails once and gets ejected
+	flakyDown.Store(true)
+	failures := 0
+	for i := 0; i < 6; i++ {
+		if status, _ := get(); status != http.StatusOK {
+			failures++
+		}
+	}
+	require.Equal(t, 1, failures)
+
+	// once it recovers, it gets traffic again after its ejection time
+	flakyDown.Store(false)
+	require.Eventually(t, func() bool {
+		_, body := get()
+		return body == flakyBody
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestOutlierDetectionSuccessRate(t *testing.T) {
+	numBackends := 3
+	backendURLs := make([]*url.URL, numBackends)
+	for i := 0; i < numBackends; i++ {
+		backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the last backend fails every request
+			if i == numBackends-1 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		backendURLs[i], _ = url.Parse(backendServer.URL)
+		defer backendServer.Close()
+	}
+
+	backendGroup := &config.BackendGroup{
+		Name:    "test-group",
+		Lb:      loadbalancer.NewRoundRobin(backendURLs),
+		Servers: backendURLs,
+		OutlierDetection: &config.OutlierDetection{
+			SuccessRateStdevFactor:   1,
+			SuccessRateMinimumHosts:  3,
+			SuccessRateRequestVolume: 5,
+			Interval:                 100 * time.Millisecond,
+			BaseEjectionTime:         time.Minute,
+			MaxEjectionTime:          time.Minute,
+			MaxEjectionPercent:       50,
+		},
+	}
+	proxyConfig := &config.Config{
+		Port:          0,
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules: []*config.Rule{
+			{
+				Path:         "",
+				BackendGroup: backendGroup,
+			},
+		},
+	}
+
+	proxyServer := proxy.NewProxy(proxyConfig, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxyServer)
+	defer proxyServer.Stop()
+
+	// keep sending traffic until the failing backend is ejected
+	// by the success rate analysis
+	require.Eventually(t, func() bool {
+		for i := 0; i < numBackends*2; i++ {
+			resp, err := http.Get(proxyURL + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
 func TestYamlConfigLoading(t *testing.T) {
 	bodyContent := "Hello World!"
 	// start a backend server
@@ -468,6 +698,209 @@ func TestYamlConfigReloading(t *testing.T) {
 	defer resp_v1.Body.Close()
 }
 
+func TestYamlConfigAutoReloading(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backendURL, _ := url.Parse(backendServer.URL)
+	defer backendServer.Close()
+
+	// the configs of TestYamlConfigReloading route /v0 and /v1 respectively
+	templateDir := filepath.Join("testdata", "TestYamlConfigReloading")
+	tempConfigFile_v0 := createTempConfigFile(t, filepath.Join(templateDir, "config_v0.yaml"), backendURL)
+	defer os.Remove(tempConfigFile_v0.Name())
+	tempConfigFile_v1 := createTempConfigFile(t, filepath.Join(templateDir, "config_v1.yaml"), backendURL)
+	defer os.Remove(tempConfigFile_v1.Name())
+
+	configSrc := yaml.Source{Path: tempConfigFile_v0.Name(), AutoReload: true, Debounce: 10 * time.Millisecond}
+	proxy := proxy.NewProxy(&configSrc, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxy)
+	defer proxy.Stop()
+
+	requireStatus := func(path string, status int) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			resp, err := http.Get(proxyURL + path)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == status
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+	requireStatus("/v0", http.StatusOK)
+
+	// an invalid file is skipped, the v0 config keeps serving requests
+	require.NoError(t, os.WriteFile(tempConfigFile_v0.Name(), []byte("port: -1\n"), 0o644))
+	time.Sleep(100 * time.Millisecond)
+	requireStatus("/v0", http.StatusOK)
+
+	// the v1 config is loaded without SIGHUP
+	require.NoError(t, os.Rename(tempConfigFile_v1.Name(), tempConfigFile_v0.Name()))
+	requireStatus("/v1", http.StatusOK)
+	requireStatus("/v0", http.StatusNotFound)
+}
+
+func TestHealthStateSurvivesConfigReload(t *testing.T) {
+	// start a healthy and an unhealthy backend server
+	healthyBody := "healthy"
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(healthyBody))
+	}))
+	healthyURL, _ := url.Parse(healthyServer.URL)
+	defer healthyServer.Close()
+
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	unhealthyURL, _ := url.Parse(unhealthyServer.URL)
+	defer unhealthyServer.Close()
+
+	replacements := map[string]string{
+		"{{BACKEND_URL}}":           healthyURL.String(),
+		"{{UNHEALTHY_BACKEND_URL}}": unhealthyURL.String(),
+	}
+	tempConfigFile_v0 := fillConfigTemplate(t, filepath.Join("testdata", t.Name(), "config_v0.yaml"), replacements)
+	defer os.Remove(tempConfigFile_v0.Name())
+	tempConfigFile_v1 := fillConfigTemplate(t, filepath.Join("testdata", t.Name(), "config_v1.yaml"), replacements)
+
+	configSrc := yaml.Source{Path: tempConfigFile_v0.Name()}
+	proxy := proxy.NewProxy(&configSrc, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxy)
+	defer proxy.Stop()
+
+	// wait for the unhealthy backend to be detected
+	time.Sleep(250 * time.Millisecond)
+
+	// reload the config and wait for it to be applied
+	os.Rename(tempConfigFile_v1.Name(), tempConfigFile_v0.Name())
+	p, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, p.Signal(syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(proxyURL + "/v1")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode != http.StatusNotFound
+	}, time.Second, 5*time.Millisecond)
+
+	// the unhealthy backend must not get traffic right after the reload,
+	// before the next health check had a chance to run
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(proxyURL + "/v1")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, healthyBody, string(body))
+	}
+}
+
+func TestAdminAPIOverUnixSocket(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backendURL, _ := url.Parse(backendServer.URL)
+	defer backendServer.Close()
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	templatePath := filepath.Join("testdata", t.Name(), "config.yaml")
+	tempConfigFile := fillConfigTemplate(t, templatePath, map[string]string{
+		"{{BACKEND_URL}}":  backendURL.String(),
+		"{{ADMIN_SOCKET}}": socket,
+	})
+	defer os.Remove(tempConfigFile.Name())
+
+	configSrc := yaml.Source{Path: tempConfigFile.Name()}
+	proxy := proxy.NewProxy(&configSrc, &proxy.HttpClient{Client: &http.Client{}})
+	startProxyAndGetURL(t, proxy)
+	defer proxy.Stop()
+	require.Equal(t, socket, proxy.GetAdminAddr())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	req, err := http.NewRequest("GET", "http://admin/backend_groups", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"address":"`+backendURL.String()+`"`)
+}
+
+func TestHealthCheckRuntimeServer(t *testing.T) {
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("healthy"))
+	}))
+	defer healthyServer.Close()
+	healthyURL, _ := url.Parse(healthyServer.URL)
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthyServer.Close()
+	unhealthyURL, _ := url.Parse(unhealthyServer.URL)
+
+	backendURLs := []*url.URL{healthyURL}
+	backendGroup := &config.BackendGroup{
+		Name:    "test-group",
+		Lb:      loadbalancer.NewRoundRobin(backendURLs),
+		Servers: backendURLs,
+		HealthCheck: &config.HealthCheck{
+			Path:               "/health",
+			Method:             http.MethodGet,
+			ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}},
+			Interval:           20 * time.Millisecond,
+			Timeout:            5 * time.Millisecond,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+		},
+	}
+	proxyConfig := &config.Config{
+		BackendGroups: []*config.BackendGroup{backendGroup},
+		Rules:         []*config.Rule{{BackendGroup: backendGroup}},
+		Admin:         &config.Admin{Network: "tcp", Address: "127.0.0.1:0", Token: "secret"},
+	}
+	proxyServer := proxy.NewProxy(proxyConfig, &proxy.HttpClient{Client: &http.Client{}})
+	proxyURL := startProxyAndGetURL(t, proxyServer)
+	defer proxyServer.Stop()
+
+	// register the unhealthy server through the admin API
+	req, err := http.NewRequest("POST", "http://"+proxyServer.GetAdminAddr()+"/backend_groups/test-group/servers",
+		strings.NewReader(`{"address": "`+unhealthyURL.Host+`"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// it gets health checked and stops receiving traffic
+	require.Eventually(t, func() bool {
+		for i := 0; i < 4; i++ {
+			resp, err := http.Get(proxyURL + "/")
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
 // startProxyAndGetURL starts the proxy in a separate goroutine and waits for its address to be available
 func startProxyAndGetURL(t *testing.T, proxyServer *proxy.Proxy) string {
 	go func() {
@@ -490,11 +923,19 @@ func startProxyAndGetURL(t *testing.T, proxyServer *proxy.Proxy) string {
 
 // createTempConfigFile creates a temporary config file from the given template and backend URL
 func createTempConfigFile(t *testing.T, templatePath string, backendURL *url.URL) *os.File {
+	return fillConfigTemplate(t, templatePath, map[string]string{"{{BACKEND_URL}}": backendURL.String()})
+}
+
+// fillConfigTemplate creates a temporary config file from the given template
+// by replacing each placeholder with its value
+func fillConfigTemplate(t *testing.T, templatePath string, replacements map[string]string) *os.File {
 	template, err := os.ReadFile(templatePath)
 	require.NoError(t, err)
 
-	// replace placeholder with actual backend URL
-	configContent := strings.ReplaceAll(string(template), "{{BACKEND_URL}}", backendURL.String())
+	configContent := string(template)
+	for placeholder, value := range replacements {
+		configContent = strings.ReplaceAll(configContent, placeholder, value)
+	}
 
 	// write to temporary file
 	tempConfigFile, err := os.CreateTemp("", "proxy_config_*.yaml")
@@ -5,6 +5,7 @@ package mocks
 
 import (
 	"github.com/mouad-eh/wasseet/loadbalancer"
+	"github.com/mouad-eh/wasseet/request"
 	"net/url"
 	"sync"
 )
@@ -19,8 +20,8 @@ var _ loadbalancer.LoadBalancer = &LoadBalancerMock{}
 //
 //		// make and configure a mocked loadbalancer.LoadBalancer
 //		mockedLoadBalancer := &LoadBalancerMock{
-//			NextFunc: func() *url.URL {
-//				panic("mock out the Next method")
+//			PickFunc: func(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error) {
+//				panic("mock out the Pick method")
 //			},
 //		}
 //
@@ -29,41 +30,48 @@ var _ loadbalancer.LoadBalancer = &LoadBalancerMock{}
 //
 //	}
 type LoadBalancerMock struct {
-	// NextFunc mocks the Next method.
-	NextFunc func() *url.URL
+	// PickFunc mocks the Pick method.
+	PickFunc func(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
-		// Next holds details about calls to the Next method.
-		Next []struct {
+		// Pick holds details about calls to the Pick method.
+		Pick []struct {
+			// Req is the req argument value.
+			Req request.ServerRequest
 		}
 	}
-	lockNext sync.RWMutex
+	lockPick sync.RWMutex
 }
 
-// Next calls NextFunc.
-func (mock *LoadBalancerMock) Next() *url.URL {
-	if mock.NextFunc == nil {
-		panic("LoadBalancerMock.NextFunc: method is nil but LoadBalancer.Next was just called")
+// Pick calls PickFunc.
+func (mock *LoadBalancerMock) Pick(req request.ServerRequest) (*url.URL, loadbalancer.DoneFunc, error) {
+	if mock.PickFunc == nil {
+		panic("LoadBalancerMock.PickFunc: method is nil but LoadBalancer.Pick was just called")
 	}
 	callInfo := struct {
-	}{}
-	mock.lockNext.Lock()
-	mock.calls.Next = append(mock.calls.Next, callInfo)
-	mock.lockNext.Unlock()
-	return mock.NextFunc()
+		Req request.ServerRequest
+	}{
+		Req: req,
+	}
+	mock.lockPick.Lock()
+	mock.calls.Pick = append(mock.calls.Pick, callInfo)
+	mock.lockPick.Unlock()
+	return mock.PickFunc(req)
 }
 
-// NextCalls gets all the calls that were made to Next.
+// PickCalls gets all the calls that were made to Pick.
 // Check the length with:
 //
-//	len(mockedLoadBalancer.NextCalls())
-func (mock *LoadBalancerMock) NextCalls() []struct {
+//	len(mockedLoadBalancer.PickCalls())
+func (mock *LoadBalancerMock) PickCalls() []struct {
+	Req request.ServerRequest
 } {
 	var calls []struct {
+		Req request.ServerRequest
 	}
-	mock.lockNext.RLock()
-	calls = mock.calls.Next
-	mock.lockNext.RUnlock()
+	mock.lockPick.RLock()
+	calls = mock.calls.Pick
+	mock.lockPick.RUnlock()
 	return calls
 }